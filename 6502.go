@@ -1,28 +1,263 @@
-package main
+// Package mos6502 implements the MOS 6502 (6507) processor.
+//
+// A Cpu is built on top of a Mem, which provides the whole address space
+// of the processor:
+//
+//	cpu := mos6502.NewCpu(mem)
+//	cpu.Reset()
+//	for {
+//		cpu.Step()
+//	}
+package mos6502
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+)
 
 // the main struct, containing the main registers,
 // the processor's status and the memory
 type Cpu struct {
-	pc, sp, ac, x, y int
+	pc               uint16
+	sp, ac, x, y     uint8
 	pbCrossed        bool
+	irq, nmi         bool
+	nmiPending       bool
+	overshoot        int
+	halted           bool
+	undefinedPolicy  UndefinedPolicy
+	illegalOpcodes   IllegalOpcodes
+	variant          Variant
+	waiting          bool
+	extraCycles      int
 	p                ProcStat
 	mem              Mem
+	tracer           *Tracer
+
+	// cycle by cycle running, see Tick
+	ticks     func() (BusCycle, bool)
+	stopTicks func()
+	yield     func(BusCycle) bool
+	lastCycle BusCycle
+	pending   bool
+	accesses  int
+	boundary  bool
+	tickErr   error
+}
+
+// NewCpu returns an NMOS 6502 attached to the given memory. Its registers
+// are all zero: call Reset to run the power-on sequence.
+func NewCpu(mem Mem) *Cpu {
+	return NewCpuVariant(mem, NMOS6502)
+}
+
+// NewCpuVariant returns a processor of the given variant attached to the
+// given memory. Its registers are all zero: call Reset to run the power-on
+// sequence.
+func NewCpuVariant(mem Mem, variant Variant) *Cpu {
+	if variant == MOS6507 {
+		mem = &addrMask{mem: mem, mask: 0x1FFF}
+	}
+	return &Cpu{mem: mem, variant: variant}
+}
+
+// Variant is the model of the processor
+type Variant int
+
+// Processor variants
+const (
+	// The original NMOS 6502
+	NMOS6502 Variant = iota
+	// The 6507 of the Atari 2600: a 6502 with only 13 address lines and
+	// no IRQ and NMI pins
+	MOS6507
+	// The Ricoh 2A03 of the NES: a 6502 without decimal mode. The D flag
+	// can be set, but ADC and SBC ignore it
+	RICOH2A03
+	// The WDC 65C02: adds BRA, PHX, PHY, PLX, PLY, STZ, TRB, TSB, INC A,
+	// DEC A, the new BIT modes, (zp) addressing, JMP (abs,X), RMB, SMB,
+	// BBR, BBS, WAI and STP. Decimal mode sets N and Z properly, taking
+	// one more cycle, interrupts clear the D flag and the undocumented
+	// opcodes are all NOPs
+	WDC65C02
+)
+
+// Variant returns the model of the processor
+func (cpu *Cpu) Variant() Variant {
+	return cpu.variant
+}
+
+// a memory seen through an address bus narrower than 16 bits
+type addrMask struct {
+	mem  Mem
+	mask uint16
+}
+
+func (m *addrMask) Read(addr uint16) uint8 {
+	return m.mem.Read(addr & m.mask)
+}
+
+func (m *addrMask) Write(addr uint16, value uint8) {
+	m.mem.Write(addr&m.mask, value)
+}
+
+// register accessors
+
+// PC returns the program counter
+func (cpu *Cpu) PC() uint16 {
+	return cpu.pc
+}
+
+// SetPC sets the program counter
+func (cpu *Cpu) SetPC(pc uint16) {
+	cpu.pc = pc
+}
+
+// SP returns the stack pointer
+func (cpu *Cpu) SP() uint8 {
+	return cpu.sp
+}
+
+// SetSP sets the stack pointer
+func (cpu *Cpu) SetSP(sp uint8) {
+	cpu.sp = sp
+}
+
+// AC returns the accumulator
+func (cpu *Cpu) AC() uint8 {
+	return cpu.ac
+}
+
+// SetAC sets the accumulator
+func (cpu *Cpu) SetAC(ac uint8) {
+	cpu.ac = ac
+}
+
+// X returns the X index register
+func (cpu *Cpu) X() uint8 {
+	return cpu.x
+}
+
+// SetX sets the X index register
+func (cpu *Cpu) SetX(x uint8) {
+	cpu.x = x
+}
+
+// Y returns the Y index register
+func (cpu *Cpu) Y() uint8 {
+	return cpu.y
+}
+
+// SetY sets the Y index register
+func (cpu *Cpu) SetY(y uint8) {
+	cpu.y = y
+}
+
+// Status returns the processor status. Changes made through the returned
+// pointer are seen by the processor.
+func (cpu *Cpu) Status() *ProcStat {
+	return &cpu.p
+}
+
+// Mem returns the memory the processor is attached to, as the processor
+// sees it through its address bus
+func (cpu *Cpu) Mem() Mem {
+	return cpu.mem
+}
+
+// Halted reports whether the processor is halted. Only Reset gets it
+// running again.
+func (cpu *Cpu) Halted() bool {
+	return cpu.halted
+}
+
+// SetUndefinedPolicy tells the processor what to do with the opcodes it
+// doesn't implement
+func (cpu *Cpu) SetUndefinedPolicy(policy UndefinedPolicy) {
+	cpu.undefinedPolicy = policy
+}
+
+// SetIllegalOpcodes selects which of the undocumented opcodes of the NMOS
+// part are run. The rest of them go through the undefined opcode policy
+func (cpu *Cpu) SetIllegalOpcodes(illegal IllegalOpcodes) {
+	cpu.illegalOpcodes = illegal
 }
 
+// IllegalOpcodes selects which of the undocumented opcodes of the NMOS
+// part the processor runs
+type IllegalOpcodes int
+
+// Illegal opcode sets
+const (
+	// None of them, they all go through the undefined opcode policy. This
+	// is the default
+	IllegalNone IllegalOpcodes = iota
+	// The stable ones: LAX, SAX, DCP, ISC, SLO, RLA, SRE, RRA, ANC, ALR,
+	// ARR, SBX, SBC #imm, the NOPs and JAM, which halts the processor
+	IllegalStable
+	// All of them, including the unstable XAA, LXA, AHX, TAS, SHX, SHY and
+	// LAS
+	IllegalAll
+)
+
+// UnstableMagic is the constant the unstable XAA and LXA opcodes mix into
+// the accumulator: A = (A | UnstableMagic) & ... On real hardware it
+// depends on the chip, and even on its temperature; $EE is the value most
+// commonly observed
+const UnstableMagic = 0xEE
+
+// UndefinedPolicy is what the processor does when it fetches an opcode it
+// doesn't implement
+type UndefinedPolicy int
+
+// Undefined opcode policies
+const (
+	// The opcode is not executed and Step returns an
+	// *UndefinedOpcodeError. This is the default
+	UndefinedError UndefinedPolicy = iota
+	// The processor halts on the opcode until it is reset
+	UndefinedHalt
+	// The opcode is run as a NOP, taking the bytes and cycles the NMOS
+	// part takes for it
+	UndefinedNop
+)
+
+// UndefinedOpcodeError reports an opcode the processor doesn't implement,
+// and the address it was fetched from
+type UndefinedOpcodeError struct {
+	Opcode uint8
+	PC     uint16
+}
+
+func (e *UndefinedOpcodeError) Error() string {
+	return fmt.Sprintf("undefined opcode $%02X at $%04X", e.Opcode, e.PC)
+}
+
+// ErrHalted is returned by RunUntil when the processor is halted, as it
+// won't make any progress until it is reset
+var ErrHalted = errors.New("processor halted")
+
 // the status flags of the processor
-// carry, zero, interrupt, decimal, break,
-// negative, overflow
+// carry, zero, interrupt, decimal, negative, overflow
+//
+// The break flag is not a real flag: it only exists in the copies of the
+// status pushed onto the stack, where it tells BRK and PHP (set) apart from
+// IRQ and NMI (clear). Bit 5 is unused and always reads as set.
 type ProcStat struct {
-	c, z, i, d, b, n, v int
+	c, z, i, d, n, v int
 }
 
-// returns the status as an int word
-func (p *ProcStat) getAsWord() (pstatus int) {
-	pstatus = p.c | p.z<<1 | p.i<<2 | p.d<<3 | p.b<<4 | p.v<<6 | p.n<<7
+// returns the status as a byte, with the unused bit set and the break flag
+// clear
+func (p *ProcStat) getAsWord() (pstatus uint8) {
+	pstatus = uint8(p.c | p.z<<1 | p.i<<2 | p.d<<3 | BIT_5 | p.v<<6 | p.n<<7)
 	return
 }
 
-func (p *ProcStat) setAsWord(pstatus int) {
+// sets the status from a byte. The break flag and the unused bit don't
+// exist in the register, so they are ignored
+func (p *ProcStat) setAsWord(pstatus uint8) {
 	if pstatus&BIT_0 == 0 {
 		p.c = 0
 	} else {
@@ -43,26 +278,92 @@ func (p *ProcStat) setAsWord(pstatus int) {
 	} else {
 		p.d = 1
 	}
-	if pstatus&BIT_4 == 0 {
-		p.b = 0
-	} else {
-		p.b = 1
-	}
 	if pstatus&BIT_6 == 0 {
-		p.n = 0
+		p.v = 0
 	} else {
-		p.n = 1
+		p.v = 1
 	}
 	if pstatus&BIT_7 == 0 {
-		p.v = 0
+		p.n = 0
 	} else {
-		p.v = 1
+		p.n = 1
 	}
 }
 
+// AsWord returns the status as a byte, as PHP would push it but with the
+// break flag clear
+func (p *ProcStat) AsWord() uint8 {
+	return p.getAsWord()
+}
+
+// SetAsWord sets the status from a byte, as PLP would do
+func (p *ProcStat) SetAsWord(pstatus uint8) {
+	p.setAsWord(pstatus)
+}
+
+// Carry returns the carry flag (c)
+func (p *ProcStat) Carry() bool {
+	return p.c == 1
+}
+
+// SetCarry sets the carry flag (c)
+func (p *ProcStat) SetCarry(set bool) {
+	p.c = flag(set)
+}
+
+// Zero returns the zero flag (z)
+func (p *ProcStat) Zero() bool {
+	return p.z == 1
+}
+
+// SetZero sets the zero flag (z)
+func (p *ProcStat) SetZero(set bool) {
+	p.z = flag(set)
+}
+
+// Interrupt returns the interrupt disable flag (i)
+func (p *ProcStat) Interrupt() bool {
+	return p.i == 1
+}
+
+// SetInterrupt sets the interrupt disable flag (i)
+func (p *ProcStat) SetInterrupt(set bool) {
+	p.i = flag(set)
+}
+
+// Decimal returns the decimal mode flag (d)
+func (p *ProcStat) Decimal() bool {
+	return p.d == 1
+}
+
+// SetDecimal sets the decimal mode flag (d)
+func (p *ProcStat) SetDecimal(set bool) {
+	p.d = flag(set)
+}
+
+// Overflow returns the overflow flag (v)
+func (p *ProcStat) Overflow() bool {
+	return p.v == 1
+}
+
+// SetOverflow sets the overflow flag (v)
+func (p *ProcStat) SetOverflow(set bool) {
+	p.v = flag(set)
+}
+
+// Negative returns the negative flag (n)
+func (p *ProcStat) Negative() bool {
+	return p.n == 1
+}
+
+// SetNegative sets the negative flag (n)
+func (p *ProcStat) SetNegative(set bool) {
+	p.n = flag(set)
+}
+
 // sets the negative flag (n) from the
 // data given
-func (p *ProcStat) setN(data int) {
+func (p *ProcStat) setN(data uint8) {
 	if data&BIT_7 == BIT_7 {
 		p.n = 1
 	} else {
@@ -72,7 +373,7 @@ func (p *ProcStat) setN(data int) {
 
 // set the zero flag (z) from the data
 // given
-func (p *ProcStat) setZ(data int) {
+func (p *ProcStat) setZ(data uint8) {
 	if data == 0 {
 		p.z = 1
 	} else {
@@ -83,13 +384,45 @@ func (p *ProcStat) setZ(data int) {
 // the memory interface
 // a memory must be provided for the cpu to work
 type Mem interface {
+	Read(addr uint16) uint8
+	Write(addr uint16, value uint8)
+}
+
+// IntMem is a memory that reads and writes ints, as Mem used to. Wrap it
+// with AdaptIntMem to use it as a Mem.
+type IntMem interface {
 	Read(addr int) int
 	Write(addr, value int)
 }
 
-// interprets a word as bcd
-func bcd(n int) int {
-	return (n & 0xF) + (n & 0xF0 >> 4 * 10)
+// AdaptIntMem turns an IntMem into a Mem. The values it reads are cut to
+// their low 8 bits.
+func AdaptIntMem(mem IntMem) Mem {
+	return intMem{mem}
+}
+
+type intMem struct {
+	mem IntMem
+}
+
+func (m intMem) Read(addr uint16) uint8 {
+	return uint8(m.mem.Read(int(addr)))
+}
+
+func (m intMem) Write(addr uint16, value uint8) {
+	m.mem.Write(int(addr), int(value))
+}
+
+// RAM is a flat 64K memory, with nothing but RAM in the whole address
+// space
+type RAM [1 << 16]uint8
+
+func (r *RAM) Read(addr uint16) uint8 {
+	return r[addr]
+}
+
+func (r *RAM) Write(addr uint16, value uint8) {
+	r[addr] = value
 }
 
 // Register constants
@@ -112,821 +445,390 @@ const (
 	BIT_8
 )
 
-func (cpu *Cpu) execute() (resCycles int) {
-	// grab current instruction and increment pc
-	inst := cpu.mem.Read(cpu.pc)
-	cpu.pc++
-
-	switch inst {
-	case 0x69:
-		cpu.adc(cpu.imm())
-		resCycles = 2
-
-	case 0x65:
-		cpu.adc(cpu.zp())
-		resCycles = 3
-
-	case 0x75:
-		cpu.adc(cpu.zpx())
-		resCycles = 4
-
-	case 0x6D:
-		cpu.adc(cpu.abs())
-		resCycles = 4
-
-	case 0x7D:
-		cpu.adc(cpu.abx())
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
-
-	case 0x79:
-		cpu.adc(cpu.aby())
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
-
-	case 0x61:
-		cpu.adc(cpu.indx())
-		resCycles = 6
-
-	case 0x71:
-		cpu.adc(cpu.indy())
-		if cpu.pbCrossed {
-			resCycles = 6
-		} else {
-			resCycles = 5
-		}
-
-	// AND's
-	case 0x29:
-		cpu.and(cpu.imm())
-		resCycles = 2
-
-	case 0x25:
-		cpu.and(cpu.zp())
-		resCycles = 2
-
-	case 0x35:
-		cpu.and(cpu.zpx())
-		resCycles = 3
-
-	case 0x2D:
-		cpu.and(cpu.abs())
-		resCycles = 4
-
-	case 0x3D:
-		cpu.and(cpu.abx())
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
-
-	case 0x39:
-		cpu.and(cpu.aby())
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
-
-	case 0x21:
-		cpu.and(cpu.indx())
-		resCycles = 6
-
-	case 0x31:
-		cpu.and(cpu.indy())
-		if cpu.pbCrossed {
-			resCycles = 6
-		} else {
-			resCycles = 5
-		}
-
-	// ASL's
-	case 0x0A:
-		cpu.asla()
-		resCycles = 2
-
-	case 0x06:
-		cpu.asl(cpu.zp())
-		resCycles = 5
-
-	case 0x16:
-		cpu.asl(cpu.zpx())
-		resCycles = 6
-
-	case 0x0E:
-		cpu.asl(cpu.abs())
-		resCycles = 6
+// Vector constants
+const (
+	NMI_VECTOR   = 0xFFFA
+	RESET_VECTOR = 0xFFFC
+	IRQ_VECTOR   = 0xFFFE
+)
 
-	case 0x1E:
-		cpu.asl(cpu.abx())
-		resCycles = 7
+// Reset runs the power-on/reset sequence of the processor: the program
+// counter is loaded from the reset vector ($FFFC/$FFFD), the stack pointer
+// is set to $FD and interrupts are disabled. Like on the real chip, it
+// takes 7 cycles.
+func (cpu *Cpu) Reset() (resCycles int) {
+	var l, h uint16
 
-	// BCC
-	case 0x90:
-		if cpu.bcc(cpu.rel()) {
-			if cpu.pbCrossed {
-				resCycles = 4
-			} else {
-				resCycles = 3
-			}
-		} else {
-			resCycles = 2
-		}
+	// an instruction in progress under Tick is abandoned
+	cpu.stopTicking()
 
-	// BCS
-	case 0xB0:
-		if cpu.bcs(cpu.rel()) {
-			if cpu.pbCrossed {
-				resCycles = 4
-			} else {
-				resCycles = 3
-			}
-		} else {
-			resCycles = 2
-		}
+	cpu.sp = 0xFD
+	cpu.p.i = 1
+	cpu.halted = false
+	cpu.waiting = false
 
-	// BEQ
-	case 0xF0:
-		if cpu.beq(cpu.rel()) {
-			if cpu.pbCrossed {
-				resCycles = 4
-			} else {
-				resCycles = 3
-			}
-		} else {
-			resCycles = 2
-		}
+	l = uint16(cpu.read(RESET_VECTOR))
+	h = uint16(cpu.read(RESET_VECTOR+1)) << 8
+	cpu.pc = h | l
 
-	// BIT
-	case 0x24:
-		cpu.bit(cpu.zp())
-		resCycles = 3
-
-	case 0x2C:
-		cpu.bit(cpu.abs())
-		resCycles = 4
-
-	// BMI
-	case 0x30:
-		if cpu.bmi(cpu.rel()) {
-			if cpu.pbCrossed {
-				resCycles = 4
-			} else {
-				resCycles = 3
-			}
-		} else {
-			resCycles = 2
-		}
+	resCycles = 7
+	return
+}
 
-	// BNE
-	case 0xD0:
-		if cpu.bne(cpu.rel()) {
-			if cpu.pbCrossed {
-				resCycles = 4
-			} else {
-				resCycles = 3
-			}
-		} else {
-			resCycles = 2
-		}
+// SetIRQ drives the maskable interrupt line. The line is level-triggered:
+// as long as it is asserted and the interrupt flag is clear, an interrupt
+// is taken before the next instruction. The 6507 has no IRQ pin, so it
+// ignores it.
+func (cpu *Cpu) SetIRQ(asserted bool) {
+	if cpu.variant == MOS6507 {
+		return
+	}
+	cpu.irq = asserted
+}
 
-	// BPL
-	case 0x10:
-		if cpu.bpl(cpu.rel()) {
-			if cpu.pbCrossed {
-				resCycles = 4
-			} else {
-				resCycles = 3
+// SetNMI drives the non-maskable interrupt line. The line is
+// edge-triggered: only its transition to asserted requests an interrupt,
+// and the line has to be released before it can fire again. The 6507 has
+// no NMI pin, so it ignores it.
+func (cpu *Cpu) SetNMI(asserted bool) {
+	if cpu.variant == MOS6507 {
+		return
+	}
+	if asserted && !cpu.nmi {
+		cpu.nmiPending = true
+	}
+	cpu.nmi = asserted
+}
+
+// Step runs a single instruction, or the interrupt sequence if an
+// interrupt is pending, and returns the cycles it took. A halted processor
+// just lets one cycle go by. If Tick left an instruction in progress, Step
+// only finishes it.
+func (cpu *Cpu) Step() (resCycles int, err error) {
+	if cpu.ticks != nil {
+		if !cpu.boundary {
+			for !cpu.boundary && err == nil {
+				_, err = cpu.Tick()
+				resCycles++
 			}
-		} else {
-			resCycles = 2
+			cpu.stopTicking()
+			return
 		}
+		cpu.stopTicking()
+	}
+	return cpu.step()
+}
 
-	// BRK
-	case 0x00:
-		cpu.brk()
-		resCycles = 7
-
-	// BVC
-	case 0x50:
-		if cpu.bvc(cpu.rel()) {
-			if cpu.pbCrossed {
-				resCycles = 4
-			} else {
-				resCycles = 3
-			}
-		} else {
-			resCycles = 2
-		}
+func (cpu *Cpu) step() (resCycles int, err error) {
+	if cpu.halted {
+		resCycles = 1
+		return
+	}
+	resCycles, err = cpu.execute()
+	return
+}
 
-	// BVS
-	case 0x70:
-		if cpu.bvs(cpu.rel()) {
-			if cpu.pbCrossed {
-				resCycles = 4
-			} else {
-				resCycles = 3
-			}
-		} else {
-			resCycles = 2
+// RunCycles runs instructions for a budget of n cycles and returns the
+// cycles actually run. An instruction can't be split, so the last one may
+// overshoot the budget: the extra cycles are deducted from the budget of
+// the next call, which keeps the processor in step with the rest of the
+// machine over time. It stops early if an instruction fails.
+func (cpu *Cpu) RunCycles(n int) (ran int, err error) {
+	budget := n - cpu.overshoot
+	for budget > 0 {
+		var resCycles int
+		resCycles, err = cpu.Step()
+		ran += resCycles
+		budget -= resCycles
+		if err != nil {
+			break
 		}
+	}
+	if budget < 0 {
+		cpu.overshoot = -budget
+	} else {
+		cpu.overshoot = 0
+	}
 
-	case 0x18:
-		cpu.clc()
-		resCycles = 2
-
-	case 0xD8:
-		cpu.cld()
-		resCycles = 2
-
-	case 0x58:
-		cpu.cli()
-		resCycles = 2
-
-	case 0xB8:
-		cpu.clv()
-
-	// CMP
-	case 0xC9:
-		cpu.cmp(cpu.imm(), A)
-		resCycles = 2
-
-	case 0xC5:
-		cpu.cmp(cpu.zp(), A)
-		resCycles = 3
-
-	case 0xD5:
-		cpu.cmp(cpu.zpx(), A)
-		resCycles = 4
-
-	case 0xCD:
-		cpu.cmp(cpu.abs(), A)
-		resCycles = 4
-
-	case 0xDD:
-		cpu.cmp(cpu.abx(), A)
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
+	return
+}
 
-	case 0xD9:
-		cpu.cmp(cpu.aby(), A)
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
+// RunUntil runs instructions until pred, which is checked before each of
+// them, returns true. It returns the cycles run. It stops early if an
+// instruction fails or the processor halts.
+func (cpu *Cpu) RunUntil(pred func(cpu *Cpu) bool) (ran int, err error) {
+	for !pred(cpu) {
+		if cpu.halted {
+			err = ErrHalted
+			return
 		}
 
-	case 0xC1:
-		cpu.cmp(cpu.indx(), A)
-		resCycles = 6
-
-	case 0xD1:
-		cpu.cmp(cpu.indy(), A)
-		if cpu.pbCrossed {
-			resCycles = 6
-		} else {
-			resCycles = 5
+		var resCycles int
+		resCycles, err = cpu.Step()
+		ran += resCycles
+		if err != nil {
+			return
 		}
+	}
 
-	// CPX
-	case 0xE0:
-		cpu.cmp(cpu.imm(), X)
-		resCycles = 2
-
-	case 0xE4:
-		cpu.cmp(cpu.zp(), X)
-		resCycles = 3
-
-	case 0xEC:
-		cpu.cmp(cpu.abs(), X)
-		resCycles = 4
-
-	// CPY
-	case 0xC0:
-		cpu.cmp(cpu.imm(), Y)
-		resCycles = 2
-
-	case 0xC4:
-		cpu.cmp(cpu.zp(), Y)
-		resCycles = 3
-
-	case 0xCC:
-		cpu.cmp(cpu.abs(), Y)
-		resCycles = 4
-
-	// DEC
-	case 0xC6:
-		cpu.dec(cpu.zp())
-		resCycles = 5
-
-	case 0xD6:
-		cpu.dec(cpu.zpx())
-		resCycles = 6
-
-	case 0xCE:
-		cpu.dec(cpu.abs())
-		resCycles = 6
-
-	case 0xDE:
-		cpu.dec(cpu.abx())
-		resCycles = 7
+	return
+}
 
-	// DEX
-	case 0xCA:
-		cpu.decxy(X)
-		resCycles = 2
-
-	// DEY
-	case 0x88:
-		cpu.decxy(Y)
-		resCycles = 2
-
-	// EOR
-	case 0x49:
-		cpu.eor(cpu.imm())
-		resCycles = 2
-
-	case 0x45:
-		cpu.eor(cpu.zp())
-		resCycles = 3
-
-	case 0x55:
-		cpu.eor(cpu.zpx())
-		resCycles = 4
-
-	case 0x4D:
-		cpu.eor(cpu.abs())
-		resCycles = 4
-
-	case 0x5D:
-		cpu.eor(cpu.abx())
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
+// BusCycle is the access the processor makes on its bus during a cycle:
+// it reads Data from Addr, or writes it there.
+type BusCycle struct {
+	Addr  uint16
+	Data  uint8
+	Write bool
+}
 
-	case 0x59:
-		cpu.eor(cpu.aby())
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
+// errTicksStopped unwinds an instruction abandoned in the middle by
+// stopTicking
+var errTicksStopped = errors.New("ticks stopped")
 
-	case 0x41:
-		cpu.eor(cpu.indx())
-		resCycles = 6
+// Tick runs the processor for a single cycle and returns the bus access
+// made on it. Instructions are spread over the cycles they take, with one
+// access per cycle, dummy reads and writes included, so the memory sees
+// each access on its exact cycle: whatever runs alongside the processor
+// can be stepped between ticks. The cycles the model has no access for,
+// like those of a halted or waiting processor, read from the PC. So do
+// the last four cycles of the reserved $5C opcode of the 65C02, an
+// approximation of what the chip puts on its bus then.
+//
+// An instruction that fails returns its error on its last cycle. Step,
+// RunCycles and RunUntil can be mixed with Tick: they finish the
+// instruction in progress first. Reset abandons it.
+func (cpu *Cpu) Tick() (cycle BusCycle, err error) {
+	if cpu.ticks == nil {
+		cpu.ticks, cpu.stopTicks = iter.Pull(cpu.cycles)
+	}
+	cycle, _ = cpu.ticks()
+	err, cpu.tickErr = cpu.tickErr, nil
+	return
+}
 
-	case 0x51:
-		cpu.eor(cpu.indy())
-		if cpu.pbCrossed {
-			resCycles = 6
-		} else {
-			resCycles = 5
+// cycles runs instructions for Tick, yielding each access as the cycle it
+// is made on ends. A cycle ends when the processor starts the next one, so
+// a tick does everything the processor does up to the next access. Between
+// instructions the processor stops on a boundary, where nothing of the
+// next instruction has been done yet.
+func (cpu *Cpu) cycles(yield func(BusCycle) bool) {
+	defer func() {
+		cpu.yield, cpu.pending, cpu.boundary = nil, false, false
+		if r := recover(); r != nil && r != errTicksStopped {
+			panic(r)
 		}
-
-	// INC
-	case 0xE6:
-		cpu.inc(cpu.zp())
-		resCycles = 5
-
-	case 0xF6:
-		cpu.inc(cpu.zpx())
-		resCycles = 6
-
-	case 0xEE:
-		cpu.inc(cpu.abs())
-		resCycles = 6
-
-	case 0xFE:
-		cpu.inc(cpu.abx())
-		resCycles = 7
-
-	// INX
-	case 0xE8:
-		cpu.incxy(X)
-		resCycles = 2
-
-	// INY
-	case 0xC8:
-		cpu.incxy(Y)
-		resCycles = 2
-
-	// JMP
-	case 0x4C:
-		cpu.jmp(cpu.abs())
-		resCycles = 3
-
-	case 0x6C:
-		cpu.jmp(cpu.ind())
-		resCycles = 5
-
-	// JSR
-	case 0x20:
-		cpu.jsr(cpu.abs())
-		resCycles = 6
-
-	// LDA
-	case 0xA9:
-		cpu.ldr(cpu.imm(), A)
-		resCycles = 2
-
-	case 0xA5:
-		cpu.ldr(cpu.zp(), A)
-		resCycles = 3
-
-	case 0xB5:
-		cpu.ldr(cpu.zpx(), A)
-		resCycles = 4
-
-	case 0xAD:
-		cpu.ldr(cpu.abs(), A)
-		resCycles = 4
-
-	case 0xBD:
-		cpu.ldr(cpu.abx(), A)
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
+	}()
+	cpu.yield = yield
+
+	for {
+		if cpu.pending {
+			cpu.pending = false
+			cpu.boundary = true
+			if !yield(cpu.lastCycle) {
+				return
+			}
+			cpu.boundary = false
 		}
 
-	case 0xB9:
-		cpu.ldr(cpu.aby(), A)
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
+		cpu.accesses = 0
+		resCycles, err := cpu.step()
+		if err != nil {
+			cpu.tickErr = err
+			continue
 		}
-
-	case 0xA1:
-		cpu.ldr(cpu.indx(), A)
-		resCycles = 6
-
-	case 0xB1:
-		cpu.ldr(cpu.indy(), A)
-		if cpu.pbCrossed {
-			resCycles = 6
-		} else {
-			resCycles = 5
+		for cpu.accesses < resCycles {
+			cpu.read(cpu.pc)
 		}
+	}
+}
 
-	// LDX
-	case 0xA2:
-		cpu.ldr(cpu.imm(), X)
-		resCycles = 2
-
-	case 0xA6:
-		cpu.ldr(cpu.zp(), X)
-		resCycles = 3
-
-	case 0xB6:
-		cpu.ldr(cpu.zpy(), X)
-		resCycles = 4
-
-	case 0xAE:
-		cpu.ldr(cpu.abs(), X)
-		resCycles = 4
-
-	case 0xBE:
-		cpu.ldr(cpu.aby(), X)
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
+// stops running cycle by cycle, abandoning the instruction in progress
+func (cpu *Cpu) stopTicking() {
+	if cpu.stopTicks != nil {
+		cpu.stopTicks()
+	}
+	cpu.ticks, cpu.stopTicks = nil, nil
+}
 
-	// LDY
-	case 0xA0:
-		cpu.ldr(cpu.imm(), Y)
-		resCycles = 2
+// reads a byte through the bus
+func (cpu *Cpu) read(addr uint16) uint8 {
+	cpu.cycle()
+	data := cpu.mem.Read(addr)
+	cpu.lastCycle = BusCycle{Addr: addr, Data: data}
+	return data
+}
 
-	case 0xA4:
-		cpu.ldr(cpu.zp(), Y)
-		resCycles = 3
+// writes a byte through the bus
+func (cpu *Cpu) write(addr uint16, data uint8) {
+	cpu.cycle()
+	cpu.mem.Write(addr, data)
+	cpu.lastCycle = BusCycle{Addr: addr, Data: data, Write: true}
+}
 
-	case 0xB4:
-		cpu.ldr(cpu.zpx(), Y)
-		resCycles = 4
+// starts a bus cycle. When running under Tick, this ends the previous one
+func (cpu *Cpu) cycle() {
+	if cpu.yield == nil {
+		return
+	}
+	if cpu.pending && !cpu.yield(cpu.lastCycle) {
+		panic(errTicksStopped)
+	}
+	cpu.pending = true
+	cpu.accesses++
+}
 
-	case 0xAC:
-		cpu.ldr(cpu.abs(), Y)
-		resCycles = 4
+func (cpu *Cpu) execute() (resCycles int, err error) {
+	if cpu.tracer != nil {
+		defer func() { cpu.tracer.Cycles += resCycles }()
+	}
 
-	case 0xBC:
-		cpu.ldr(cpu.abx(), Y)
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
+	// a 65C02 stopped by WAI resumes on any interrupt, even a masked one
+	if cpu.waiting {
+		if !cpu.nmiPending && !cpu.irq {
+			resCycles = 1
+			return
 		}
+		cpu.waiting = false
+	}
 
-	// LSR
-	case 0x4A:
-		cpu.lsra()
-		resCycles = 2
-
-	case 0x46:
-		cpu.lsrm(cpu.zp())
-		resCycles = 5
-
-	case 0x56:
-		cpu.lsrm(cpu.zpx())
-		resCycles = 6
-
-	case 0x4E:
-		cpu.lsrm(cpu.abs())
-		resCycles = 6
-
-	case 0x5E:
-		cpu.lsrm(cpu.abx())
+	// interrupts are checked between instructions. NMI has priority
+	if cpu.nmiPending {
+		cpu.nmiPending = false
+		cpu.interrupt(NMI_VECTOR, false)
 		resCycles = 7
-
-	// NOP
-	case 0xEA:
-		cpu.nop()
-		resCycles = 2
-
-	// ORA
-	case 0x09:
-		cpu.ora(cpu.imm())
-		resCycles = 2
-
-	case 0x05:
-		cpu.ora(cpu.imm())
-		resCycles = 2
-
-	case 0x15:
-		cpu.ora(cpu.imm())
-		resCycles = 3
-
-	case 0x1D:
-		cpu.ora(cpu.imm())
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
-
-	case 0x19:
-		cpu.ora(cpu.imm())
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
-
-	case 0x01:
-		cpu.ora(cpu.imm())
-		resCycles = 6
-
-	case 0x11:
-		cpu.ora(cpu.imm())
-		if cpu.pbCrossed {
-			resCycles = 6
-		} else {
-			resCycles = 5
-		}
-
-	// PHA
-	case 0x48:
-		cpu.pha()
-		resCycles = 3
-
-	// PHP
-	case 0x08:
-		cpu.php()
-		resCycles = 3
-
-	// PLA
-	case 0x68:
-		cpu.pla()
-		resCycles = 4
-
-	// PLP
-	case 0x28:
-		cpu.plp()
-		resCycles = 4
-
-	// ROL
-	case 0x2A:
-		cpu.rola()
-		resCycles = 2
-
-	case 0x26:
-		cpu.rolm(cpu.zp())
-		resCycles = 5
-
-	case 0x36:
-		cpu.rolm(cpu.zpx())
-		resCycles = 6
-
-	case 0x2E:
-		cpu.rolm(cpu.abs())
-		resCycles = 6
-
-	case 0x3E:
-		cpu.rolm(cpu.abx())
+		return
+	}
+	if cpu.irq && cpu.p.i == 0 {
+		cpu.interrupt(IRQ_VECTOR, false)
 		resCycles = 7
+		return
+	}
 
-	// ROR
-	case 0x6A:
-		cpu.rora()
-		resCycles = 2
+	if cpu.tracer != nil {
+		cpu.tracer.trace(cpu)
+	}
 
-	case 0x66:
-		cpu.rorm(cpu.zp())
-		resCycles = 5
+	// grab current instruction and increment pc
+	opcode := cpu.read(cpu.pc)
+	cpu.pc++
+	cpu.extraCycles = 0
+	cpu.pbCrossed = false
 
-	case 0x76:
-		cpu.rorm(cpu.zpx())
-		resCycles = 6
+	inst := &instructionSet(cpu.variant)[opcode]
+	if !cpu.runs(inst.Status) {
+		return cpu.undefined(inst, opcode)
+	}
 
-	case 0x6E:
-		cpu.rorm(cpu.abs())
-		resCycles = 6
+	inst.run(cpu, cpu.operand(inst))
 
-	case 0x7E:
-		cpu.rorm(cpu.abx())
-		resCycles = 7
+	resCycles = inst.Cycles
+	if cpu.pbCrossed {
+		resCycles += inst.PageCross
+	}
+	// cycles the instruction took on top of the ones of its addressing
+	// mode, like taken branches and the decimal mode correction of the
+	// 65C02
+	resCycles += cpu.extraCycles
 
-	// RTI
-	case 0x40:
-		cpu.rti()
-		resCycles = 6
-
-	// RTS
-	case 0x60:
-		cpu.rts()
-		resCycles = 6
-
-	// SBC
-	case 0xE9:
-		cpu.sbc(cpu.imm())
-		resCycles = 2
-
-	case 0xE5:
-		cpu.sbc(cpu.zp())
-		resCycles = 3
-
-	case 0xF5:
-		cpu.sbc(cpu.zpx())
-		resCycles = 4
-
-	case 0xED:
-		cpu.sbc(cpu.abs())
-		resCycles = 4
-
-	case 0xFD:
-		cpu.sbc(cpu.abx())
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
+	return
+}
 
-	case 0xF9:
-		cpu.sbc(cpu.aby())
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
-		}
+// tells if the processor runs the opcodes of a status, as the illegal
+// opcodes setting says
+func (cpu *Cpu) runs(status OpcodeStatus) bool {
+	switch status {
+	case Undocumented:
+		return cpu.illegalOpcodes != IllegalNone
+	case Unstable:
+		return cpu.illegalOpcodes == IllegalAll
+	}
+	return true
+}
 
-	case 0xE1:
-		cpu.sbc(cpu.indx())
-		resCycles = 6
+// resolves the address an instruction works on, as its addressing mode
+// says. Indexed instructions without a page crossing penalty, the stores
+// and read-modify-writes, always take the cycle to fix the address
+func (cpu *Cpu) operand(inst *instruction) uint16 {
+	if inst.fetch {
+		return 0
+	}
 
-	case 0xF1:
-		cpu.sbc(cpu.indy())
-		if cpu.pbCrossed {
-			resCycles = 6
-		} else {
-			resCycles = 5
+	fixed := inst.PageCross == 0
+	switch inst.Mode {
+	case Implied, Accumulator:
+		// the one cycle NOPs of the 65C02 don't even read the next byte
+		if inst.Cycles > 1 {
+			cpu.imp()
 		}
-
-	// SEC
-	case 0x38:
-		cpu.sec()
-		resCycles = 2
-
-	// SED
-	case 0xF8:
-		cpu.sed()
-		resCycles = 2
-
-	// SEI
-	case 0x78:
-		cpu.sei()
-		resCycles = 2
-
-	// STA
-	case 0x85:
-		cpu.st(cpu.zp(), A)
-		resCycles = 3
-
-	case 0x95:
-		cpu.st(cpu.zpx(), A)
-		resCycles = 4
-
-	case 0x8D:
-		cpu.st(cpu.abs(), A)
-		resCycles = 4
-
-	case 0x9D:
-		cpu.st(cpu.abx(), A)
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
+	case Immediate:
+		return cpu.imm()
+	case ZeroPage, ZeroPageRelative:
+		// the instruction reads the offset itself
+		return cpu.zp()
+	case ZeroPageX:
+		return cpu.zpx()
+	case ZeroPageY:
+		return cpu.zpy()
+	case Relative:
+		return cpu.rel()
+	case Absolute:
+		return cpu.abs()
+	case AbsoluteX:
+		if fixed {
+			return cpu.abxw()
 		}
-
-	case 0x99:
-		cpu.st(cpu.aby(), A)
-		if cpu.pbCrossed {
-			resCycles = 5
-		} else {
-			resCycles = 4
+		return cpu.abx()
+	case AbsoluteY:
+		if fixed {
+			return cpu.abyw()
 		}
-
-	case 0x81:
-		cpu.st(cpu.indx(), A)
-		resCycles = 6
-
-	case 0x91:
-		cpu.st(cpu.indy(), A)
-		if cpu.pbCrossed {
-			resCycles = 6
-		} else {
-			resCycles = 5
+		return cpu.aby()
+	case Indirect:
+		return cpu.ind()
+	case IndirectX:
+		return cpu.indx()
+	case IndirectY:
+		if fixed {
+			return cpu.indyw()
 		}
+		return cpu.indy()
+	case ZeroPageIndirect:
+		return cpu.zpi()
+	case AbsoluteIndirectX:
+		return cpu.iax()
+	}
 
-	// STX
-	case 0x86:
-		cpu.st(cpu.zp(), X)
-		resCycles = 3
-
-	case 0x96:
-		cpu.st(cpu.zpy(), X)
-		resCycles = 4
-
-	case 0x8E:
-		cpu.st(cpu.abs(), X)
-		resCycles = 4
-
-	// STY
-	case 0x84:
-		cpu.st(cpu.zp(), Y)
-		resCycles = 3
-
-	case 0x94:
-		cpu.st(cpu.zpx(), Y)
-		resCycles = 4
-
-	case 0x8C:
-		cpu.st(cpu.abs(), Y)
-		resCycles = 4
+	return 0
+}
 
-	// TAX
-	case 0xAA:
-		cpu.taxy(X)
-		resCycles = 2
+// runs an opcode the processor doesn't implement, as the undefined opcode
+// policy says
+func (cpu *Cpu) undefined(inst *instruction, opcode uint8) (resCycles int, err error) {
+	switch cpu.undefinedPolicy {
+	case UndefinedHalt:
+		cpu.pc--
+		cpu.halted = true
 
-	// TAY
-	case 0xA8:
-		cpu.taxy(Y)
-		resCycles = 2
+	case UndefinedNop:
+		resCycles = cpu.skip(inst)
 
-	// TSX
-	case 0xBA:
-		cpu.tsx()
-		resCycles = 2
+	default:
+		cpu.pc--
+		err = &UndefinedOpcodeError{Opcode: opcode, PC: cpu.pc}
+	}
 
-	// TXA
-	case 0x8A:
-		cpu.txya(X)
-		resCycles = 2
+	return
+}
 
-	// TXS
-	case 0x9A:
-		cpu.txs()
-		resCycles = 2
+// skips an opcode as a NOP, consuming the operand bytes and the cycles the
+// processor would take to run it
+func (cpu *Cpu) skip(inst *instruction) (resCycles int) {
+	cpu.operand(inst)
 
-	// TYA
-	case 0x98:
-		cpu.txya(Y)
-		resCycles = 2
+	resCycles = inst.Cycles
+	if cpu.pbCrossed {
+		resCycles += inst.PageCross
 	}
 
 	return
@@ -934,39 +836,34 @@ func (cpu *Cpu) execute() (resCycles int) {
 
 // instruction implementations
 // add with carry
-func (cpu *Cpu) adc(addr int) {
-	data := cpu.mem.Read(addr)
-
-	if cpu.p.d == 1 {
-		// Calculate auxiliary value
-		aux := bcd2bin(cpu.ac) + bcd2bin(data) + cpu.p.c
-
-		if aux > 99 {
-			aux -= 100
-			cpu.p.c = 1
-		} else {
-			cpu.p.c = 0
-		}
+func (cpu *Cpu) adc(addr uint16) {
+	cpu.adcValue(cpu.read(addr))
+}
 
-		cpu.ac = bin2bcd(aux)
+// add with carry, on a value already read
+func (cpu *Cpu) adcValue(data uint8) {
+	if cpu.decimalMode() {
+		cpu.adcDecimal(data)
 	} else {
 		// Calculate auxiliary value
-		aux := cpu.ac + data + cpu.p.c
+		aux := int(cpu.ac) + int(data) + cpu.p.c
 
 		// Set flags: overflow, sign, zero, and carry
 		// If the sum of two positive numbers yields a negative result,
 		// it has overflowed. If the sum of two negative numbers
 		// yields a positive result, it has overflowed.
-		isAcPos := cpu.ac & BIT_7 == 0
-		isDataPos := data & BIT_7 == 0
-		isResPos := aux & BIT_7 == 0
+		isAcPos := cpu.ac&BIT_7 == 0
+		isDataPos := data&BIT_7 == 0
+		isResPos := aux&BIT_7 == 0
 		if (isAcPos && isDataPos && !isResPos) ||
-		   (!isAcPos && !isDataPos && isResPos) {
+			(!isAcPos && !isDataPos && isResPos) {
 			cpu.p.v = 1
+		} else {
+			cpu.p.v = 0
 		}
 
-		cpu.p.setN(aux)
-		cpu.p.setZ(aux)
+		cpu.p.setN(uint8(aux))
+		cpu.p.setZ(uint8(aux))
 
 		if aux > 255 {
 			cpu.p.c = 1
@@ -975,13 +872,66 @@ func (cpu *Cpu) adc(addr int) {
 		}
 
 		// take the possible carry out
-		cpu.ac = aux & 0xFF
+		cpu.ac = uint8(aux)
+	}
+}
+
+// Decimal mode addition, as the hardware does it for every input,
+// including invalid BCD digits. Taken from Bruce Clark's "Decimal Mode"
+// tutorial on 6502.org:
+// - The result comes from adding the nibbles separately, adjusting each
+//   one by 6 when it goes over 9.
+// - On the NMOS part, Z comes from the binary sum, while N and V come from
+//   the intermediate result, before the high nibble is adjusted.
+// - On the 65C02, N and Z come from the result, which takes one more
+//   cycle.
+func (cpu *Cpu) adcDecimal(data uint8) {
+	ac, d := int(cpu.ac), int(data)
+
+	al := (ac & 0xF) + (d & 0xF) + cpu.p.c
+	if al >= 0x0A {
+		al = ((al + 0x06) & 0x0F) + 0x10
+	}
+
+	// intermediate result, with the high nibble still unadjusted. Its
+	// signed version gives the overflow
+	t := (ac & 0xF0) + (d & 0xF0) + al
+	st := int(int8(cpu.ac&0xF0)) + int(int8(data&0xF0)) + al
+
+	cpu.p.setZ(uint8(ac + d + cpu.p.c))
+	cpu.p.setN(uint8(t))
+	if st < -128 || st > 127 {
+		cpu.p.v = 1
+	} else {
+		cpu.p.v = 0
+	}
+
+	if t >= 0xA0 {
+		t += 0x60
+	}
+	if t >= 0x100 {
+		cpu.p.c = 1
+	} else {
+		cpu.p.c = 0
+	}
+	cpu.ac = uint8(t)
+
+	if cpu.variant == WDC65C02 {
+		cpu.p.setN(cpu.ac)
+		cpu.p.setZ(cpu.ac)
+		// the extra cycle reads the pc
+		cpu.read(cpu.pc)
+		cpu.extraCycles = 1
 	}
 }
 
 // and accumulator with memory
-func (cpu *Cpu) and(addr int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) and(addr uint16) {
+	cpu.andValue(cpu.read(addr))
+}
+
+// and with accumulator, on a value already read
+func (cpu *Cpu) andValue(data uint8) {
 	cpu.ac &= data
 
 	// flags: sign, zero.
@@ -1005,8 +955,9 @@ func (cpu *Cpu) asla() {
 }
 
 // asymetric shift left memory
-func (cpu *Cpu) asl(addr int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) asl(addr uint16) uint8 {
+	data := cpu.read(addr)
+	cpu.modify(addr, data)
 
 	carry := (data & BIT_7) == BIT_7
 	if carry {
@@ -1019,113 +970,102 @@ func (cpu *Cpu) asl(addr int) {
 	cpu.p.setN(data)
 	cpu.p.setZ(data)
 
-	cpu.mem.Write(addr, data)
+	cpu.write(addr, data)
+
+	return data
 }
 
 // branch if carry clear
-func (cpu *Cpu) bcc(addr int) bool {
+func (cpu *Cpu) bcc(addr uint16) bool {
 	if cpu.p.c == 0 {
-		cpu.pc = addr
+		cpu.branch(addr)
 		return true
 	}
 	return false
 }
 
 // branch if carry set
-func (cpu *Cpu) bcs(addr int) bool {
+func (cpu *Cpu) bcs(addr uint16) bool {
 	if cpu.p.c == 1 {
-		cpu.pc = addr
+		cpu.branch(addr)
 		return true
 	}
 	return false
 }
 
 // branch if equals (checks zero)
-func (cpu *Cpu) beq(addr int) bool {
+func (cpu *Cpu) beq(addr uint16) bool {
 	if cpu.p.z == 1 {
-		cpu.pc = addr
+		cpu.branch(addr)
 		return true
 	}
 	return false
 }
 
 // bit test
-func (cpu *Cpu) bit(addr int) {
-	data := cpu.mem.Read(addr) & cpu.ac
+func (cpu *Cpu) bit(addr uint16) {
+	data := cpu.read(addr)
 
+	// N and V are the top bits of the operand, Z tells if it has none of
+	// the bits of A
 	if data&BIT_6 != 0 {
 		cpu.p.v = 1
 	} else {
 		cpu.p.v = 0
 	}
 	cpu.p.setN(data)
-	cpu.p.setZ(data)
+	cpu.p.setZ(data & cpu.ac)
 }
 
 // branch if negative
-func (cpu *Cpu) bmi(addr int) bool {
+func (cpu *Cpu) bmi(addr uint16) bool {
 	if cpu.p.n == 1 {
-		cpu.pc = addr
+		cpu.branch(addr)
 		return true
 	}
 	return false
 }
 
 // branch if not equal (checks zero)
-func (cpu *Cpu) bne(addr int) bool {
+func (cpu *Cpu) bne(addr uint16) bool {
 	if cpu.p.z == 0 {
-		cpu.pc = addr
+		cpu.branch(addr)
 		return true
 	}
 	return false
 }
 
 // branch if positive
-func (cpu *Cpu) bpl(addr int) bool {
+func (cpu *Cpu) bpl(addr uint16) bool {
 	if cpu.p.n == 0 {
-		cpu.pc = addr
+		cpu.branch(addr)
 		return true
 	}
 	return false
 }
 
 // break
-// TODO
 func (cpu *Cpu) brk() {
-	var l, h int
-
 	// Even though the brk instruction is just one byte long, the pc is
 	// incremented, meaning that the instruction after brk is ignored.
+	// The return address pushed is the address of brk plus 2.
 	cpu.pc++
-	/*
-		cpu.mem.Write(cpu.sp, cpu.pc&0xF0)
-		cpu.mem.commit()
-		cpu.sp--
-		cpu.mem.Write(cpu.sp, cpu.pc&0xF)
-		cpu.mem.commit()
-		cpu.sp--
-		cpu.mem.Write(cpu.sp, cpu.p.b)
-		cpu.sp--
-	*/
-	l = cpu.mem.Read(0xFFFE)
-	h = cpu.mem.Read(0xFFFF) << 8
-
-	cpu.pc = h | l
+	cpu.interrupt(IRQ_VECTOR, true)
 }
 
 // branch if bit clear
-func (cpu *Cpu) bvc(addr int) bool {
+func (cpu *Cpu) bvc(addr uint16) bool {
 	if cpu.p.v == 0 {
-		cpu.pc = addr
+		cpu.branch(addr)
 		return true
 	}
 	return false
 }
 
 // branch if bit set
-func (cpu *Cpu) bvs(addr int) bool {
+func (cpu *Cpu) bvs(addr uint16) bool {
 	if cpu.p.v == 1 {
-		cpu.pc = addr
+		cpu.branch(addr)
 		return true
 	}
 	return false
@@ -1152,11 +1092,14 @@ func (cpu *Cpu) clv() {
 }
 
 // compare accumulator with memory
-func (cpu *Cpu) cmp(addr, r int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) cmp(addr uint16, r int) {
+	cpu.cmpValue(cpu.read(addr), r)
+}
 
+// compare, on a value already read
+func (cpu *Cpu) cmpValue(data uint8, r int) {
 	// Calculate auxiliary value
-	t := 0
+	var t uint8
 	switch r {
 	case A:
 		t = cpu.ac - data
@@ -1189,93 +1132,103 @@ func (cpu *Cpu) cmp(addr, r int) {
 }
 
 // decrement memory
-func (cpu *Cpu) dec(addr int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) dec(addr uint16) uint8 {
+	data := cpu.read(addr)
+	cpu.modify(addr, data)
 
-	// Decrement & AND 0xFF
-	data = (data - 1) & 0xFF
-	cpu.mem.Write(addr, data)
+	// Decrement
+	data--
+	cpu.write(addr, data)
 
 	// Set flags
 	cpu.p.setN(data)
 	cpu.p.setZ(data)
+
+	return data
 }
 
 // decrement register
 func (cpu *Cpu) decxy(r int) {
 	switch r {
 	case X:
-		cpu.x = (cpu.x - 1) & 0xFF
+		cpu.x--
 		cpu.p.setN(cpu.x)
 		cpu.p.setZ(cpu.x)
 
 	case Y:
-		cpu.y = (cpu.y - 1) & 0xFF
+		cpu.y--
 		cpu.p.setN(cpu.y)
 		cpu.p.setZ(cpu.y)
 	}
 }
 
 // exclusive or accumulator and memory
-func (cpu *Cpu) eor(addr int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) eor(addr uint16) {
+	cpu.eorValue(cpu.read(addr))
+}
 
+// exclusive or with accumulator, on a value already read
+func (cpu *Cpu) eorValue(data uint8) {
 	cpu.ac ^= data
 	cpu.p.setN(cpu.ac)
 	cpu.p.setZ(cpu.ac)
 }
 
 // increment memory
-func (cpu *Cpu) inc(addr int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) inc(addr uint16) uint8 {
+	data := cpu.read(addr)
+	cpu.modify(addr, data)
 
 	data++
-	data &= 0xFF
-	cpu.mem.Write(addr, data)
+	cpu.write(addr, data)
 
 	cpu.p.setN(data)
 	cpu.p.setZ(data)
+
+	return data
 }
 
 // increment register
 func (cpu *Cpu) incxy(r int) {
 	switch r {
 	case X:
-		cpu.x = (cpu.x + 1) & 0xFF
+		cpu.x++
 		cpu.p.setN(cpu.x)
 		cpu.p.setZ(cpu.x)
 
 	case Y:
-		cpu.y = (cpu.y + 1) & 0xFF
+		cpu.y++
 		cpu.p.setN(cpu.y)
 		cpu.p.setZ(cpu.y)
 	}
 }
 
 // jump to address
-func (cpu *Cpu) jmp(addr int) {
+func (cpu *Cpu) jmp(addr uint16) {
 	cpu.pc = addr
 }
 
-// jump to subrutine
-func (cpu *Cpu) jsr(addr int) {
-	t := cpu.pc - 1
+// jump to subrutine. The pc is pushed between the reads of the low and the
+// high byte of the address, so it points to the last byte of the
+// instruction
+func (cpu *Cpu) jsr() {
+	l := cpu.read(cpu.pc)
+	cpu.pc++
+	// dummy read while the stack pointer is ready
+	cpu.read(0x100 | uint16(cpu.sp))
 
 	// Push PC onto the stack
-	cpu.mem.Write(cpu.sp, (t&0xFF00)>>8)
-	// TODO: what, why?
-	//cpu.mem.commit()
-	cpu.sp--
-	cpu.mem.Write(cpu.sp, t&0xFF)
-	cpu.sp--
+	cpu.push(uint8(cpu.pc >> 8))
+	cpu.push(uint8(cpu.pc))
 
 	// Jump
-	cpu.pc = addr
+	h := cpu.read(cpu.pc)
+	cpu.pc = word(l, h)
 }
 
 // load memory to register
-func (cpu *Cpu) ldr(addr, r int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) ldr(addr uint16, r int) {
+	data := cpu.read(addr)
 
 	// One function for three different opcodes. Have to switch the register
 	switch r {
@@ -1310,8 +1263,9 @@ func (cpu *Cpu) lsra() {
 }
 
 // right shift memory
-func (cpu *Cpu) lsrm(addr int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) lsrm(addr uint16) uint8 {
+	data := cpu.read(addr)
+	cpu.modify(addr, data)
 
 	cpu.p.n = 0
 	if data&BIT_0 == 0 {
@@ -1322,7 +1276,9 @@ func (cpu *Cpu) lsrm(addr int) {
 	data = (data >> 1) & 0x7F
 	cpu.p.setZ(data)
 
-	cpu.mem.Write(addr, data)
+	cpu.write(addr, data)
+
+	return data
 }
 
 // no operation
@@ -1331,9 +1287,12 @@ func (cpu *Cpu) nop() {
 }
 
 // or with accumulator
-func (cpu *Cpu) ora(addr int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) ora(addr uint16) {
+	cpu.oraValue(cpu.read(addr))
+}
 
+// or with accumulator, on a value already read
+func (cpu *Cpu) oraValue(data uint8) {
 	cpu.ac |= data
 	cpu.p.setZ(cpu.ac)
 	cpu.p.setN(cpu.ac)
@@ -1341,20 +1300,19 @@ func (cpu *Cpu) ora(addr int) {
 
 // push accumulator to stack
 func (cpu *Cpu) pha() {
-	cpu.mem.Write(cpu.sp, cpu.ac)
-	cpu.sp--
+	cpu.push(cpu.ac)
 }
 
 // push processor status to stack
 func (cpu *Cpu) php() {
-	cpu.mem.Write(cpu.sp, cpu.p.getAsWord())
-	cpu.sp--
+	cpu.push(cpu.p.getAsWord() | BIT_4)
 }
 
 // put stack in accumulator
 func (cpu *Cpu) pla() {
-	cpu.sp++
-	cpu.ac = cpu.mem.Read(cpu.sp)
+	// dummy read while incrementing the stack pointer
+	cpu.read(0x100 | uint16(cpu.sp))
+	cpu.ac = cpu.pull()
 
 	cpu.p.setN(cpu.ac)
 	cpu.p.setZ(cpu.ac)
@@ -1362,8 +1320,9 @@ func (cpu *Cpu) pla() {
 
 // set push stack to processor status
 func (cpu *Cpu) plp() {
-	cpu.sp++
-	cpu.p.setAsWord(cpu.mem.Read(cpu.sp))
+	// dummy read while incrementing the stack pointer
+	cpu.read(0x100 | uint16(cpu.sp))
+	cpu.p.setAsWord(cpu.pull())
 }
 
 // rotate accumulator left
@@ -1382,7 +1341,7 @@ func (cpu *Cpu) rola() {
 	// Rotate left and &
 	cpu.ac = (cpu.ac << 1) & 0xFE
 	// Set LSB with the carry value from before the operation
-	cpu.ac |= cpu.p.c
+	cpu.ac |= uint8(cpu.p.c)
 	// Set the next carry
 	cpu.p.c = t
 	// Set flags
@@ -1391,8 +1350,9 @@ func (cpu *Cpu) rola() {
 }
 
 // rotate memory left
-func (cpu *Cpu) rolm(addr int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) rolm(addr uint16) uint8 {
+	data := cpu.read(addr)
+	cpu.modify(addr, data)
 	var t int
 	if data&BIT_7 != 0 {
 		t = 1
@@ -1403,7 +1363,7 @@ func (cpu *Cpu) rolm(addr int) {
 	// Rotate left and &
 	data = (data << 1) & 0xFE
 	// Set LSB with the carry value from before the operation
-	data |= cpu.p.c
+	data |= uint8(cpu.p.c)
 	// Set the next carry
 	cpu.p.c = t
 	// Set flags
@@ -1411,7 +1371,9 @@ func (cpu *Cpu) rolm(addr int) {
 	cpu.p.setN(data)
 
 	// Write to memory
-	cpu.mem.Write(addr, data)
+	cpu.write(addr, data)
+
+	return data
 }
 
 // rorate accumulator right
@@ -1445,8 +1407,9 @@ func (cpu *Cpu) rora() {
 }
 
 // rotate memory right
-func (cpu *Cpu) rorm(addr int) {
-	data := cpu.mem.Read(addr)
+func (cpu *Cpu) rorm(addr uint16) uint8 {
+	data := cpu.read(addr)
+	cpu.modify(addr, data)
 	var t int
 	if data&BIT_0 != 0 {
 		t = 1
@@ -1471,89 +1434,123 @@ func (cpu *Cpu) rorm(addr int) {
 	cpu.p.setN(data)
 
 	// Write to memory
-	cpu.mem.Write(addr, data)
+	cpu.write(addr, data)
+
+	return data
 }
 
 // return from interrupt
 func (cpu *Cpu) rti() {
-	var l, h int
-	// TODO: increment or decrement sp?
-	cpu.sp++
-	cpu.p.setAsWord(cpu.mem.Read(cpu.sp))
-	cpu.sp++
-	l = cpu.mem.Read(cpu.sp)
-	cpu.sp++
-	h = cpu.mem.Read(cpu.sp)
+	var l, h uint16
+
+	// dummy read while incrementing the stack pointer
+	cpu.read(0x100 | uint16(cpu.sp))
+	cpu.p.setAsWord(cpu.pull())
+	l = uint16(cpu.pull())
+	h = uint16(cpu.pull())
 
 	cpu.pc = (h << 8) | l
 }
 
 // return from subrutine
 func (cpu *Cpu) rts() {
-	var l, h int
+	var l, h uint16
 
-	cpu.sp++
-	l = cpu.mem.Read(cpu.sp)
-	cpu.sp++
-	h = cpu.mem.Read(cpu.sp)
+	// dummy read while incrementing the stack pointer
+	cpu.read(0x100 | uint16(cpu.sp))
+	l = uint16(cpu.pull())
+	h = uint16(cpu.pull())
 
-	cpu.pc = ((h << 8) | l) + 1
+	// dummy read while incrementing the pc
+	cpu.pc = (h << 8) | l
+	cpu.read(cpu.pc)
+	cpu.pc++
 }
 
 // substract with carry
-func (cpu *Cpu) sbc(addr int) {
-	data := cpu.mem.Read(addr)
-
-	var t int
-	// If decimal mode is on...
-	if cpu.p.d == 1 {
-		// When using SBC, the code should have used SEC to set the carry
-		// before. This is to make sure that, if we need to borrow, there is
-		// something to borrow.
-		var negcarry int
-		if cpu.p.c == 1 {
-			negcarry = 0
-		} else {
-			negcarry = 1
-		}
-		t = bcd2bin(cpu.ac) - bcd2bin(data) - negcarry
-
-		if t > 99 || t < 0 {
-			cpu.p.v = 1
-		} else {
-			cpu.p.v = 0
-		}
+func (cpu *Cpu) sbc(addr uint16) {
+	cpu.sbcValue(cpu.read(addr))
+}
+
+// substract with carry, on a value already read
+func (cpu *Cpu) sbcValue(data uint8) {
+	// When using SBC, the code should have used SEC to set the carry
+	// before. This is to make sure that, if we need to borrow, there is
+	// something to borrow.
+	var negcarry int
+	if cpu.p.c != 0 {
+		negcarry = 0
 	} else {
-		var negcarry int
-		if cpu.p.c != 0 {
-			negcarry = 0
-		} else {
-			negcarry = 1
-		}
-		t = cpu.ac - data - negcarry
-
-		// Sign changed when substracing numbers with opposite
-		// sign yields overflow.
-		isAcPos := cpu.ac & BIT_7 == 0
-		isDataPos := data & BIT_7 == 0
-		isResPos := t & BIT_7 == 0
-		if (isAcPos && !isDataPos && !isResPos) ||
-		   (!isAcPos && isDataPos && isResPos) {
-			cpu.p.v = 1
-		}
+		negcarry = 1
+	}
+	t := int(cpu.ac) - int(data) - negcarry
+
+	// The flags are the ones of the binary substraction, even in decimal
+	// mode (except for N and Z on the 65C02).
+	// Sign changed when substracing numbers with opposite
+	// sign yields overflow.
+	isAcPos := cpu.ac&BIT_7 == 0
+	isDataPos := data&BIT_7 == 0
+	isResPos := t&BIT_7 == 0
+	if (isAcPos && !isDataPos && !isResPos) ||
+		(!isAcPos && isDataPos && isResPos) {
+		cpu.p.v = 1
+	} else {
+		cpu.p.v = 0
 	}
 
-	// Set the flags
 	if t >= 0 {
 		cpu.p.c = 1
 	} else {
 		cpu.p.c = 0
 	}
-	cpu.p.setZ(t)
-	cpu.p.setN(t)
+	cpu.p.setZ(uint8(t))
+	cpu.p.setN(uint8(t))
+
+	if cpu.decimalMode() {
+		cpu.sbcDecimal(data, negcarry)
+		return
+	}
+
+	// Write the result, wrapped to a byte
+	cpu.ac = uint8(t)
+}
+
+// Decimal mode substraction, as the hardware does it for every input,
+// including invalid BCD digits. Taken from Bruce Clark's "Decimal Mode"
+// tutorial on 6502.org. The NMOS part borrows from the high nibble as
+// soon as the low one goes under zero, while the 65C02 adjusts the binary
+// difference, and sets N and Z from the result.
+func (cpu *Cpu) sbcDecimal(data uint8, negcarry int) {
+	ac, d := int(cpu.ac), int(data)
+
+	al := (ac & 0xF) - (d & 0xF) - negcarry
+
+	if cpu.variant == WDC65C02 {
+		t := ac - d - negcarry
+		if t < 0 {
+			t -= 0x60
+		}
+		if al < 0 {
+			t -= 0x06
+		}
+		cpu.ac = uint8(t)
+		cpu.p.setN(cpu.ac)
+		cpu.p.setZ(cpu.ac)
+		// the extra cycle reads the pc
+		cpu.read(cpu.pc)
+		cpu.extraCycles = 1
+		return
+	}
 
-	// Write the result (ANDed, just in case it overflowed)
-	cpu.ac = t & 0xFF
+	if al < 0 {
+		al = ((al - 0x06) & 0x0F) - 0x10
+	}
+	t := (ac & 0xF0) - (d & 0xF0) + al
+	if t < 0 {
+		t -= 0x60
+	}
+	cpu.ac = uint8(t)
 }
 
 // set carry flag
@@ -1572,16 +1569,16 @@ func (cpu *Cpu) sei() {
 }
 
 // store register in memory
-func (cpu *Cpu) st(addr, r int) {
+func (cpu *Cpu) st(addr uint16, r int) {
 	switch r {
 	case A:
-		cpu.mem.Write(addr, cpu.ac)
+		cpu.write(addr, cpu.ac)
 
 	case X:
-		cpu.mem.Write(addr, cpu.x)
+		cpu.write(addr, cpu.x)
 
 	case Y:
-		cpu.mem.Write(addr, cpu.y)
+		cpu.write(addr, cpu.y)
 	}
 }
 
@@ -1590,21 +1587,21 @@ func (cpu *Cpu) taxy(r int) {
 	switch r {
 	case X:
 		cpu.x = cpu.ac
-		cpu.p.n = cpu.x
-		cpu.p.z = cpu.x
+		cpu.p.setN(cpu.x)
+		cpu.p.setZ(cpu.x)
 
 	case Y:
 		cpu.y = cpu.ac
-		cpu.p.n = cpu.y
-		cpu.p.z = cpu.y
+		cpu.p.setN(cpu.y)
+		cpu.p.setZ(cpu.y)
 	}
 }
 
 // load stack in register
 func (cpu *Cpu) tsx() {
 	cpu.x = cpu.sp
-	cpu.p.n = cpu.x
-	cpu.p.z = cpu.x
+	cpu.p.setN(cpu.x)
+	cpu.p.setZ(cpu.x)
 }
 
 // load accumulator with register
@@ -1617,8 +1614,8 @@ func (cpu *Cpu) txya(r int) {
 		cpu.ac = cpu.y
 	}
 
-	cpu.p.n = cpu.ac
-	cpu.p.z = cpu.ac
+	cpu.p.setN(cpu.ac)
+	cpu.p.setZ(cpu.ac)
 }
 
 // set stack to register x
@@ -1626,16 +1623,310 @@ func (cpu *Cpu) txs() {
 	cpu.sp = cpu.x
 }
 
+// undocumented instruction implementations
+// and immediate with accumulator, then shift right
+func (cpu *Cpu) alr(addr uint16) {
+	cpu.and(addr)
+	cpu.lsra()
+}
+
+// and immediate with accumulator, copying the negative flag into carry
+func (cpu *Cpu) anc(addr uint16) {
+	cpu.and(addr)
+	cpu.p.c = cpu.p.n
+}
+
+// store accumulator and X, ANDed with the high byte of the address + 1
+func (cpu *Cpu) ahx(addr uint16) {
+	cpu.sh(addr, cpu.y, cpu.ac&cpu.x)
+}
+
+// and immediate with accumulator, then rotate right. The flags come out
+// of the adder rather than the shifter: carry is bit 6 of the result and
+// overflow is bit 6 xor bit 5. In decimal mode the result is adjusted as
+// if it were BCD
+func (cpu *Cpu) arr(addr uint16) {
+	t := cpu.ac & cpu.read(addr)
+
+	cpu.ac = (t >> 1) | uint8(cpu.p.c<<7)
+	cpu.p.setN(cpu.ac)
+	cpu.p.setZ(cpu.ac)
+
+	if !cpu.decimalMode() {
+		cpu.p.c = int(cpu.ac&BIT_6) >> 6
+		cpu.p.v = int(cpu.ac&BIT_6)>>6 ^ int(cpu.ac&BIT_5)>>5
+		return
+	}
+
+	cpu.p.v = int((t^cpu.ac)&BIT_6) >> 6
+	if (t&0xF)+(t&0x1) > 5 {
+		cpu.ac = (cpu.ac & 0xF0) | ((cpu.ac + 6) & 0xF)
+	}
+	if (t>>4)+((t>>4)&0x1) > 5 {
+		cpu.p.c = 1
+		cpu.ac += 0x60
+	} else {
+		cpu.p.c = 0
+	}
+}
+
+// decrement memory, then compare with accumulator
+func (cpu *Cpu) dcp(addr uint16) {
+	cpu.cmpValue(cpu.dec(addr), A)
+}
+
+// increment memory, then substract it from accumulator
+func (cpu *Cpu) isc(addr uint16) {
+	cpu.sbcValue(cpu.inc(addr))
+}
+
+// halt the processor until the next reset
+func (cpu *Cpu) jam() {
+	cpu.pc--
+	cpu.halted = true
+}
+
+// and memory with stack pointer, and load it into accumulator, X and the
+// stack pointer
+func (cpu *Cpu) las(addr uint16) {
+	data := cpu.read(addr) & cpu.sp
+
+	cpu.ac = data
+	cpu.x = data
+	cpu.sp = data
+	cpu.p.setN(data)
+	cpu.p.setZ(data)
+}
+
+// load accumulator and X with memory
+func (cpu *Cpu) lax(addr uint16) {
+	data := cpu.read(addr)
+
+	cpu.ac = data
+	cpu.x = data
+	cpu.p.setN(data)
+	cpu.p.setZ(data)
+}
+
+// load accumulator and X with immediate, mixed with the magic constant
+func (cpu *Cpu) lxa(addr uint16) {
+	data := (cpu.ac | UnstableMagic) & cpu.read(addr)
+
+	cpu.ac = data
+	cpu.x = data
+	cpu.p.setN(data)
+	cpu.p.setZ(data)
+}
+
+// no operation, reading memory
+func (cpu *Cpu) nopm(addr uint16) {
+	cpu.read(addr)
+}
+
+// rotate memory left, then and it with accumulator
+func (cpu *Cpu) rla(addr uint16) {
+	cpu.andValue(cpu.rolm(addr))
+}
+
+// rotate memory right, then add it to accumulator with carry
+func (cpu *Cpu) rra(addr uint16) {
+	cpu.adcValue(cpu.rorm(addr))
+}
+
+// store accumulator and X
+func (cpu *Cpu) sax(addr uint16) {
+	cpu.write(addr, cpu.ac&cpu.x)
+}
+
+// substract immediate from accumulator and X into X, without borrow.
+// Carry is set as in a compare
+func (cpu *Cpu) sbx(addr uint16) {
+	t := int(cpu.ac&cpu.x) - int(cpu.read(addr))
+
+	if t >= 0 {
+		cpu.p.c = 1
+	} else {
+		cpu.p.c = 0
+	}
+	cpu.x = uint8(t)
+	cpu.p.setN(cpu.x)
+	cpu.p.setZ(cpu.x)
+}
+
+// shift memory left, then or it with accumulator
+func (cpu *Cpu) slo(addr uint16) {
+	cpu.oraValue(cpu.asl(addr))
+}
+
+// shift memory right, then exclusive or it with accumulator
+func (cpu *Cpu) sre(addr uint16) {
+	cpu.eorValue(cpu.lsrm(addr))
+}
+
+// store X, ANDed with the high byte of the address + 1
+func (cpu *Cpu) shx(addr uint16) {
+	cpu.sh(addr, cpu.y, cpu.x)
+}
+
+// store Y, ANDed with the high byte of the address + 1
+func (cpu *Cpu) shy(addr uint16) {
+	cpu.sh(addr, cpu.x, cpu.y)
+}
+
+// set stack pointer to accumulator and X, then store it ANDed with the
+// high byte of the address + 1
+func (cpu *Cpu) tas(addr uint16) {
+	cpu.sp = cpu.ac & cpu.x
+	cpu.sh(addr, cpu.y, cpu.sp)
+}
+
+// and X with accumulator, mixed with the magic constant, and immediate
+func (cpu *Cpu) xaa(addr uint16) {
+	cpu.ac = (cpu.ac | UnstableMagic) & cpu.x & cpu.read(addr)
+	cpu.p.setN(cpu.ac)
+	cpu.p.setZ(cpu.ac)
+}
+
+// 65C02 instruction implementations
+// branch if bit reset. The zero page byte to test comes before the offset
+func (cpu *Cpu) bbr(addr uint16, bit uint8) bool {
+	data := cpu.read(addr)
+	// dummy read while testing the bit
+	cpu.read(addr)
+	target := cpu.rel()
+
+	if data&(1<<bit) == 0 {
+		cpu.branch(target)
+		return true
+	}
+	return false
+}
+
+// branch if bit set. The zero page byte to test comes before the offset
+func (cpu *Cpu) bbs(addr uint16, bit uint8) bool {
+	data := cpu.read(addr)
+	// dummy read while testing the bit
+	cpu.read(addr)
+	target := cpu.rel()
+
+	if data&(1<<bit) != 0 {
+		cpu.branch(target)
+		return true
+	}
+	return false
+}
+
+// bit test immediate. Only the zero flag is affected
+func (cpu *Cpu) biti(addr uint16) {
+	cpu.p.setZ(cpu.read(addr) & cpu.ac)
+}
+
+// decrement accumulator
+func (cpu *Cpu) deca() {
+	cpu.ac--
+	cpu.p.setN(cpu.ac)
+	cpu.p.setZ(cpu.ac)
+}
+
+// increment accumulator
+func (cpu *Cpu) inca() {
+	cpu.ac++
+	cpu.p.setN(cpu.ac)
+	cpu.p.setZ(cpu.ac)
+}
+
+// push register to stack
+func (cpu *Cpu) phxy(r int) {
+	switch r {
+	case X:
+		cpu.push(cpu.x)
+
+	case Y:
+		cpu.push(cpu.y)
+	}
+}
+
+// pull register from stack
+func (cpu *Cpu) plxy(r int) {
+	// dummy read while incrementing the stack pointer
+	cpu.read(0x100 | uint16(cpu.sp))
+
+	switch r {
+	case X:
+		cpu.x = cpu.pull()
+		cpu.p.setN(cpu.x)
+		cpu.p.setZ(cpu.x)
+
+	case Y:
+		cpu.y = cpu.pull()
+		cpu.p.setN(cpu.y)
+		cpu.p.setZ(cpu.y)
+	}
+}
+
+// reset memory bit
+func (cpu *Cpu) rmb(addr uint16, bit uint8) {
+	data := cpu.read(addr)
+	cpu.modify(addr, data)
+	cpu.write(addr, data&^(1<<bit))
+}
+
+// set memory bit
+func (cpu *Cpu) smb(addr uint16, bit uint8) {
+	data := cpu.read(addr)
+	cpu.modify(addr, data)
+	cpu.write(addr, data|(1<<bit))
+}
+
+// stop the processor until the next reset
+func (cpu *Cpu) stp() {
+	cpu.halted = true
+}
+
+// store zero in memory
+func (cpu *Cpu) stz(addr uint16) {
+	cpu.write(addr, 0)
+}
+
+// test and reset memory bits with accumulator
+func (cpu *Cpu) trb(addr uint16) {
+	data := cpu.read(addr)
+	cpu.modify(addr, data)
+
+	cpu.p.setZ(data & cpu.ac)
+	cpu.write(addr, data&^cpu.ac)
+}
+
+// test and set memory bits with accumulator
+func (cpu *Cpu) tsb(addr uint16) {
+	data := cpu.read(addr)
+	cpu.modify(addr, data)
+
+	cpu.p.setZ(data & cpu.ac)
+	cpu.write(addr, data|cpu.ac)
+}
+
+// wait for an interrupt
+func (cpu *Cpu) wai() {
+	cpu.waiting = true
+}
+
 // -----------------------------------
 // Addressing modes
 // - Page crossing is checked
 // - The operand is retrieved and stored for debugging purposes
 // -----------------------------------
 
+// Implied and accumulator: the instruction has no operand, but the
+// processor reads the byte after the opcode anyway, and ignores it.
+func (cpu *Cpu) imp() {
+	cpu.read(cpu.pc)
+}
+
 /**
  * Immediate: The operand is used directly to perform the computation.
  */
-func (cpu *Cpu) imm() int {
+func (cpu *Cpu) imm() uint16 {
 	addr := cpu.pc
 	cpu.pc++
 	return addr
@@ -1644,129 +1935,257 @@ func (cpu *Cpu) imm() int {
 // Zero page: A single byte specifies an address in the first page of mem
 // ($00xx), also known as the zero page, and the byte at that address is
 // used to perform the computation.
-func (cpu *Cpu) zp() int {
-	addr := cpu.mem.Read(cpu.pc) & 0xFF
+func (cpu *Cpu) zp() uint16 {
+	addr := cpu.read(cpu.pc)
 	cpu.pc++
-	return addr
+	return uint16(addr)
 }
 
 // Zero page,X: The value in X is added to the specified zero page address
 // for a sum address. The value at the sum address is used to perform the
-// computation.
-func (cpu *Cpu) zpx() int {
-	addr := cpu.mem.Read(cpu.pc)
+// computation. The sum wraps around within the zero page.
+func (cpu *Cpu) zpx() uint16 {
+	addr := cpu.read(cpu.pc)
 	cpu.pc++
-	return (addr + cpu.x) & 0xFF
+	// dummy read while adding the index
+	cpu.read(uint16(addr))
+	return uint16(addr + cpu.x)
 }
 
 // Zero page,Y: The value in Y is added to the specified zero page address
 // for a sum address. The value at the sum address is used to perform the
-// computation.
-func (cpu *Cpu) zpy() int {
-	addr := cpu.mem.Read(cpu.pc)
+// computation. The sum wraps around within the zero page.
+func (cpu *Cpu) zpy() uint16 {
+	addr := cpu.read(cpu.pc)
 	cpu.pc++
-	return (addr + cpu.y) & 0xFF
+	// dummy read while adding the index
+	cpu.read(uint16(addr))
+	return uint16(addr + cpu.y)
 }
 
 // The offset specified is added to the current address stored in the
-// Program Counter (PC). Offsets can range from -128 to +127.
-func (cpu *Cpu) rel() int {
-	addr := cpu.mem.Read(cpu.pc)
+// Program Counter (PC). Offsets can range from -128 to +127. The PC has
+// already moved past the offset byte when it is added.
+func (cpu *Cpu) rel() uint16 {
+	offset := int8(cpu.read(cpu.pc))
 	cpu.pc++
-	offset := int((byte(addr)))
-	addr = cpu.pc + offset
-
-	cpu.pageBoundaryCrossed(cpu.pc, addr)
-
-	return addr
+	return cpu.pc + uint16(offset)
 }
 
 // Absolute: A full 16-bit address is specified and the byte at that address
 // is used to perform the computation.
-func (cpu *Cpu) abs() int {
-	op1 := cpu.mem.Read(cpu.pc)
+func (cpu *Cpu) abs() uint16 {
+	op1 := cpu.read(cpu.pc)
 	cpu.pc++
-	op2 := cpu.mem.Read(cpu.pc)
+	op2 := cpu.read(cpu.pc)
 	cpu.pc++
-	addr := cpu.mem.Read(op1) | (cpu.mem.Read(op2) << 8)
 
-	return addr
+	return word(op1, op2)
 }
 
 // Absolute indexed with X: The value in X is added to the specified address
 // for a sum address. The value at the sum address is used to perform the
 // computation.
-func (cpu *Cpu) abx() int {
-	op1 := cpu.mem.Read(cpu.pc)
-	cpu.pc++
-	op2 := cpu.mem.Read(cpu.pc)
-	cpu.pc++
-	addr := (cpu.mem.Read(op1) | (cpu.mem.Read(op2) << 8))
-
-	before := addr
-	after := (before + cpu.x)
-
-	cpu.pageBoundaryCrossed(before, after)
+func (cpu *Cpu) abx() uint16 {
+	return cpu.index(cpu.abs(), cpu.x, false)
+}
 
-	return after & 0xFFFF
+// Absolute indexed with X, for writes and read-modify-writes: these always
+// take the cycle to fix the high byte of the address.
+func (cpu *Cpu) abxw() uint16 {
+	return cpu.index(cpu.abs(), cpu.x, true)
 }
 
 // Absolute indexed with Y: The value in Y is added to the specified address
 // for a sum address. The value at the sum address is used to perform the
 // computation.
-func (cpu *Cpu) aby() int {
-	op1 := cpu.pc
-	cpu.pc++
-	op2 := cpu.pc
-	cpu.pc++
-	addr := (cpu.mem.Read(op1) | (cpu.mem.Read(op2) << 8))
-	before := addr
-	after := (before + cpu.y)
-
-	cpu.pageBoundaryCrossed(before, after)
+func (cpu *Cpu) aby() uint16 {
+	return cpu.index(cpu.abs(), cpu.y, false)
+}
 
-	return after & 0xFFFF
+// Absolute indexed with Y, for writes and read-modify-writes: these always
+// take the cycle to fix the high byte of the address.
+func (cpu *Cpu) abyw() uint16 {
+	return cpu.index(cpu.abs(), cpu.y, true)
 }
 
-// Indirect addressing. With this instruction, the 8-bit address (location)
-// supplied by the programmer is considered to be a Zero-Page address, that
-// is, an address in the first 256 (0..255) bytes of memory. The content of
-// this Zero-Page address must contain the low 8-bits of a memory address.
-// The following byte (the contents of address+1) must contain the upper
-// 8-bits of a memory address
-func (cpu *Cpu) ind() int {
-	addr := cpu.mem.Read(cpu.pc) & 0xFF
+// Indirect addressing (JMP only). The 16-bit address supplied by the
+// programmer points to the low 8-bits of the target address; the following
+// byte contains the upper 8-bits. On the NMOS parts the pointer's high byte
+// does not carry, so JMP ($xxFF) fetches the upper 8-bits from $xx00. The
+// 65C02 fixes this, at the cost of an extra cycle.
+func (cpu *Cpu) ind() uint16 {
+	op1 := cpu.read(cpu.pc)
 	cpu.pc++
+	op2 := cpu.read(cpu.pc)
+	cpu.pc++
+	addr := word(op1, op2)
+
+	next := word(op1+1, op2)
+	if cpu.variant == WDC65C02 {
+		next = addr + 1
+		// the extra cycle reads the last operand byte again
+		cpu.read(cpu.pc - 1)
+	}
 
-	return cpu.mem.Read(addr) | (cpu.mem.Read(addr+1) << 8)
+	return word(cpu.read(addr), cpu.read(next))
 }
 
 // Zero Page Indexed Indirect: Much like Indirect Addressing, but the
 // content of the index register is added to the Zero-Page address
-// (location)
-func (cpu *Cpu) indx() int {
-	addr := cpu.mem.Read(cpu.pc) & 0xFF
+// (location). Both the sum and the pointer wrap around within the zero
+// page.
+func (cpu *Cpu) indx() uint16 {
+	addr := cpu.read(cpu.pc)
 	cpu.pc++
+	// dummy read while adding the index
+	cpu.read(uint16(addr))
+	addr += cpu.x
 
-	return (cpu.mem.Read(addr+cpu.x) | (cpu.mem.Read(addr+1+cpu.x) << 8))
+	return word(cpu.read(uint16(addr)), cpu.read(uint16(addr+1)))
 }
 
 // Indirect Indexed Addressing: Much like Indexed Addressing, but the
 // contents of the index register is added to the Base_Location after it is
-// read from Zero-Page memory.
-func (cpu *Cpu) indy() int {
-	addr := cpu.mem.Read(cpu.pc) & 0xFF
+// read from Zero-Page memory. The pointer wraps around within the zero
+// page.
+func (cpu *Cpu) indy() uint16 {
+	return cpu.index(cpu.zpi(), cpu.y, false)
+}
+
+// Indirect Indexed Addressing, for writes and read-modify-writes: these
+// always take the cycle to fix the high byte of the address.
+func (cpu *Cpu) indyw() uint16 {
+	return cpu.index(cpu.zpi(), cpu.y, true)
+}
+
+// Zero page indirect (65C02): like Indirect Indexed Addressing, without
+// the index.
+func (cpu *Cpu) zpi() uint16 {
+	addr := cpu.read(cpu.pc)
+	cpu.pc++
+
+	return word(cpu.read(uint16(addr)), cpu.read(uint16(addr+1)))
+}
+
+// Absolute indexed indirect (65C02, JMP only): the value in X is added to
+// the specified address, and the address to jump to is read from there.
+func (cpu *Cpu) iax() uint16 {
+	op1 := cpu.read(cpu.pc)
+	cpu.pc++
+	op2 := cpu.read(cpu.pc)
 	cpu.pc++
+	addr := word(op1, op2) + uint16(cpu.x)
+	// dummy read while adding the index
+	cpu.read(cpu.pc - 1)
+
+	return word(cpu.read(addr), cpu.read(addr+1))
+}
+
+// helper functions
+
+// The cycle a read-modify-write instruction spends modifying the data: the
+// NMOS part writes the unmodified data back, the 65C02 reads it again.
+func (cpu *Cpu) modify(addr uint16, data uint8) {
+	if cpu.variant == WDC65C02 {
+		cpu.read(addr)
+	} else {
+		cpu.write(addr, data)
+	}
+}
 
-	before := cpu.mem.Read(cpu.mem.Read(addr) | (cpu.mem.Read(addr+1) << 8))
-	after := before + cpu.y
+// Takes a branch. Adding the offset to the pc takes a cycle, and fixing
+// its high byte when that crosses a page takes another one, reading from
+// the pc with the high byte still unfixed.
+func (cpu *Cpu) branch(addr uint16) {
+	cpu.read(cpu.pc)
+	cpu.extraCycles++
+
+	cpu.pageBoundaryCrossed(cpu.pc, addr)
+	if cpu.pbCrossed {
+		cpu.read((cpu.pc & 0xFF00) | (addr & 0xFF))
+	}
+	cpu.pc = addr
+}
+
+// Adds an index to a base address. When the sum crosses a page the
+// processor takes an extra cycle to fix the high byte, and it reads from
+// the address with the high byte still unfixed meanwhile. Writes and
+// read-modify-writes can't undo a wrong access, so they always take that
+// cycle. The 65C02 reads the last operand byte again instead.
+func (cpu *Cpu) index(before uint16, index uint8, write bool) uint16 {
+	after := before + uint16(index)
 
 	cpu.pageBoundaryCrossed(before, after)
+	if cpu.pbCrossed && cpu.variant == WDC65C02 {
+		cpu.read(cpu.pc - 1)
+	} else if cpu.pbCrossed || write {
+		cpu.read((before & 0xFF00) | (after & 0xFF))
+	}
 
 	return after
 }
 
-// helper functions
+// Store of the SH* family of undocumented opcodes: the data is ANDed with
+// the high byte of the base address (before indexing) plus one. If the
+// indexing crossed a page, the high byte of the address written to gets
+// ANDed as well.
+func (cpu *Cpu) sh(addr uint16, index, data uint8) {
+	base := addr - uint16(index)
+	data &= uint8(base>>8) + 1
+
+	if cpu.pbCrossed {
+		addr = word(uint8(addr), data)
+	}
+	cpu.write(addr, data)
+}
+
+// The stack lives in page one ($0100-$01FF). The stack pointer is 8 bits
+// wide, so it wraps around within the page.
+
+// pushes a byte onto the stack
+func (cpu *Cpu) push(data uint8) {
+	cpu.write(0x100 | uint16(cpu.sp), data)
+	cpu.sp--
+}
+
+// pulls a byte from the stack
+func (cpu *Cpu) pull() uint8 {
+	cpu.sp++
+	return cpu.read(0x100 | uint16(cpu.sp))
+}
+
+// Interrupt sequence: the program counter and the processor status are
+// pushed onto the stack, interrupts are disabled and the program counter is
+// loaded from the given vector. The pushed status has the break flag set
+// only for BRK.
+func (cpu *Cpu) interrupt(vector uint16, brk bool) {
+	var l, h uint16
+
+	pstatus := cpu.p.getAsWord()
+	if brk {
+		pstatus |= BIT_4
+	} else {
+		// the opcode fetch and the operand read are turned into dummy
+		// reads
+		cpu.read(cpu.pc)
+		cpu.read(cpu.pc)
+	}
+
+	cpu.push(uint8(cpu.pc >> 8))
+	cpu.push(uint8(cpu.pc))
+	cpu.push(pstatus)
+
+	cpu.p.i = 1
+	if cpu.variant == WDC65C02 {
+		cpu.p.d = 0
+	}
+
+	l = uint16(cpu.read(vector))
+	h = uint16(cpu.read(vector+1)) << 8
+
+	cpu.pc = h | l
+}
 
 // Checks if a page boundary was crossed between two addresses.
 //
@@ -1778,19 +2197,24 @@ func (cpu *Cpu) indy() int {
 // operation takes only four clocks, which is one microsecond at 4MHz. If
 // there is a carry requiring the high byte to be incremented, it takes one
 // additional clock." (Taken from the AtariAge forums)
-func (cpu *Cpu) pageBoundaryCrossed(addr1, addr2 int) {
-	cpu.pbCrossed = ((addr1 ^ addr2) & BIT_8) != 0
+func (cpu *Cpu) pageBoundaryCrossed(addr1, addr2 uint16) {
+	cpu.pbCrossed = addr1>>8 != addr2>>8
 }
 
-// interprets a word as bcd
-func bcd2bin(n int) int {
-	return (n & 0xF) + ((n & 0xF0) >> 4 * 10)
+// tells if ADC and SBC work in decimal mode. The 2A03 has no decimal mode
+func (cpu *Cpu) decimalMode() bool {
+	return cpu.p.d == 1 && cpu.variant != RICOH2A03
 }
 
-// turns a binary word into bcd
-func bin2bcd(n int) int {
-	units := n % 10
-	tens := (n - units) / 10
+// makes an address out of its low and high bytes
+func word(l, h uint8) uint16 {
+	return uint16(h)<<8 | uint16(l)
+}
 
-	return (tens << 4) | units
+// turns a bool into a flag value
+func flag(set bool) int {
+	if set {
+		return 1
+	}
+	return 0
 }
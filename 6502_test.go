@@ -1,4 +1,4 @@
-package main
+package mos6502
 
 import (
 	"reflect"
@@ -6,35 +6,539 @@ import (
 )
 
 type Memory struct {
-	memory [1 << 8]int
+	memory [1 << 16]uint8
 }
 
-func (m *Memory) Read(addr int) int {
+func (m *Memory) Read(addr uint16) uint8 {
 	return m.memory[addr]
 }
 
-func (m *Memory) Write(addr, value int) {
+func (m *Memory) Write(addr uint16, value uint8) {
 	m.memory[addr] = value
 }
 
 func TestGetAsWord(t *testing.T) {
-	procStat := ProcStat{c:1, z:1, i:1, d:1, b:1, v:1, n:1}
+	procStat := ProcStat{c:1, z:1, i:1, d:1, v:1, n:1}
 	pstatus := procStat.getAsWord()
 
-	if expProcStat := 223; pstatus != expProcStat {
+	if expProcStat := uint8(239); pstatus != expProcStat {
 		t.Errorf("Expected %+v, got %+v\n", expProcStat, pstatus)
 	}
 }
 
+func TestSetAsWord(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		pstatus uint8
+		// Expected
+		expProc ProcStat
+	}{
+		{name: "Negative", pstatus: BIT_7, expProc: ProcStat{n: 1}},
+		{name: "Overflow", pstatus: BIT_6, expProc: ProcStat{v: 1}},
+		{name: "Break and unused ignored", pstatus: BIT_4 | BIT_5, expProc: ProcStat{}},
+		{name: "All set",
+			pstatus: 0xFF,
+			expProc: ProcStat{c: 1, z: 1, i: 1, d: 1, v: 1, n: 1},
+		},
+	} {
+		procStat := ProcStat{}
+		procStat.setAsWord(tt.pstatus)
+		t.Log(tt.name)
+
+		if !reflect.DeepEqual(procStat, tt.expProc) {
+			t.Errorf("Expected %+v, got %+v\n", tt.expProc, procStat)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x0400, sp: 0x12}
+	mem.Write(0xFFFC, 0x34)
+	mem.Write(0xFFFD, 0x12)
+
+	cycles := cpu.Reset()
+
+	if expPc := uint16(0x1234); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+	if expSp := uint8(0xFD); cpu.sp != expSp {
+		t.Errorf("Expected %+v, got %+v\n", expSp, cpu.sp)
+	}
+	if cpu.p.i != 1 {
+		t.Errorf("Interrupt flag clear")
+	}
+	if expCycles := 7; cycles != expCycles {
+		t.Errorf("Expected %+v, got %+v\n", expCycles, cycles)
+	}
+}
+
+func TestIrq(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// Set-up
+		proc ProcStat
+		// Expected
+		expPc     uint16
+		expSp     uint8
+		expCycles int
+	}{
+		{name: "Interrupts enabled",
+			proc:  ProcStat{c: 1},
+			expPc: 0x2000, expSp: 0x3D, expCycles: 7,
+		},
+		{name: "Interrupts disabled",
+			proc:  ProcStat{i: 1},
+			expPc: 0x1235, expSp: 0x40, expCycles: 2,
+		},
+	} {
+		var mem Memory
+		cpu := Cpu{mem: &mem, pc: 0x1234, sp: 0x40, p: tt.proc}
+		mem.Write(0x1234, 0xEA)
+		mem.Write(0xFFFE, 0x00)
+		mem.Write(0xFFFF, 0x20)
+
+		cpu.SetIRQ(true)
+		cycles, _ := cpu.execute()
+		t.Log(tt.name)
+
+		if cpu.pc != tt.expPc {
+			t.Errorf("Expected %+v, got %+v\n", tt.expPc, cpu.pc)
+		}
+		if cpu.sp != tt.expSp {
+			t.Errorf("Expected %+v, got %+v\n", tt.expSp, cpu.sp)
+		}
+		if cycles != tt.expCycles {
+			t.Errorf("Expected %+v, got %+v\n", tt.expCycles, cycles)
+		}
+	}
+}
+
+func TestIrqStackFrame(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x1234, sp: 0x40, p: ProcStat{c: 1, n: 1}}
+	mem.Write(0xFFFE, 0x00)
+	mem.Write(0xFFFF, 0x20)
+
+	cpu.SetIRQ(true)
+	cpu.execute()
+
+	if exp := uint8(0x12); mem.Read(0x140) != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, mem.Read(0x140))
+	}
+	if exp := uint8(0x34); mem.Read(0x13F) != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, mem.Read(0x13F))
+	}
+	if mem.Read(0x13E)&BIT_4 != 0 {
+		t.Errorf("Break flag pushed by IRQ")
+	}
+	if mem.Read(0x13E)&BIT_0 == 0 {
+		t.Errorf("Carry flag not pushed")
+	}
+	if cpu.p.i != 1 {
+		t.Errorf("Interrupt flag clear")
+	}
+}
+
+func TestNmi(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x1234, sp: 0x40, p: ProcStat{i: 1}}
+	mem.Write(0x1234, 0xEA)
+	mem.Write(0x2000, 0xEA)
+	mem.Write(0xFFFA, 0x00)
+	mem.Write(0xFFFB, 0x20)
+
+	cpu.SetNMI(true)
+	if cycles, _ := cpu.execute(); cycles != 7 {
+		t.Errorf("Expected %+v, got %+v\n", 7, cycles)
+	}
+	if expPc := uint16(0x2000); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+
+	// The line is still asserted, but NMI only fires on the edge
+	cpu.SetNMI(true)
+	cpu.execute()
+	if expPc := uint16(0x2001); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+
+	// Released and asserted again
+	cpu.SetNMI(false)
+	cpu.SetNMI(true)
+	cpu.execute()
+	if expPc := uint16(0x2000); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+}
+
+func TestStep(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x0200}
+	// LDA #$10; STA $1234
+	for i, b := range []uint8{0xA9, 0x10, 0x8D, 0x34, 0x12} {
+		mem.Write(0x0200+uint16(i), b)
+	}
+
+	if cycles, _ := cpu.Step(); cycles != 2 {
+		t.Errorf("Expected %+v, got %+v\n", 2, cycles)
+	}
+	if cycles, _ := cpu.Step(); cycles != 4 {
+		t.Errorf("Expected %+v, got %+v\n", 4, cycles)
+	}
+	if expPc := uint16(0x0205); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+}
+
+func TestRunCycles(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x0200}
+	for i := uint16(0); i < 16; i++ {
+		mem.Write(0x0200+i, 0xEA)
+	}
+
+	// 3 NOPs, overshooting the budget by one cycle
+	if ran, _ := cpu.RunCycles(5); ran != 6 {
+		t.Errorf("Expected %+v, got %+v\n", 6, ran)
+	}
+	if expPc := uint16(0x0203); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+
+	// The overshoot is deducted from the next budget
+	if ran, _ := cpu.RunCycles(5); ran != 4 {
+		t.Errorf("Expected %+v, got %+v\n", 4, ran)
+	}
+	if expPc := uint16(0x0205); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+}
+
+func TestRunUntil(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x0200}
+	for i := uint16(0); i < 16; i++ {
+		mem.Write(0x0200+i, 0xEA)
+	}
+
+	ran, err := cpu.RunUntil(func(cpu *Cpu) bool {
+		return cpu.pc == 0x0208
+	})
+
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if ran != 16 {
+		t.Errorf("Expected %+v, got %+v\n", 16, ran)
+	}
+	if expPc := uint16(0x0208); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+}
+
+func TestTick(t *testing.T) {
+	r := func(addr uint16, data uint8) BusCycle { return BusCycle{Addr: addr, Data: data} }
+	w := func(addr uint16, data uint8) BusCycle { return BusCycle{Addr: addr, Data: data, Write: true} }
+
+	for _, tt := range []struct {
+		name string
+		// Set-up: the instruction at $0200
+		variant Variant
+		inst    []uint8
+		x, sp   uint8
+		mem     [][2]int
+		// Expected
+		expBus []BusCycle
+	}{
+		{name: "Implied",
+			inst:   []uint8{0xE8},
+			expBus: []BusCycle{r(0x0200, 0xE8), r(0x0201, 0x00)},
+		},
+		{name: "Zero page,X",
+			inst: []uint8{0xB5, 0x10}, x: 0x05, mem: [][2]int{{0x15, 0x42}},
+			expBus: []BusCycle{
+				r(0x0200, 0xB5), r(0x0201, 0x10), r(0x0010, 0x00), r(0x0015, 0x42),
+			},
+		},
+		{name: "Absolute,X",
+			inst: []uint8{0xBD, 0x34, 0x12}, x: 0x01, mem: [][2]int{{0x1235, 0x42}},
+			expBus: []BusCycle{
+				r(0x0200, 0xBD), r(0x0201, 0x34), r(0x0202, 0x12), r(0x1235, 0x42),
+			},
+		},
+		{name: "Absolute,X crossing a page",
+			inst: []uint8{0xBD, 0xFF, 0x12}, x: 0x01, mem: [][2]int{{0x1300, 0x42}},
+			expBus: []BusCycle{
+				r(0x0200, 0xBD), r(0x0201, 0xFF), r(0x0202, 0x12),
+				r(0x1200, 0x00), r(0x1300, 0x42),
+			},
+		},
+		{name: "Absolute,X crossing a page, 65C02",
+			variant: WDC65C02,
+			inst:    []uint8{0xBD, 0xFF, 0x12}, x: 0x01, mem: [][2]int{{0x1300, 0x42}},
+			expBus: []BusCycle{
+				r(0x0200, 0xBD), r(0x0201, 0xFF), r(0x0202, 0x12),
+				r(0x0202, 0x12), r(0x1300, 0x42),
+			},
+		},
+		{name: "Absolute,X, store",
+			inst: []uint8{0x9D, 0x34, 0x12}, x: 0x01,
+			expBus: []BusCycle{
+				r(0x0200, 0x9D), r(0x0201, 0x34), r(0x0202, 0x12),
+				r(0x1235, 0x00), w(0x1235, 0x00),
+			},
+		},
+		{name: "Read-modify-write",
+			inst: []uint8{0xE6, 0x10}, mem: [][2]int{{0x10, 0x41}},
+			expBus: []BusCycle{
+				r(0x0200, 0xE6), r(0x0201, 0x10),
+				r(0x0010, 0x41), w(0x0010, 0x41), w(0x0010, 0x42),
+			},
+		},
+		{name: "Read-modify-write, 65C02",
+			variant: WDC65C02,
+			inst:    []uint8{0xE6, 0x10}, mem: [][2]int{{0x10, 0x41}},
+			expBus: []BusCycle{
+				r(0x0200, 0xE6), r(0x0201, 0x10),
+				r(0x0010, 0x41), r(0x0010, 0x41), w(0x0010, 0x42),
+			},
+		},
+		{name: "Reserved $5C, 65C02",
+			variant: WDC65C02,
+			inst:    []uint8{0x5C, 0x34, 0x12}, mem: [][2]int{{0x1234, 0x42}},
+			// the last four cycles are approximated
+			expBus: []BusCycle{
+				r(0x0200, 0x5C), r(0x0201, 0x34), r(0x0202, 0x12), r(0x1234, 0x42),
+				r(0x0203, 0x00), r(0x0203, 0x00), r(0x0203, 0x00), r(0x0203, 0x00),
+			},
+		},
+		{name: "(Zero page,X)",
+			inst: []uint8{0xA1, 0x20}, x: 0x04,
+			mem: [][2]int{{0x24, 0x34}, {0x25, 0x12}, {0x1234, 0x42}},
+			expBus: []BusCycle{
+				r(0x0200, 0xA1), r(0x0201, 0x20), r(0x0020, 0x00),
+				r(0x0024, 0x34), r(0x0025, 0x12), r(0x1234, 0x42),
+			},
+		},
+		{name: "Branch, taken and crossing a page",
+			inst: []uint8{0xD0, 0x80},
+			expBus: []BusCycle{
+				r(0x0200, 0xD0), r(0x0201, 0x80), r(0x0202, 0x00), r(0x0282, 0x00),
+			},
+		},
+		{name: "PLA",
+			inst: []uint8{0x68}, sp: 0xFC, mem: [][2]int{{0x1FD, 0x42}},
+			expBus: []BusCycle{
+				r(0x0200, 0x68), r(0x0201, 0x00), r(0x01FC, 0x00), r(0x01FD, 0x42),
+			},
+		},
+		{name: "JSR",
+			inst: []uint8{0x20, 0x34, 0x12}, sp: 0xFD,
+			expBus: []BusCycle{
+				r(0x0200, 0x20), r(0x0201, 0x34), r(0x01FD, 0x00),
+				w(0x01FD, 0x02), w(0x01FC, 0x02), r(0x0202, 0x12),
+			},
+		},
+		{name: "RTS",
+			inst: []uint8{0x60}, sp: 0xFB, mem: [][2]int{{0x1FC, 0x02}, {0x1FD, 0x12}},
+			expBus: []BusCycle{
+				r(0x0200, 0x60), r(0x0201, 0x00), r(0x01FB, 0x00),
+				r(0x01FC, 0x02), r(0x01FD, 0x12), r(0x1202, 0x00),
+			},
+		},
+	} {
+		var mem Memory
+		cpu := NewCpuVariant(&mem, tt.variant)
+		cpu.pc, cpu.x, cpu.sp = 0x0200, tt.x, tt.sp
+		for i, b := range tt.inst {
+			mem.Write(0x0200+uint16(i), b)
+		}
+		for _, c := range tt.mem {
+			mem.Write(uint16(c[0]), uint8(c[1]))
+		}
+
+		var bus []BusCycle
+		for range tt.expBus {
+			cycle, err := cpu.Tick()
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			bus = append(bus, cycle)
+		}
+		t.Log(tt.name)
+
+		if !reflect.DeepEqual(bus, tt.expBus) {
+			t.Errorf("Expected %+v, got %+v\n", tt.expBus, bus)
+		}
+		// the instruction is over: the next tick fetches an opcode
+		if cycle, _ := cpu.Tick(); cycle.Addr != cpu.pc-1 {
+			t.Errorf("Expected a fetch from %+v, got %+v\n", cpu.pc-1, cycle)
+		}
+	}
+}
+
+func TestTickAndStep(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x0200}
+	// LDX #$05; loop: DEX; BNE loop; NOP
+	for i, b := range []uint8{0xA2, 0x05, 0xCA, 0xD0, 0xFD, 0xEA} {
+		mem.Write(0x0200+uint16(i), b)
+	}
+
+	// Ticks one cycle at a time, up to the first cycle of the BNE
+	for i := 0; i < 5; i++ {
+		cpu.Tick()
+	}
+	if cpu.x != 0x04 {
+		t.Errorf("Expected %+v, got %+v\n", 0x04, cpu.x)
+	}
+
+	// Step finishes the BNE in progress
+	if cycles, _ := cpu.Step(); cycles != 2 || cpu.pc != 0x0202 {
+		t.Errorf("Expected 2 cycles to $0202, got %+v to %+v\n", cycles, cpu.pc)
+	}
+
+	// Then ticking takes as many cycles as stepping: DEX and a taken BNE
+	// three times, the last DEX and an untaken BNE
+	for i := 0; i < 3*(2+3)+2+2; i++ {
+		cpu.Tick()
+	}
+	if cpu.pc != 0x0205 {
+		t.Errorf("Expected %+v, got %+v\n", 0x0205, cpu.pc)
+	}
+	if cpu.x != 0 {
+		t.Errorf("Expected %+v, got %+v\n", 0, cpu.x)
+	}
+	if cycle, _ := cpu.Tick(); cycle != (BusCycle{Addr: 0x0205, Data: 0xEA}) {
+		t.Errorf("Expected the NOP to be fetched, got %+v\n", cycle)
+	}
+}
+
+func TestTickInterrupt(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x0200, sp: 0xFD}
+	mem.Write(0x0200, 0xEA)
+	mem.Write(0xFFFE, 0x00)
+	mem.Write(0xFFFF, 0x30)
+	cpu.SetIRQ(true)
+
+	var bus []BusCycle
+	for i := 0; i < 7; i++ {
+		cycle, _ := cpu.Tick()
+		bus = append(bus, cycle)
+	}
+
+	exp := []BusCycle{
+		{Addr: 0x0200, Data: 0xEA}, {Addr: 0x0200, Data: 0xEA},
+		{Addr: 0x01FD, Data: 0x02, Write: true},
+		{Addr: 0x01FC, Data: 0x00, Write: true},
+		{Addr: 0x01FB, Data: 0x20, Write: true},
+		{Addr: 0xFFFE, Data: 0x00}, {Addr: 0xFFFF, Data: 0x30},
+	}
+	if !reflect.DeepEqual(bus, exp) {
+		t.Errorf("Expected %+v, got %+v\n", exp, bus)
+	}
+}
+
+func TestUndefinedPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy UndefinedPolicy
+		// LAX $1234,Y: undocumented, 3 bytes and 4 cycles
+		inst uint8
+		// Expected
+		expPc     uint16
+		expCycles int
+		expErr    bool
+		expHalted bool
+	}{
+		{name: "Error",
+			policy: UndefinedError, inst: 0xBF,
+			expPc: 0x0200, expCycles: 0, expErr: true,
+		},
+		{name: "Halt",
+			policy: UndefinedHalt, inst: 0xBF,
+			expPc: 0x0200, expCycles: 0, expHalted: true,
+		},
+		{name: "Nop",
+			policy: UndefinedNop, inst: 0xBF,
+			expPc: 0x0203, expCycles: 4,
+		},
+		{name: "Nop, implied",
+			policy: UndefinedNop, inst: 0x1A,
+			expPc: 0x0201, expCycles: 2,
+		},
+	} {
+		var mem Memory
+		cpu := Cpu{mem: &mem, pc: 0x0200}
+		cpu.SetUndefinedPolicy(tt.policy)
+		mem.Write(0x0200, tt.inst)
+
+		cycles, err := cpu.Step()
+		t.Log(tt.name)
+
+		if cpu.pc != tt.expPc {
+			t.Errorf("Expected %+v, got %+v\n", tt.expPc, cpu.pc)
+		}
+		if cycles != tt.expCycles {
+			t.Errorf("Expected %+v, got %+v\n", tt.expCycles, cycles)
+		}
+		if cpu.Halted() != tt.expHalted {
+			t.Errorf("Expected %+v, got %+v\n", tt.expHalted, cpu.Halted())
+		}
+		if (err != nil) != tt.expErr {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if uerr, ok := err.(*UndefinedOpcodeError); ok {
+			if uerr.Opcode != tt.inst || uerr.PC != 0x0200 {
+				t.Errorf("Expected %+v, got %+v\n",
+					UndefinedOpcodeError{tt.inst, 0x0200}, *uerr)
+			}
+		}
+	}
+}
+
+func TestRunUntilHalted(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x0200}
+	cpu.SetUndefinedPolicy(UndefinedHalt)
+	mem.Write(0x0200, 0xEA)
+	mem.Write(0x0201, 0x02)
+
+	ran, err := cpu.RunUntil(func(cpu *Cpu) bool {
+		return false
+	})
+
+	if err != ErrHalted {
+		t.Errorf("Expected %+v, got %+v\n", ErrHalted, err)
+	}
+	if ran != 2 {
+		t.Errorf("Expected %+v, got %+v\n", 2, ran)
+	}
+
+	// Time still goes by for a halted processor
+	if ran, _ := cpu.RunCycles(10); ran != 10 {
+		t.Errorf("Expected %+v, got %+v\n", 10, ran)
+	}
+
+	mem.Write(0xFFFC, 0x00)
+	mem.Write(0xFFFD, 0x02)
+	cpu.Reset()
+	if cpu.Halted() {
+		t.Errorf("Still halted after reset")
+	}
+}
+
 func TestAdc(t *testing.T) {
 	for _, tt := range []struct {
 		name string
 		// Set-up
-		ac, val int
-		adc     int
+		ac, val uint8
+		adc     uint16
 		proc    ProcStat
 		// Expected
-		expAc   int
+		expAc   uint8
 		expProc ProcStat
 	}{
 		{name: "Happy Path",
@@ -49,7 +553,7 @@ func TestAdc(t *testing.T) {
 		{name: "With overflow 2",
 			ac: 0xFF, val: 1, adc: 0,
 			expAc:  0,
-			expProc: ProcStat{n: 0, v: 0, c: 1},
+			expProc: ProcStat{n: 0, v: 0, c: 1, z: 1},
 		},
 		{name: "With negative",
 			val:     200,
@@ -61,7 +565,7 @@ func TestAdc(t *testing.T) {
 		},
 		{name: "With carry",
 			ac: 255, val: 1,
-			expProc: ProcStat{c: 1},
+			expProc: ProcStat{c: 1, z: 1},
 		},
 		{name: "Decimal mode, without Carry",
 			ac: 64, val: 8,
@@ -69,10 +573,18 @@ func TestAdc(t *testing.T) {
 			expProc: ProcStat{d: 1},
 			expAc:   72,
 		},
+		// N comes from the result before the high nibble is adjusted,
+		// Z from the binary sum
 		{name: "Decimal mode, with carry",
 			ac: 1, val: 153,
 			proc:    ProcStat{d: 1},
-			expProc: ProcStat{c: 1, d: 1},
+			expProc: ProcStat{c: 1, d: 1, n: 1},
+		},
+		{name: "Decimal mode, invalid BCD",
+			ac: 0x0F, val: 0x0F,
+			proc:    ProcStat{d: 1},
+			expProc: ProcStat{d: 1},
+			expAc:   0x14,
 		},
 	} {
 		var mem Memory
@@ -105,7 +617,7 @@ func TestAdcWithCarry(t *testing.T) {
 	if cpu.p.c != 1 {
 		t.Errorf("Carry flag clear")
 	}
-	if expect := 0; cpu.ac != expect {
+	if expect := uint8(0); cpu.ac != expect {
 		t.Errorf("Invalid result: %b != %d", cpu.ac, expect)
 	}
 }
@@ -119,7 +631,7 @@ func TestAnd(t *testing.T) {
 
 	cpu.and(0)
 
-	if expect := 240; cpu.ac != expect {
+	if expect := uint8(240); cpu.ac != expect {
 		t.Errorf("Invalid result: %b != %b", cpu.ac, expect)
 	}
 	if cpu.p.n != 1 || cpu.p.z != 0 {
@@ -135,7 +647,7 @@ func TestAslaWithoutCarry(t *testing.T) {
 
 	cpu.asla()
 
-	if expect := 32; cpu.ac != expect {
+	if expect := uint8(32); cpu.ac != expect {
 		t.Errorf("Invalid result: %b != %b", cpu.ac, expect)
 	}
 	if cpu.p.n != 0 || cpu.p.z != 0 || cpu.p.c != 0 {
@@ -168,7 +680,7 @@ func TestAslWithoutCarry(t *testing.T) {
 	cpu.asl(0)
 
 	actual := cpu.mem.Read(0)
-	if expect := 32; actual != expect {
+	if expect := uint8(32); actual != expect {
 		t.Errorf("Invalid result: %b != %b", actual, expect)
 	}
 	if cpu.p.c != 0 || cpu.p.n != 0 || cpu.p.z != 0 {
@@ -185,7 +697,7 @@ func TestAslWithCarry(t *testing.T) {
 	cpu.asl(0)
 
 	actual := cpu.mem.Read(0)
-	if expect := 0; actual != expect {
+	if expect := uint8(0); actual != expect {
 		t.Errorf("Invalid result: %b != %b", actual, expect)
 	}
 	if cpu.p.c != 1 || cpu.p.n != 0 || cpu.p.z != 1 {
@@ -204,7 +716,7 @@ func TestBccWithCarryClear(t *testing.T) {
 	if expect := true; actual != expect {
 		t.Errorf("Invalid return value: %v != %v", actual, expect)
 	}
-	if expect := 16; cpu.pc != expect {
+	if expect := uint16(16); cpu.pc != expect {
 		t.Errorf("Wrong PC")
 	}
 }
@@ -246,7 +758,7 @@ func TestBcsWithCarrySet(t *testing.T) {
 	if expect := true; actual != expect {
 		t.Errorf("Invalid return value: %v != %v", actual, expect)
 	}
-	if expect := 16; cpu.pc != expect {
+	if expect := uint16(16); cpu.pc != expect {
 		t.Errorf("Wrong PC")
 	}
 }
@@ -255,11 +767,11 @@ func TestBeq(t *testing.T) {
 	for _, tt := range []struct {
 		name string
 		// Set-up
-		addr	int
+		addr uint16
 		zero	int
 		proc	ProcStat
 		// Expected
-		expPc	int
+		expPc     uint16
 		expBranch bool
 	}{
 		{name: "With Zero",
@@ -293,31 +805,44 @@ func TestBit(t *testing.T) {
 	for _, tt := range []struct {
 		name string
 		// Set-up
-		addr	int
-		value	int
-		ac		int
+		addr  uint16
+		value uint8
+		ac    uint8
 		// Expected
-		expProc	ProcStat
+		expProc ProcStat
 	}{
 		{name: "Sets overflow",
-			value: 64,
-			expProc: ProcStat{z: 0, n: 0, v: 1}},
+			value:   64,
+			expProc: ProcStat{z: 1, n: 0, v: 1}},
 		{name: "Overflow not set",
-			value: 4,
-			expProc: ProcStat{z:0, n:0, v:0},
+			value: 4, ac: 4,
+			expProc: ProcStat{z: 0, n: 0, v: 0},
 		},
-	}{
+		{name: "Negative and overflow from the operand",
+			value: 0xC0, ac: 0,
+			expProc: ProcStat{z: 1, n: 1, v: 1},
+		},
+		{name: "Zero from the AND",
+			value: 0xC0, ac: 0x3F,
+			expProc: ProcStat{z: 1, n: 1, v: 1},
+		},
+		{name: "Not zero",
+			value: 0x81, ac: 0x01,
+			expProc: ProcStat{z: 0, n: 1, v: 0},
+		},
+	} {
 		var mem Memory
 		cpu := Cpu{
 			mem: &mem,
-			p: ProcStat{},
+			ac:  tt.ac,
+			p:   ProcStat{},
 		}
 		cpu.mem.Write(tt.addr, tt.value)
 
 		cpu.bit(tt.addr)
 		t.Log(tt.name)
 
-		if reflect.DeepEqual(cpu.p, tt.expProc) {
+		if !reflect.DeepEqual(cpu.p, tt.expProc) {
 			t.Errorf("Expected %+v, got %+v\n", tt.expProc, cpu.p)
 		}
 	}
@@ -327,10 +852,10 @@ func TestBmi(t *testing.T) {
 	for _, tt := range []struct {
 		name string
 		// Set-up
-		addr		int
+		addr     uint16
 		negative	int
 		// Expected
-		expPc	int
+		expPc     uint16
 		expBranch bool
 	}{
 		{name: "With Negative",
@@ -364,10 +889,10 @@ func TestBne(t *testing.T) {
 	for _, tt := range []struct {
 		name string
 		// Set-up
-		addr		int
+		addr uint16
 		zero		int
 		// Expected
-		expPc	int
+		expPc     uint16
 		expBranch bool
 	}{
 		{name: "With Equals",
@@ -401,10 +926,10 @@ func TestBpl(t *testing.T) {
 	for _, tt := range []struct {
 		name string
 		// Set-up
-		addr		int
+		addr     uint16
 		negative	int
 		// Expected
-		expPc	int
+		expPc     uint16
 		expBranch bool
 	}{
 		{name: "With Positive",
@@ -434,14 +959,47 @@ func TestBpl(t *testing.T) {
 	}
 }
 
+func TestBrk(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x1234, sp: 0x40, p: ProcStat{c: 1}}
+	mem.Write(0x1234, 0x00)
+	mem.Write(0xFFFE, 0x00)
+	mem.Write(0xFFFF, 0x20)
+
+	if cycles, _ := cpu.execute(); cycles != 7 {
+		t.Errorf("Expected %+v, got %+v\n", 7, cycles)
+	}
+
+	if expPc := uint16(0x2000); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+	if expSp := uint8(0x3D); cpu.sp != expSp {
+		t.Errorf("Expected %+v, got %+v\n", expSp, cpu.sp)
+	}
+	// Return address is the address of BRK plus 2
+	if exp := uint8(0x12); mem.Read(0x140) != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, mem.Read(0x140))
+	}
+	if exp := uint8(0x36); mem.Read(0x13F) != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, mem.Read(0x13F))
+	}
+	// Carry, break and unused bit
+	if exp := uint8(0x31); mem.Read(0x13E) != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, mem.Read(0x13E))
+	}
+	if cpu.p.i != 1 {
+		t.Errorf("Interrupt flag clear")
+	}
+}
+
 func TestBvc(t *testing.T) {
 	for _, tt := range []struct {
 		name string
 		// Set-up
-		addr		int
+		addr     uint16
 		overflow	int
 		// Expected
-		expPc	int
+		expPc     uint16
 		expBranch bool
 	}{
 		{name: "Without Overflow",
@@ -475,10 +1033,10 @@ func TestBvs(t *testing.T) {
 	for _, tt := range []struct {
 		name string
 		// Set-up
-		addr		int
+		addr     uint16
 		overflow	int
 		// Expected
-		expPc	int
+		expPc     uint16
 		expBranch bool
 	}{
 		{name: "With Overflow",
@@ -508,6 +1066,86 @@ func TestBvs(t *testing.T) {
 	}
 }
 
+func TestBranchCycles(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// Set-up: the branch sits at pc
+		pc     uint16
+		offset uint8
+		zero   int
+		// Expected
+		expPc     uint16
+		expCycles int
+	}{
+		{name: "Not taken",
+			pc: 0x0200, offset: 0x10, zero: 1,
+			expPc: 0x0202, expCycles: 2,
+		},
+		{name: "Forward",
+			pc: 0x0200, offset: 0x10,
+			expPc: 0x0212, expCycles: 3,
+		},
+		{name: "Backward",
+			pc: 0x0240, offset: 0xFC,
+			expPc: 0x023E, expCycles: 3,
+		},
+		{name: "Forward, crossing a page",
+			pc: 0x02F0, offset: 0x7F,
+			expPc: 0x0371, expCycles: 4,
+		},
+		{name: "Backward, crossing a page",
+			pc: 0x0200, offset: 0x80,
+			expPc: 0x0182, expCycles: 4,
+		},
+		{name: "Backward, to the last byte of the previous page",
+			pc: 0x0200, offset: 0xFD,
+			expPc: 0x01FF, expCycles: 4,
+		},
+		{name: "Wraps around the address space",
+			pc: 0xFFF0, offset: 0x7F,
+			expPc: 0x0071, expCycles: 4,
+		},
+	} {
+		var mem Memory
+		cpu := Cpu{mem: &mem, pc: tt.pc, p: ProcStat{z: tt.zero}}
+		// BNE
+		mem.Write(tt.pc, 0xD0)
+		mem.Write(tt.pc+1, tt.offset)
+
+		cycles, _ := cpu.execute()
+		t.Log(tt.name)
+
+		if cpu.pc != tt.expPc {
+			t.Errorf("Expected %+v, got %+v\n", tt.expPc, cpu.pc)
+		}
+		if cycles != tt.expCycles {
+			t.Errorf("Expected %+v, got %+v\n", tt.expCycles, cycles)
+		}
+	}
+}
+
+func TestBranchLoop(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, pc: 0x0200}
+	// LDX #$05; loop: DEX; BNE loop; NOP
+	for i, b := range []uint8{0xA2, 0x05, 0xCA, 0xD0, 0xFD, 0xEA} {
+		mem.Write(0x0200+uint16(i), b)
+	}
+
+	cycles, err := cpu.RunUntil(func(c *Cpu) bool { return c.PC() == 0x0205 })
+
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if cpu.x != 0 {
+		t.Errorf("Expected %+v, got %+v\n", 0, cpu.x)
+	}
+	// LDX, then five DEX and four taken plus one untaken BNE
+	if exp := 2 + 5*2 + 4*3 + 2; cycles != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, cycles)
+	}
+}
+
 func TestClc(t *testing.T) {
 	cpu := Cpu{}
 	cpu.p.c = 1
@@ -554,10 +1192,11 @@ func TestClv(t *testing.T) {
 
 func TestCmp(t *testing.T) {
 	for _, tt := range []struct {
-		name		string
-		reg, ac		int
-		x, y		int
-		data		int
+		name string
+		reg  int
+		ac   uint8
+		x, y uint8
+		data uint8
 		// Expected
 		expProc		ProcStat
 	}{
@@ -622,7 +1261,7 @@ func TestDecxyRegX(t *testing.T) {
 
 	cpu.decxy(X)
 
-	if exp := 0; cpu.x != exp {
+	if exp := uint8(0); cpu.x != exp {
 		t.Errorf("Expected %+v, got %+v\n", exp, cpu.x)
 	}
 	if exp := (ProcStat{z:1, n:0}); !reflect.DeepEqual(exp, cpu.p) {
@@ -636,7 +1275,7 @@ func TestDecxyRegY(t *testing.T) {
 
 	cpu.decxy(Y)
 
-	if exp := 0; cpu.y != exp {
+	if exp := uint8(0); cpu.y != exp {
 		t.Errorf("Expected %+v, got %+v\n", exp, cpu.y)
 	}
 	if exp := (ProcStat{z:1, n:0}); !reflect.DeepEqual(exp, cpu.p) {
@@ -653,7 +1292,7 @@ func TestEor(t *testing.T) {
 
 	cpu.eor(0)
 
-	if exp := 3; cpu.ac != exp {
+	if exp := uint8(3); cpu.ac != exp {
 		t.Errorf("Expected %+v, got %+v\n", exp, cpu.ac)
 	}
 	if exp := (ProcStat{z:0, n:0}); !reflect.DeepEqual(exp, cpu.p) {
@@ -670,7 +1309,7 @@ func TestInc(t *testing.T) {
 	cpu.inc(0)
 	actual := cpu.mem.Read(0)
 
-	if exp := 0; exp != actual {
+	if exp := uint8(0); exp != actual {
 		t.Errorf("Expected %+v, got %+v\n", exp, actual)
 	}
 	if exp := (ProcStat{z:1, n:0}); !reflect.DeepEqual(exp, cpu.p) {
@@ -684,7 +1323,7 @@ func TestIncxyRegX(t *testing.T) {
 
 	cpu.incxy(X)
 
-	if exp := 0; cpu.x != exp {
+	if exp := uint8(0); cpu.x != exp {
 		t.Errorf("Expected %+v, got %+v\n", exp, cpu.x)
 	}
 	if exp := (ProcStat{z:1, n:0}); !reflect.DeepEqual(exp, cpu.p) {
@@ -698,7 +1337,7 @@ func TestIncxyRegY(t *testing.T) {
 
 	cpu.incxy(Y)
 
-	if exp := 0; cpu.y != exp {
+	if exp := uint8(0); cpu.y != exp {
 		t.Errorf("Expected %+v, got %+v\n", exp, cpu.y)
 	}
 	if exp := (ProcStat{z:1, n:0}); !reflect.DeepEqual(exp, cpu.p) {
@@ -709,7 +1348,7 @@ func TestIncxyRegY(t *testing.T) {
 func TestJmp(t *testing.T) {
 	cpu := Cpu{}
 
-	exp := 24
+	exp := uint16(24)
 	cpu.jmp(exp)
 
 	if cpu.pc != exp {
@@ -717,20 +1356,94 @@ func TestJmp(t *testing.T) {
 	}
 }
 
-// TODO: test jsr
-
-func TestLdrWithAc(t *testing.T) {
+func TestJmpIndirect(t *testing.T) {
 	for _, tt := range []struct {
-		name				string
-		reg, data, addr		int
-		//exp
-		expProc				ProcStat
-	} {
-		{name: "With ac",
-			reg:A, data:100, addr:40,
-			expProc:ProcStat{},
+		name    string
+		variant Variant
+		ptr     uint16
+		// Expected
+		expPc     uint16
+		expCycles int
+	}{
+		{name: "NMOS",
+			variant: NMOS6502, ptr: 0x1230,
+			expPc: 0x5634, expCycles: 5,
 		},
-		{name: "With X",
+		{name: "NMOS, pointer at a page end",
+			variant: NMOS6502, ptr: 0x12FF,
+			expPc: 0x78EF, expCycles: 5,
+		},
+		{name: "65C02",
+			variant: WDC65C02, ptr: 0x1230,
+			expPc: 0x5634, expCycles: 6,
+		},
+		{name: "65C02, pointer at a page end",
+			variant: WDC65C02, ptr: 0x12FF,
+			expPc: 0x9AEF, expCycles: 6,
+		},
+	} {
+		var mem Memory
+		cpu := NewCpuVariant(&mem, tt.variant)
+		cpu.pc = 0x0200
+		mem.Write(0x0200, 0x6C)
+		mem.Write(0x0201, uint8(tt.ptr))
+		mem.Write(0x0202, uint8(tt.ptr>>8))
+		mem.Write(0x1230, 0x34)
+		mem.Write(0x1231, 0x56)
+		mem.Write(0x1200, 0x78)
+		mem.Write(0x12FF, 0xEF)
+		mem.Write(0x1300, 0x9A)
+
+		cycles, _ := cpu.execute()
+		t.Log(tt.name)
+
+		if cpu.pc != tt.expPc {
+			t.Errorf("Expected %+v, got %+v\n", tt.expPc, cpu.pc)
+		}
+		if cycles != tt.expCycles {
+			t.Errorf("Expected %+v, got %+v\n", tt.expCycles, cycles)
+		}
+	}
+}
+
+func TestJsr(t *testing.T) {
+	var mem Memory
+	// JSR $2000 at $1233: the pc points to the operand
+	cpu := Cpu{mem: &mem, pc: 0x1234, sp: 0xFF}
+	mem.Write(0x1234, 0x00)
+	mem.Write(0x1235, 0x20)
+
+	cpu.jsr()
+
+	if expPc := uint16(0x2000); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+	if expSp := uint8(0xFD); cpu.sp != expSp {
+		t.Errorf("Expected %+v, got %+v\n", expSp, cpu.sp)
+	}
+	// The return address pushed is the last byte of the jsr instruction
+	if exp := uint8(0x12); mem.Read(0x1FF) != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, mem.Read(0x1FF))
+	}
+	if exp := uint8(0x35); mem.Read(0x1FE) != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, mem.Read(0x1FE))
+	}
+}
+
+func TestLdrWithAc(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		reg  int
+		data uint8
+		addr uint16
+		//exp
+		expProc				ProcStat
+	} {
+		{name: "With ac",
+			reg:A, data:100, addr:40,
+			expProc:ProcStat{},
+		},
+		{name: "With X",
 			reg:X, data:100, addr:40,
 			expProc:ProcStat{},
 		},
@@ -745,7 +1458,7 @@ func TestLdrWithAc(t *testing.T) {
 
 		cpu.ldr(tt.addr, tt.reg)
 
-		var regValue int
+		var regValue uint8
 		switch (tt.reg) {
 		case A:
 			regValue = cpu.ac
@@ -767,9 +1480,9 @@ func TestLdrWithAc(t *testing.T) {
 func TestLsra(t *testing.T) {
 	for _, tt := range []struct {
 		name		string
-		ac			int
+		ac   uint8
 		// exp
-		expAc		int
+		expAc   uint8
 		expProc		ProcStat
 	} {
 		{name: "With carry set",
@@ -800,9 +1513,9 @@ func TestLsra(t *testing.T) {
 func TestLsrm(t *testing.T) {
 	for _, tt := range []struct {
 		name		string
-		val			int
+		val  uint8
 		// exp
-		expVal		int
+		expVal  uint8
 		expProc		ProcStat
 	} {
 		{name: "With carry set",
@@ -850,7 +1563,7 @@ func TestOra(t *testing.T) {
 
 	cpu.ora(0)
 
-	if exp := 15; cpu.ac != exp {
+	if exp := uint8(15); cpu.ac != exp {
 		t.Errorf("Expected %+v, got %+v\n", exp, cpu.ac)
 	}
 }
@@ -861,14 +1574,45 @@ func TestPha(t *testing.T) {
 
 	cpu.pha()
 
-	if expSp := 99; cpu.sp != expSp {
+	if expSp := uint8(99); cpu.sp != expSp {
 		t.Errorf("Expected %+v, got %+v\n", expSp, cpu.sp)
 	}
-	if expMemSp := cpu.mem.Read(100); expMemSp != cpu.ac {
+	if expMemSp := cpu.mem.Read(0x100 + 100); expMemSp != cpu.ac {
 		t.Errorf("Expected %+v, got %+v\n", expMemSp, cpu.ac)
 	}
 }
 
+func TestStackWrap(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem, sp: 0x00}
+
+	cpu.push(0x12)
+	if expSp := uint8(0xFF); cpu.sp != expSp {
+		t.Errorf("Expected %+v, got %+v\n", expSp, cpu.sp)
+	}
+	if exp := uint8(0x12); mem.Read(0x100) != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, mem.Read(0x100))
+	}
+
+	cpu.push(0x34)
+	if exp := uint8(0x34); mem.Read(0x1FF) != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, mem.Read(0x1FF))
+	}
+	if mem.Read(0xFF) != 0 {
+		t.Errorf("Stack written outside page one")
+	}
+
+	if data := cpu.pull(); data != 0x34 {
+		t.Errorf("Expected %+v, got %+v\n", 0x34, data)
+	}
+	if data := cpu.pull(); data != 0x12 {
+		t.Errorf("Expected %+v, got %+v\n", 0x12, data)
+	}
+	if expSp := uint8(0x00); cpu.sp != expSp {
+		t.Errorf("Expected %+v, got %+v\n", expSp, cpu.sp)
+	}
+}
+
 func TestPhp(t *testing.T) {
 	var mem Memory
 	procStat := ProcStat{}
@@ -877,15 +1621,20 @@ func TestPhp(t *testing.T) {
 
 	cpu.php()
 
-	if expProc := 223; cpu.p.getAsWord() != expProc {
+	if expProc := uint8(239); cpu.p.getAsWord() != expProc {
 		t.Errorf("Expected %+v, got %+v\n", expProc, cpu.p.getAsWord())
 	}
+	// B and the unused bit are set in the pushed copy
+	if expPushed := uint8(255); cpu.mem.Read(0x100+40) != expPushed {
+		t.Errorf("Expected %+v, got %+v\n", expPushed, cpu.mem.Read(0x100 + 40))
+	}
 }
 
 func TestPla(t *testing.T) {
 	var mem Memory
-	cpu := Cpu{mem:&mem, sp:40}
-	expAc := 5; mem.Write(41, expAc)
+	cpu := Cpu{mem: &mem, sp: 40}
+	expAc := uint8(5)
+	mem.Write(0x100+41, expAc)
 
 	cpu.pla()
 
@@ -901,9 +1650,10 @@ func TestPlp(t *testing.T) {
 	var mem Memory
 	procStat := ProcStat{}
 	procStat.setAsWord(223)
-	cpu := Cpu{p:procStat, sp:40, mem:&mem}
-	expSp := 41; expProc := 223;
-	cpu.mem.Write(expSp, procStat.getAsWord())
+	cpu := Cpu{p: procStat, sp: 40, mem: &mem}
+	expSp := uint8(41)
+	expProc := uint8(239)
+	cpu.mem.Write(0x100+uint16(expSp), 255)
 
 	cpu.plp()
 
@@ -918,10 +1668,10 @@ func TestPlp(t *testing.T) {
 func TestRola(t *testing.T) {
 	for _, tt := range []struct {
 		name		string
-		ac			int
+		ac   uint8
 		proc		ProcStat
 		// exp
-		expAc		int
+		expAc   uint8
 		expProc		ProcStat
 	} {
 		{name: "With carry bit",
@@ -959,10 +1709,10 @@ func TestRola(t *testing.T) {
 func TestRolm(t *testing.T) {
 	for _, tt := range []struct {
 		name		string
-		val			int
+		val  uint8
 		proc		ProcStat
 		// exp
-		expVal		int
+		expVal  uint8
 		expProc		ProcStat
 	} {
 		{name: "With carry bit",
@@ -1001,10 +1751,10 @@ func TestRolm(t *testing.T) {
 func TestRora(t *testing.T) {
 	for _, tt := range []struct {
 		name		string
-		ac			int
+		ac   uint8
 		proc		ProcStat
 		// exp
-		expAc		int
+		expAc   uint8
 		expProc		ProcStat
 	} {
 		{name: "With carry bit",
@@ -1042,10 +1792,10 @@ func TestRora(t *testing.T) {
 func TestRorm(t *testing.T) {
 	for _, tt := range []struct {
 		name		string
-		val			int
+		val  uint8
 		proc		ProcStat
 		// exp
-		expVal		int
+		expVal  uint8
 		expProc		ProcStat
 	} {
 		{name: "With carry bit",
@@ -1083,40 +1833,42 @@ func TestRorm(t *testing.T) {
 
 func TestRti(t *testing.T) {
 	var mem Memory
-	cpu := Cpu{mem:&mem}
-	sp := 100; cpu.sp = sp
+	cpu := Cpu{mem: &mem}
+	sp := uint8(100)
+	cpu.sp = sp
 
-	cpu.mem.Write(cpu.sp+1, 0xFF)
-	cpu.mem.Write(cpu.sp+2, 0x10)
-	cpu.mem.Write(cpu.sp+3, 0x10)
+	cpu.mem.Write(0x100+uint16(cpu.sp)+1, 0xFF)
+	cpu.mem.Write(0x100+uint16(cpu.sp)+2, 0x10)
+	cpu.mem.Write(0x100+uint16(cpu.sp)+3, 0x10)
 
 	cpu.rti()
 
-	if expSp := sp+3; cpu.sp != expSp {
+	if expSp := uint8(sp + 3); cpu.sp != expSp {
 		t.Errorf("Expected %+v, got %+v\n", expSp, cpu.sp)
 	}
-	if expProc := 223; cpu.p.getAsWord() != expProc {
+	if expProc := uint8(239); cpu.p.getAsWord() != expProc {
 		t.Errorf("Expected %+v, got %+v\n", expProc, cpu.p.getAsWord())
 	}
-	if expPc := 0x1010; cpu.pc != expPc {
+	if expPc := uint16(0x1010); cpu.pc != expPc {
 		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
 	}
 }
 
 func TestRts(t *testing.T) {
 	var mem Memory
-	cpu := Cpu{mem:&mem}
-	sp := 100; cpu.sp = sp
+	cpu := Cpu{mem: &mem}
+	sp := uint8(100)
+	cpu.sp = sp
 
-	cpu.mem.Write(cpu.sp+1, 0x10)
-	cpu.mem.Write(cpu.sp+2, 0x10)
+	cpu.mem.Write(0x100+uint16(cpu.sp)+1, 0x10)
+	cpu.mem.Write(0x100+uint16(cpu.sp)+2, 0x10)
 
 	cpu.rts()
 
-	if expPc := 0x1011; cpu.pc != expPc {
+	if expPc := uint16(0x1011); cpu.pc != expPc {
 		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
 	}
-	if expSp := sp+2; cpu.sp != expSp {
+	if expSp := uint8(sp + 2); cpu.sp != expSp {
 		t.Errorf("Expected %+v, got %+v\n", expSp, cpu.sp)
 	}
 }
@@ -1125,10 +1877,11 @@ func TestSbc(t *testing.T) {
 	for _, tt := range []struct {
 		name string
 		// Set-up
-		ac, val int
-		proc    ProcStat
+		ac   uint8
+		val  uint8
+		proc ProcStat
 		// Expected
-		expAc   int
+		expAc   uint8
 		expProc ProcStat
 	}{
 		{name: "Happy Path",
@@ -1147,20 +1900,30 @@ func TestSbc(t *testing.T) {
 			proc:	 ProcStat{c:1},
 			expProc: ProcStat{c:1, z:1},
 		},
-		// TODO: Review decimal mode
-/**
-		{name: "Decimal mode, without Carry",
-			ac: 64, val: 8,
-			proc:    ProcStat{d: 1},
-			expProc: ProcStat{d: 1},
-			expAc:   72,
+		{name: "Decimal mode, without borrow",
+			ac: 0x46, val: 0x12,
+			proc:    ProcStat{c: 1, d: 1},
+			expProc: ProcStat{c: 1, d: 1},
+			expAc:   0x34,
 		},
-		{name: "Decimal mode, with carry",
-			ac: 1, val: 153,
+		{name: "Decimal mode, borrowing from the high nibble",
+			ac: 0x40, val: 0x13,
+			proc:    ProcStat{c: 1, d: 1},
+			expProc: ProcStat{c: 1, d: 1},
+			expAc:   0x27,
+		},
+		{name: "Decimal mode, with borrow",
+			ac: 0x32, val: 0x02,
 			proc:    ProcStat{d: 1},
 			expProc: ProcStat{c: 1, d: 1},
+			expAc:   0x29,
+		},
+		{name: "Decimal mode, negative",
+			ac: 0x12, val: 0x21,
+			proc:    ProcStat{c: 1, d: 1},
+			expProc: ProcStat{n: 1, d: 1},
+			expAc:   0x91,
 		},
-*/
 	} {
 		var mem Memory
 		cpu := Cpu{
@@ -1180,3 +1943,688 @@ func TestSbc(t *testing.T) {
 	}
 }
 
+func TestTransfer(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		op   func(cpu *Cpu)
+		// Expected
+		expAc, expX, expY uint8
+		expProc           ProcStat
+	}{
+		{name: "TAX, negative",
+			op:    func(cpu *Cpu) { cpu.taxy(X) },
+			expAc: 0x80, expX: 0x80, expY: 0x00, expProc: ProcStat{n: 1},
+		},
+		{name: "TAY, negative",
+			op:    func(cpu *Cpu) { cpu.taxy(Y) },
+			expAc: 0x80, expX: 0x01, expY: 0x80, expProc: ProcStat{n: 1},
+		},
+		{name: "TXA",
+			op:    func(cpu *Cpu) { cpu.txya(X) },
+			expAc: 0x01, expX: 0x01, expY: 0x00, expProc: ProcStat{},
+		},
+		{name: "TYA, zero",
+			op:    func(cpu *Cpu) { cpu.txya(Y) },
+			expAc: 0x00, expX: 0x01, expY: 0x00, expProc: ProcStat{z: 1},
+		},
+		{name: "TSX, negative",
+			op:    func(cpu *Cpu) { cpu.tsx() },
+			expAc: 0x80, expX: 0xFD, expY: 0x00, expProc: ProcStat{n: 1},
+		},
+	} {
+		cpu := Cpu{ac: 0x80, x: 0x01, sp: 0xFD}
+		tt.op(&cpu)
+		t.Log(tt.name)
+
+		if cpu.ac != tt.expAc || cpu.x != tt.expX || cpu.y != tt.expY {
+			t.Errorf("Expected %02X %02X %02X, got %02X %02X %02X\n",
+				tt.expAc, tt.expX, tt.expY, cpu.ac, cpu.x, cpu.y)
+		}
+		if !reflect.DeepEqual(cpu.p, tt.expProc) {
+			t.Errorf("Expected %+v, got %+v\n", tt.expProc, cpu.p)
+		}
+	}
+}
+
+// an int memory, as Mem used to be
+type intMemory struct {
+	memory [1 << 16]int
+}
+
+func (m *intMemory) Read(addr int) int {
+	return m.memory[addr]
+}
+
+func (m *intMemory) Write(addr, value int) {
+	m.memory[addr] = value
+}
+
+func TestAdaptIntMem(t *testing.T) {
+	var mem intMemory
+	// LDA $1234; STA $1235
+	for i, b := range []int{0xAD, 0x34, 0x12, 0x8D, 0x35, 0x12} {
+		mem.Write(0x0200+i, b)
+	}
+	// only the low 8 bits are seen
+	mem.Write(0x1234, 0x1C3)
+
+	cpu := NewCpu(AdaptIntMem(&mem))
+	cpu.SetPC(0x0200)
+	cpu.Step()
+	cpu.Step()
+
+	if exp := uint8(0xC3); cpu.ac != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, cpu.ac)
+	}
+	if exp := 0xC3; mem.Read(0x1235) != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, mem.Read(0x1235))
+	}
+}
+
+func TestUndocumented(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		illegal IllegalOpcodes
+		// Set-up: the instruction at $0200, its operand at $10
+		inst  []uint8
+		ac, x uint8
+		val   uint8
+		proc  ProcStat
+		// Expected
+		expAc, expX uint8
+		expVal      uint8
+		expProc     ProcStat
+		expPc       uint16
+		expCycles   int
+		expHalted   bool
+		expErr      bool
+	}{
+		{name: "LAX",
+			inst: []uint8{0xA7, 0x10}, val: 0x80,
+			expAc: 0x80, expX: 0x80, expVal: 0x80,
+			expProc: ProcStat{n: 1}, expPc: 0x0202, expCycles: 3,
+		},
+		{name: "SAX",
+			inst: []uint8{0x87, 0x10}, ac: 0xF0, x: 0x3C,
+			expAc: 0xF0, expX: 0x3C, expVal: 0x30,
+			expPc: 0x0202, expCycles: 3,
+		},
+		{name: "DCP",
+			inst: []uint8{0xC7, 0x10}, ac: 0x40, val: 0x41,
+			expAc: 0x40, expVal: 0x40,
+			expProc: ProcStat{z: 1, c: 1}, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "ISC",
+			inst: []uint8{0xE7, 0x10}, ac: 0x20, val: 0x0F, proc: ProcStat{c: 1},
+			expAc: 0x10, expVal: 0x10,
+			expProc: ProcStat{c: 1}, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "SLO",
+			inst: []uint8{0x07, 0x10}, ac: 0x02, val: 0x81,
+			expAc: 0x02, expVal: 0x02,
+			expProc: ProcStat{c: 1}, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "RLA",
+			inst: []uint8{0x27, 0x10}, ac: 0xFF, val: 0x81, proc: ProcStat{c: 1},
+			expAc: 0x03, expVal: 0x03,
+			expProc: ProcStat{c: 1}, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "SRE",
+			inst: []uint8{0x47, 0x10}, ac: 0x01, val: 0x03,
+			expAc: 0x00, expVal: 0x01,
+			expProc: ProcStat{c: 1, z: 1}, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "RRA",
+			inst: []uint8{0x67, 0x10}, ac: 0x01, val: 0x02, proc: ProcStat{c: 1},
+			expAc: 0x82, expVal: 0x81,
+			expProc: ProcStat{n: 1}, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "ANC",
+			inst: []uint8{0x0B, 0x80}, ac: 0xFF,
+			expAc: 0x80,
+			expProc: ProcStat{n: 1, c: 1}, expPc: 0x0202, expCycles: 2,
+		},
+		{name: "ALR",
+			inst: []uint8{0x4B, 0x03}, ac: 0xFF,
+			expAc: 0x01,
+			expProc: ProcStat{c: 1}, expPc: 0x0202, expCycles: 2,
+		},
+		{name: "ARR",
+			inst: []uint8{0x6B, 0xFF}, ac: 0xC0, proc: ProcStat{c: 1},
+			expAc: 0xE0,
+			expProc: ProcStat{n: 1, c: 1}, expPc: 0x0202, expCycles: 2,
+		},
+		{name: "SBX",
+			inst: []uint8{0xCB, 0x02}, ac: 0x0F, x: 0xF3,
+			expAc: 0x0F, expX: 0x01,
+			expProc: ProcStat{c: 1}, expPc: 0x0202, expCycles: 2,
+		},
+		{name: "SBC immediate",
+			inst: []uint8{0xEB, 0x01}, ac: 0x03, proc: ProcStat{c: 1},
+			expAc: 0x02,
+			expProc: ProcStat{c: 1}, expPc: 0x0202, expCycles: 2,
+		},
+		{name: "NOP zero page",
+			inst:  []uint8{0x04, 0x10},
+			expPc: 0x0202, expCycles: 3,
+		},
+		{name: "NOP absolute",
+			inst:  []uint8{0x0C, 0x10, 0x00},
+			expPc: 0x0203, expCycles: 4,
+		},
+		{name: "JAM",
+			inst:  []uint8{0x02},
+			expPc: 0x0200, expCycles: 2, expHalted: true,
+		},
+		{name: "Unstable, not enabled",
+			inst: []uint8{0x8B, 0xFF}, ac: 0xFF, x: 0x0F,
+			expAc: 0xFF, expX: 0x0F,
+			expPc: 0x0200, expErr: true,
+		},
+		{name: "Unstable XAA",
+			illegal: IllegalAll,
+			inst:    []uint8{0x8B, 0xFF}, ac: 0xFF, x: 0x0F,
+			expAc: 0x0F, expX: 0x0F,
+			expPc: 0x0202, expCycles: 2,
+		},
+		{name: "Unstable LXA",
+			illegal: IllegalAll,
+			inst:    []uint8{0xAB, 0x33}, ac: 0x00,
+			expAc: 0x22, expX: 0x22,
+			expPc: 0x0202, expCycles: 2,
+		},
+	} {
+		var mem Memory
+		cpu := Cpu{mem: &mem, pc: 0x0200, ac: tt.ac, x: tt.x, p: tt.proc}
+		if tt.illegal == IllegalNone {
+			cpu.SetIllegalOpcodes(IllegalStable)
+		} else {
+			cpu.SetIllegalOpcodes(tt.illegal)
+		}
+		for i, b := range tt.inst {
+			mem.Write(0x0200+uint16(i), b)
+		}
+		mem.Write(0x10, tt.val)
+
+		cycles, err := cpu.Step()
+		t.Log(tt.name)
+
+		if cpu.ac != tt.expAc {
+			t.Errorf("Expected ac %+v, got %+v\n", tt.expAc, cpu.ac)
+		}
+		if cpu.x != tt.expX {
+			t.Errorf("Expected x %+v, got %+v\n", tt.expX, cpu.x)
+		}
+		if actVal := mem.Read(0x10); actVal != tt.expVal {
+			t.Errorf("Expected %+v, got %+v\n", tt.expVal, actVal)
+		}
+		if !reflect.DeepEqual(cpu.p, tt.expProc) {
+			t.Errorf("Expected %+v, got %+v\n", tt.expProc, cpu.p)
+		}
+		if cpu.pc != tt.expPc {
+			t.Errorf("Expected %+v, got %+v\n", tt.expPc, cpu.pc)
+		}
+		if cycles != tt.expCycles {
+			t.Errorf("Expected %+v, got %+v\n", tt.expCycles, cycles)
+		}
+		if cpu.Halted() != tt.expHalted {
+			t.Errorf("Expected %+v, got %+v\n", tt.expHalted, cpu.Halted())
+		}
+		if (err != nil) != tt.expErr {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+}
+
+func Test6507(t *testing.T) {
+	var mem Memory
+	cpu := NewCpuVariant(&mem, MOS6507)
+	// The reset vector is seen at $1FFC
+	mem.Write(0x1FFC, 0x00)
+	mem.Write(0x1FFD, 0xF0)
+	mem.Write(0x1000, 0xEA)
+
+	cpu.Reset()
+	if expPc := uint16(0xF000); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+
+	// No interrupt pins
+	cpu.p.i = 0
+	cpu.SetIRQ(true)
+	cpu.SetNMI(true)
+	if cycles, _ := cpu.Step(); cycles != 2 {
+		t.Errorf("Expected %+v, got %+v\n", 2, cycles)
+	}
+	if expPc := uint16(0xF001); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+}
+
+func Test2A03(t *testing.T) {
+	var mem Memory
+	cpu := NewCpuVariant(&mem, RICOH2A03)
+	cpu.ac = 0x09
+	cpu.p.d = 1
+	mem.Write(0, 0x01)
+
+	cpu.adc(0)
+
+	// Decimal mode is ignored
+	if exp := uint8(0x0A); cpu.ac != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, cpu.ac)
+	}
+}
+
+func Test65C02(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// Set-up: the instruction at $0200, its operand at $10
+		inst     []uint8
+		ac, x, y uint8
+		val      uint8
+		proc     ProcStat
+		// Expected
+		expAc     uint8
+		expVal    uint8
+		expProc   ProcStat
+		expPc     uint16
+		expCycles int
+	}{
+		{name: "BRA",
+			inst:  []uint8{0x80, 0x10},
+			expPc: 0x0212, expCycles: 3,
+		},
+		{name: "STZ",
+			inst: []uint8{0x64, 0x10}, val: 0xFF,
+			expVal: 0x00, expPc: 0x0202, expCycles: 3,
+		},
+		{name: "TSB",
+			inst: []uint8{0x04, 0x10}, ac: 0x0F, val: 0xF0,
+			expAc: 0x0F, expVal: 0xFF,
+			expProc: ProcStat{z: 1}, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "TRB",
+			inst: []uint8{0x14, 0x10}, ac: 0x0F, val: 0xFF,
+			expAc: 0x0F, expVal: 0xF0,
+			expPc: 0x0202, expCycles: 5,
+		},
+		{name: "INC A",
+			inst: []uint8{0x1A}, ac: 0x7F,
+			expAc: 0x80, expProc: ProcStat{n: 1}, expPc: 0x0201, expCycles: 2,
+		},
+		{name: "DEC A",
+			inst: []uint8{0x3A}, ac: 0x01,
+			expAc: 0x00, expProc: ProcStat{z: 1}, expPc: 0x0201, expCycles: 2,
+		},
+		{name: "BIT immediate",
+			inst: []uint8{0x89, 0xC0}, ac: 0x01,
+			expAc: 0x01, expProc: ProcStat{z: 1}, expPc: 0x0202, expCycles: 2,
+		},
+		{name: "LDA (zp)",
+			inst: []uint8{0xB2, 0x12}, val: 0x20,
+			expAc: 0x20, expVal: 0x20, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "BIT zp,X",
+			inst: []uint8{0x34, 0x0E}, x: 0x02, val: 0xC0,
+			expVal: 0xC0, expProc: ProcStat{n: 1, v: 1, z: 1}, expPc: 0x0202, expCycles: 4,
+		},
+		{name: "RMB3",
+			inst: []uint8{0x37, 0x10}, val: 0xFF,
+			expVal: 0xF7, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "SMB7",
+			inst:   []uint8{0xF7, 0x10},
+			expVal: 0x80, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "BBS0, taken",
+			inst: []uint8{0x8F, 0x10, 0x10}, val: 0x01,
+			expVal: 0x01, expPc: 0x0213, expCycles: 6,
+		},
+		{name: "BBR0, not taken",
+			inst: []uint8{0x0F, 0x10, 0x10}, val: 0x01,
+			expVal: 0x01, expPc: 0x0203, expCycles: 5,
+		},
+		{name: "ADC decimal mode",
+			inst: []uint8{0x69, 0x01}, ac: 0x99, proc: ProcStat{d: 1},
+			expAc: 0x00, expProc: ProcStat{d: 1, c: 1, z: 1},
+			expPc: 0x0202, expCycles: 3,
+		},
+		{name: "Reserved NOP",
+			inst:  []uint8{0x5C, 0x00, 0x00},
+			expPc: 0x0203, expCycles: 8,
+		},
+		{name: "Reserved one byte NOP",
+			inst:  []uint8{0x03},
+			expPc: 0x0201, expCycles: 1,
+		},
+	} {
+		var mem Memory
+		cpu := NewCpuVariant(&mem, WDC65C02)
+		cpu.SetIllegalOpcodes(IllegalStable)
+		cpu.pc, cpu.ac, cpu.x, cpu.y, cpu.p = 0x0200, tt.ac, tt.x, tt.y, tt.proc
+		for i, b := range tt.inst {
+			mem.Write(0x0200+uint16(i), b)
+		}
+		mem.Write(0x10, tt.val)
+		// (zp) pointer at $12 to $10
+		mem.Write(0x12, 0x10)
+		mem.Write(0x13, 0x00)
+
+		cycles, err := cpu.Step()
+		t.Log(tt.name)
+
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if cpu.ac != tt.expAc {
+			t.Errorf("Expected ac %+v, got %+v\n", tt.expAc, cpu.ac)
+		}
+		if actVal := mem.Read(0x10); actVal != tt.expVal {
+			t.Errorf("Expected %+v, got %+v\n", tt.expVal, actVal)
+		}
+		if !reflect.DeepEqual(cpu.p, tt.expProc) {
+			t.Errorf("Expected %+v, got %+v\n", tt.expProc, cpu.p)
+		}
+		if cpu.pc != tt.expPc {
+			t.Errorf("Expected %+v, got %+v\n", tt.expPc, cpu.pc)
+		}
+		if cycles != tt.expCycles {
+			t.Errorf("Expected %+v, got %+v\n", tt.expCycles, cycles)
+		}
+	}
+}
+
+func Test65C02Stack(t *testing.T) {
+	var mem Memory
+	cpu := NewCpuVariant(&mem, WDC65C02)
+	cpu.pc, cpu.sp, cpu.x = 0x0200, 0xFF, 0x80
+	// PHX; PLY
+	mem.Write(0x0200, 0xDA)
+	mem.Write(0x0201, 0x7A)
+
+	cpu.Step()
+	cpu.Step()
+
+	if exp := uint8(0x80); cpu.y != exp {
+		t.Errorf("Expected %+v, got %+v\n", exp, cpu.y)
+	}
+	if cpu.p.n != 1 {
+		t.Errorf("Negative flag clear")
+	}
+	if expSp := uint8(0xFF); cpu.sp != expSp {
+		t.Errorf("Expected %+v, got %+v\n", expSp, cpu.sp)
+	}
+}
+
+func Test65C02Reserved(t *testing.T) {
+	var mem Memory
+	cpu := NewCpuVariant(&mem, WDC65C02)
+	cpu.pc = 0x0200
+	// the reserved opcodes are NOPs, whatever the illegal opcodes setting
+	mem.Write(0x0200, 0x02)
+
+	cycles, err := cpu.Step()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if expPc := uint16(0x0202); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+	if cycles != 2 {
+		t.Errorf("Expected %+v, got %+v\n", 2, cycles)
+	}
+}
+
+func Test65C02Interrupt(t *testing.T) {
+	var mem Memory
+	cpu := NewCpuVariant(&mem, WDC65C02)
+	cpu.pc, cpu.sp = 0x0200, 0xFF
+	cpu.p.d = 1
+	mem.Write(0x0200, 0xCB)
+	mem.Write(0xFFFE, 0x00)
+	mem.Write(0xFFFF, 0x30)
+
+	// WAI
+	cpu.Step()
+	if cycles, _ := cpu.Step(); cycles != 1 {
+		t.Errorf("Expected %+v, got %+v\n", 1, cycles)
+	}
+
+	cpu.SetIRQ(true)
+	cpu.Step()
+	if expPc := uint16(0x3000); cpu.pc != expPc {
+		t.Errorf("Expected %+v, got %+v\n", expPc, cpu.pc)
+	}
+	// Interrupts clear the decimal flag on the 65C02
+	if cpu.p.d != 0 {
+		t.Errorf("Decimal flag set")
+	}
+}
+
+// Reference model of the NMOS decimal mode, working nibble by nibble
+// rather than with the sequences from the implementation. Returns the
+// accumulator and the status.
+func decimalReference(sbc bool, ac, data, c int) (int, ProcStat) {
+	var p ProcStat
+	p.d = 1
+
+	if !sbc {
+		al := (ac & 0xF) + (data & 0xF) + c
+		if al > 9 {
+			al += 6
+		}
+		ah := (ac >> 4) + (data >> 4)
+		if al > 15 {
+			ah++
+		}
+		if (ac+data+c)&0xFF == 0 {
+			p.z = 1
+		}
+		p.n = (ah >> 3) & 1
+		p.v = ((^(ac ^ data) & (ac ^ (ah << 4))) >> 7) & 1
+		if ah > 9 {
+			ah += 6
+		}
+		if ah > 15 {
+			p.c = 1
+		}
+		return ((ah << 4) | (al & 0xF)) & 0xFF, p
+	}
+
+	borrow := 1 - c
+	diff := ac - data - borrow
+	al := (ac & 0xF) - (data & 0xF) - borrow
+	if al < 0 {
+		al -= 6
+	}
+	ah := (ac >> 4) - (data >> 4)
+	if al < 0 {
+		ah--
+	}
+	if diff&0xFF == 0 {
+		p.z = 1
+	}
+	p.n = (diff >> 7) & 1
+	p.v = (((ac ^ data) & (ac ^ diff)) >> 7) & 1
+	if diff >= 0 {
+		p.c = 1
+	}
+	if ah < 0 {
+		ah -= 6
+	}
+	return ((ah << 4) | (al & 0xF)) & 0xFF, p
+}
+
+// Checks the decimal mode of ADC and SBC for all 2x256x256 inputs
+func TestDecimalExhaustive(t *testing.T) {
+	var mem Memory
+	cpu := Cpu{mem: &mem}
+
+	for _, sbc := range []bool{false, true} {
+		for c := 0; c < 2; c++ {
+			for ac := 0; ac < 256; ac++ {
+				for data := 0; data < 256; data++ {
+					cpu.ac = uint8(ac)
+					cpu.p = ProcStat{d: 1, c: c}
+					mem.Write(0, uint8(data))
+					if sbc {
+						cpu.sbc(0)
+					} else {
+						cpu.adc(0)
+					}
+
+					expAc, expProc := decimalReference(sbc, ac, data, c)
+					if int(cpu.ac) != expAc || !reflect.DeepEqual(cpu.p, expProc) {
+						t.Fatalf("sbc=%v A=$%02X M=$%02X C=%d: expected %02X %+v, got %02X %+v\n",
+							sbc, ac, data, c, expAc, expProc, cpu.ac, cpu.p)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestAddressingModes(t *testing.T) {
+	type cell struct {
+		addr uint16
+		val  uint8
+	}
+
+	for _, tt := range []struct {
+		name string
+		// Set-up: the instruction at $0200
+		inst []uint8
+		x, y uint8
+		mem  []cell
+		// Expected
+		expAc, expX uint8
+		expWrite    cell
+		expPc       uint16
+		expCycles   int
+	}{
+		{name: "Immediate",
+			inst:  []uint8{0xA9, 0x42},
+			expAc: 0x42, expPc: 0x0202, expCycles: 2,
+		},
+		{name: "Zero page",
+			inst: []uint8{0xA5, 0x10}, mem: []cell{{0x10, 0x42}},
+			expAc: 0x42, expPc: 0x0202, expCycles: 3,
+		},
+		{name: "Zero page,X",
+			inst: []uint8{0xB5, 0x10}, x: 0x05, mem: []cell{{0x15, 0x42}},
+			expAc: 0x42, expX: 0x05, expPc: 0x0202, expCycles: 4,
+		},
+		{name: "Zero page,X wraps around",
+			inst: []uint8{0xB5, 0xF0}, x: 0x20, mem: []cell{{0x10, 0x42}, {0x110, 0xFF}},
+			expAc: 0x42, expX: 0x20, expPc: 0x0202, expCycles: 4,
+		},
+		{name: "Zero page,Y wraps around",
+			inst: []uint8{0xB6, 0xF0}, y: 0x20, mem: []cell{{0x10, 0x42}, {0x110, 0xFF}},
+			expX: 0x42, expPc: 0x0202, expCycles: 4,
+		},
+		{name: "Absolute",
+			inst: []uint8{0xAD, 0x34, 0x12}, mem: []cell{{0x1234, 0x42}},
+			expAc: 0x42, expPc: 0x0203, expCycles: 4,
+		},
+		{name: "Absolute, store",
+			inst: []uint8{0x8E, 0x34, 0x12}, x: 0x42,
+			expX: 0x42, expWrite: cell{0x1234, 0x42}, expPc: 0x0203, expCycles: 4,
+		},
+		{name: "Absolute,X",
+			inst: []uint8{0xBD, 0x34, 0x12}, x: 0x10, mem: []cell{{0x1244, 0x42}},
+			expAc: 0x42, expX: 0x10, expPc: 0x0203, expCycles: 4,
+		},
+		{name: "Absolute,X crossing a page",
+			inst: []uint8{0xBD, 0xFF, 0x12}, x: 0x01, mem: []cell{{0x1300, 0x42}},
+			expAc: 0x42, expX: 0x01, expPc: 0x0203, expCycles: 5,
+		},
+		{name: "Absolute,X wraps around",
+			inst: []uint8{0xBD, 0xFF, 0xFF}, x: 0x02, mem: []cell{{0x0001, 0x42}},
+			expAc: 0x42, expX: 0x02, expPc: 0x0203, expCycles: 5,
+		},
+		{name: "Absolute,Y",
+			inst: []uint8{0xB9, 0x34, 0x12}, y: 0x10, mem: []cell{{0x1244, 0x42}},
+			expAc: 0x42, expPc: 0x0203, expCycles: 4,
+		},
+		{name: "Absolute,Y crossing a page",
+			inst: []uint8{0xB9, 0xF0, 0x12}, y: 0x20, mem: []cell{{0x1310, 0x42}},
+			expAc: 0x42, expPc: 0x0203, expCycles: 5,
+		},
+		{name: "(Zero page,X)",
+			inst: []uint8{0xA1, 0x20}, x: 0x04,
+			mem:   []cell{{0x24, 0x34}, {0x25, 0x12}, {0x1234, 0x42}},
+			expAc: 0x42, expX: 0x04, expPc: 0x0202, expCycles: 6,
+		},
+		{name: "(Zero page,X) wraps around",
+			inst: []uint8{0xA1, 0xF0}, x: 0x0F,
+			mem:   []cell{{0xFF, 0x34}, {0x00, 0x12}, {0x100, 0x56}, {0x1234, 0x42}},
+			expAc: 0x42, expX: 0x0F, expPc: 0x0202, expCycles: 6,
+		},
+		{name: "(Zero page,X), store",
+			inst: []uint8{0x81, 0x20}, x: 0x04,
+			mem:  []cell{{0x24, 0x34}, {0x25, 0x12}},
+			expX: 0x04, expWrite: cell{0x1234, 0x00}, expPc: 0x0202, expCycles: 6,
+		},
+		{name: "(Zero page),Y",
+			inst: []uint8{0xB1, 0x20}, y: 0x10,
+			mem:   []cell{{0x20, 0x34}, {0x21, 0x12}, {0x1244, 0x42}},
+			expAc: 0x42, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "(Zero page),Y crossing a page",
+			inst: []uint8{0xB1, 0x20}, y: 0x20,
+			mem:   []cell{{0x20, 0xF0}, {0x21, 0x12}, {0x1310, 0x42}},
+			expAc: 0x42, expPc: 0x0202, expCycles: 6,
+		},
+		{name: "(Zero page),Y pointer wraps around",
+			inst: []uint8{0xB1, 0xFF}, y: 0x01,
+			mem:   []cell{{0xFF, 0x33}, {0x00, 0x12}, {0x100, 0x56}, {0x1234, 0x42}},
+			expAc: 0x42, expPc: 0x0202, expCycles: 5,
+		},
+		{name: "(Zero page),Y, store",
+			inst: []uint8{0x91, 0x20}, y: 0x10,
+			mem:      []cell{{0x20, 0x34}, {0x21, 0x12}},
+			expWrite: cell{0x1244, 0x00}, expPc: 0x0202, expCycles: 6,
+		},
+		{name: "Absolute,X, read-modify-write",
+			inst: []uint8{0xFE, 0x34, 0x12}, x: 0x10,
+			expX: 0x10, expWrite: cell{0x1244, 0xA6}, expPc: 0x0203, expCycles: 7,
+		},
+	} {
+		var mem Memory
+		cpu := Cpu{mem: &mem, pc: 0x0200, x: tt.x, y: tt.y}
+		for i, b := range tt.inst {
+			mem.Write(0x0200+uint16(i), b)
+		}
+		for _, c := range tt.mem {
+			mem.Write(c.addr, c.val)
+		}
+		if tt.expWrite.addr != 0 {
+			mem.Write(tt.expWrite.addr, 0xA5)
+		}
+
+		cycles, err := cpu.execute()
+		t.Log(tt.name)
+
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if cpu.ac != tt.expAc {
+			t.Errorf("Expected ac %+v, got %+v\n", tt.expAc, cpu.ac)
+		}
+		if cpu.x != tt.expX {
+			t.Errorf("Expected x %+v, got %+v\n", tt.expX, cpu.x)
+		}
+		if tt.expWrite.addr != 0 {
+			if actVal := mem.Read(tt.expWrite.addr); actVal != tt.expWrite.val {
+				t.Errorf("Expected %+v, got %+v\n", tt.expWrite.val, actVal)
+			}
+		}
+		if cpu.pc != tt.expPc {
+			t.Errorf("Expected %+v, got %+v\n", tt.expPc, cpu.pc)
+		}
+		if cycles != tt.expCycles {
+			t.Errorf("Expected %+v, got %+v\n", tt.expCycles, cycles)
+		}
+	}
+}
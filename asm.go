@@ -0,0 +1,1002 @@
+package mos6502
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The assembler takes the usual 6502 syntax:
+//
+//	; comments run to the end of the line
+//	        .org $C000
+//	CHROUT = $FFD2
+//	start:  ldx #0
+//	@loop:  lda msg,x       ; @ labels are local to the last global label
+//	        beq @done
+//	        jsr CHROUT
+//	        inx
+//	        bne @loop
+//	@done:  rts
+//	msg:    .text "HELLO"
+//	        .byte 0, <start, >start
+//
+// Mnemonics, directives and register names are case insensitive, labels
+// and macro names are not. Labels end with a colon.
+//
+// Expressions are made of numbers ($hex, %binary, decimal and 'c'
+// characters), labels, * for the address of the current instruction, the
+// unary operators - ~ < (low byte) and > (high byte), and the binary
+// operators * / % + - << >> & ^ |, from the tightest binding to the
+// loosest. An operand in parentheses is an indirect one, so group with
+// brackets: lda [2+3]*4.
+//
+// Directives:
+//
+//	.org expr             assemble at expr from here on. * = expr does too
+//	.byte expr|"text"...  emit bytes
+//	.word expr...         emit little endian words
+//	.text "text"          emit the bytes of a string
+//	.include "file"       assemble a file in place, relative to the
+//	                      including one
+//	.macro name p1, p2    define a macro up to .endm. Its parameters are
+//	                      replaced by the arguments of each use, and its @
+//	                      labels are local to each use
+//	.endm
+
+// AsmError is an error in the source given to the assembler
+type AsmError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *AsmError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// Image is the output of the assembler, ready to be loaded into memory
+type Image struct {
+	// the assembled code, in the order of the source
+	Segments []Segment
+	// the global labels and constants, by name
+	Symbols map[string]uint16
+	// the source line of each instruction, by address. The instructions
+	// of a macro have the lines of its body
+	Lines map[uint16]SourceLine
+}
+
+// SourceLine is a line of assembler source
+type SourceLine struct {
+	File string
+	Line int
+}
+
+// Segment is a run of bytes assembled at consecutive addresses
+type Segment struct {
+	Addr uint16
+	Data []uint8
+}
+
+// Load writes the image into a memory
+func (img *Image) Load(mem Mem) {
+	for _, seg := range img.Segments {
+		for i, b := range seg.Data {
+			mem.Write(seg.Addr+uint16(i), b)
+		}
+	}
+}
+
+// Assembler turns source text into an Image
+type Assembler struct {
+	// FS holds the files named by .include, and by AssembleFile. The
+	// current directory when nil
+	FS fs.FS
+
+	variant Variant
+	// opcodes by mnemonic and addressing mode
+	opcodes map[string]map[AddrMode]uint8
+}
+
+// NewAssembler returns an assembler for the instruction set of a processor
+// variant. The undocumented opcodes of the NMOS part are accepted too.
+func NewAssembler(variant Variant) *Assembler {
+	a := &Assembler{variant: variant, opcodes: map[string]map[AddrMode]uint8{}}
+
+	for i, op := range Opcodes(variant) {
+		if op.Status == Reserved {
+			continue
+		}
+		modes := a.opcodes[op.Mnemonic]
+		if modes == nil {
+			modes = map[AddrMode]uint8{}
+			a.opcodes[op.Mnemonic] = modes
+		}
+		// the documented opcode wins, then the lowest one
+		if prev, ok := modes[op.Mode]; !ok || op.Status == Official && Opcodes(variant)[prev].Status != Official {
+			modes[op.Mode] = uint8(i)
+		}
+	}
+
+	return a
+}
+
+// Assemble assembles source text for an NMOS 6502. Includes are read from
+// the current directory.
+func Assemble(src string) (*Image, error) {
+	return NewAssembler(NMOS6502).Assemble("", src)
+}
+
+// Assemble assembles source text. The name is used in error messages, and
+// to find the files it includes.
+func (a *Assembler) Assemble(name, src string) (*Image, error) {
+	as := &assembly{
+		Assembler: a,
+		macros:    map[string]*macro{},
+		symbols:   map[string]*symbol{},
+		lines:     map[uint16]SourceLine{},
+	}
+
+	as.expand(name, splitLines(src, 1), "", 0)
+	if len(as.errs) == 0 {
+		as.pass1()
+	}
+	if len(as.errs) == 0 {
+		as.pass2()
+	}
+	if len(as.errs) > 0 {
+		return nil, errors.Join(as.errs...)
+	}
+
+	img := &Image{Segments: as.segments, Symbols: map[string]uint16{}, Lines: as.lines}
+	for name, sym := range as.symbols {
+		if !strings.Contains(name, "@") && sym.known {
+			img.Symbols[name] = uint16(sym.value)
+		}
+	}
+	return img, nil
+}
+
+// AssembleFile assembles a file read from FS
+func (a *Assembler) AssembleFile(name string) (*Image, error) {
+	src, err := fs.ReadFile(a.fs(), name)
+	if err != nil {
+		return nil, err
+	}
+	return a.Assemble(name, string(src))
+}
+
+func (a *Assembler) fs() fs.FS {
+	if a.FS == nil {
+		return os.DirFS(".")
+	}
+	return a.FS
+}
+
+// how deep includes and macros can nest
+const asmMaxDepth = 32
+
+// a line of source
+type line struct {
+	num  int
+	text string
+}
+
+func splitLines(src string, first int) (lines []line) {
+	for i, text := range strings.Split(src, "\n") {
+		lines = append(lines, line{first + i, strings.TrimRight(text, "\r")})
+	}
+	return
+}
+
+type macro struct {
+	params []string
+	body   []line
+	file   string
+}
+
+// a statement of the source, with its includes and macros expanded
+type statement struct {
+	file string
+	line int
+	// the local labels of the statement belong to it
+	scope string
+	label string
+	// the mnemonic or the directive, with its dot. "=" for assignments,
+	// the operand being the value
+	op      string
+	operand string
+
+	// the address, size and opcode worked out by the first pass
+	addr   int
+	size   int
+	opcode uint8
+}
+
+type symbol struct {
+	value int
+	known bool
+	// the value of an assignment, worked out when it is first needed
+	expr       *statement
+	evaluating bool
+}
+
+// the state of an assembly
+type assembly struct {
+	*Assembler
+	statements []*statement
+	macros     map[string]*macro
+	uses       int
+	symbols    map[string]*symbol
+	segments   []Segment
+	lines      map[uint16]SourceLine
+	errs       []error
+}
+
+func (as *assembly) errorf(file string, num int, format string, args ...any) {
+	as.errs = append(as.errs, &AsmError{File: file, Line: num, Msg: fmt.Sprintf(format, args...)})
+}
+
+var (
+	labelRe  = regexp.MustCompile(`^(@?[A-Za-z_][A-Za-z0-9_]*):`)
+	assignRe = regexp.MustCompile(`^(@?[A-Za-z_][A-Za-z0-9_]*|\*)\s*=\s*(.*)$`)
+	identRe  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// turns lines of source into statements, running macros and includes.
+// Returns the scope the lines leave
+func (as *assembly) expand(file string, lines []line, scope string, depth int) string {
+	if len(lines) == 0 {
+		return scope
+	}
+	if depth > asmMaxDepth {
+		as.errorf(file, lines[0].num, "includes or macros nested too deep")
+		return scope
+	}
+
+	var def *macro
+	var defName string
+	for _, l := range lines {
+		text := strings.TrimSpace(stripComment(l.text))
+
+		if def != nil {
+			if strings.EqualFold(text, ".endm") {
+				as.macros[defName] = def
+				def = nil
+			} else {
+				def.body = append(def.body, l)
+			}
+			continue
+		}
+
+		st := &statement{file: file, line: l.num}
+		if m := labelRe.FindStringSubmatch(text); m != nil {
+			st.label = m[1]
+			text = strings.TrimSpace(text[len(m[0]):])
+		}
+		if m := assignRe.FindStringSubmatch(text); m != nil && st.label == "" {
+			if m[1] == "*" {
+				st.op, st.operand = ".org", m[2]
+			} else {
+				st.label, st.op, st.operand = m[1], "=", m[2]
+			}
+		} else if text != "" {
+			st.op, st.operand, _ = strings.Cut(text, " ")
+			if i := strings.IndexByte(st.op, '\t'); i >= 0 {
+				st.op, st.operand = st.op[:i], st.op[i+1:]+" "+st.operand
+			}
+			st.operand = strings.TrimSpace(st.operand)
+		}
+
+		if st.label != "" && !strings.HasPrefix(st.label, "@") {
+			scope = st.label
+		}
+		st.scope = scope
+
+		switch directive := strings.ToLower(st.op); {
+		case directive == ".macro":
+			if st.label != "" {
+				as.statements = append(as.statements, &statement{file: file, line: l.num, scope: scope, label: st.label})
+			}
+			name, params, _ := strings.Cut(st.operand, " ")
+			if !identRe.MatchString(name) {
+				as.errorf(file, l.num, "bad macro name %q", name)
+			}
+			def, defName = &macro{file: file}, name
+			for _, p := range splitArgs(params) {
+				def.params = append(def.params, strings.TrimSpace(p))
+			}
+
+		case directive == ".endm":
+			as.errorf(file, l.num, ".endm without .macro")
+
+		case directive == ".include":
+			if st.label != "" {
+				as.statements = append(as.statements, &statement{file: file, line: l.num, scope: scope, label: st.label})
+			}
+			name, err := strconv.Unquote(st.operand)
+			if err != nil {
+				as.errorf(file, l.num, "bad file name %s", st.operand)
+				continue
+			}
+			name = path.Join(path.Dir(file), name)
+			src, err := fs.ReadFile(as.fs(), name)
+			if err != nil {
+				as.errorf(file, l.num, "%v", err)
+				continue
+			}
+			scope = as.expand(name, splitLines(string(src), 1), scope, depth+1)
+
+		case as.macros[st.op] != nil:
+			if st.label != "" {
+				as.statements = append(as.statements, &statement{file: file, line: l.num, scope: scope, label: st.label})
+			}
+			as.use(st, depth)
+
+		default:
+			as.statements = append(as.statements, st)
+		}
+	}
+
+	if def != nil {
+		as.errorf(file, lines[len(lines)-1].num, "missing .endm")
+	}
+	return scope
+}
+
+// expands a use of a macro
+func (as *assembly) use(st *statement, depth int) {
+	m := as.macros[st.op]
+	args := splitArgs(st.operand)
+	if len(args) != len(m.params) {
+		as.errorf(st.file, st.line, "macro %s takes %d arguments, got %d", st.op, len(m.params), len(args))
+		return
+	}
+
+	subst := map[string]string{}
+	for i, p := range m.params {
+		subst[p] = strings.TrimSpace(args[i])
+	}
+
+	var body []line
+	for _, l := range m.body {
+		body = append(body, line{l.num, replaceIdents(l.text, subst)})
+	}
+
+	// the local labels of each use are its own
+	as.uses++
+	as.expand(m.file, body, fmt.Sprintf("%s#%d", st.op, as.uses), depth+1)
+}
+
+// works out the addresses of the statements, and so the values of the
+// labels
+func (as *assembly) pass1() {
+	pc := 0
+	for _, st := range as.statements {
+		st.addr = pc
+		if st.label != "" {
+			as.define(st, pc)
+		}
+
+		switch op := strings.ToLower(st.op); op {
+		case "", "=":
+
+		case ".org":
+			v, err := as.eval(st, st.operand, pc, true)
+			if err != nil {
+				as.errorf(st.file, st.line, ".org: %v", err)
+				continue
+			}
+			if v < 0 || v > 0xFFFF {
+				as.errorf(st.file, st.line, ".org out of range: %d", v)
+				continue
+			}
+			pc = v
+			st.addr = pc
+
+		case ".byte":
+			for _, arg := range splitArgs(st.operand) {
+				if s, err := strconv.Unquote(strings.TrimSpace(arg)); err == nil {
+					st.size += len(s)
+				} else {
+					st.size++
+				}
+			}
+
+		case ".word":
+			st.size = 2 * len(splitArgs(st.operand))
+
+		case ".text":
+			s, err := strconv.Unquote(st.operand)
+			if err != nil {
+				as.errorf(st.file, st.line, "bad string %s", st.operand)
+			}
+			st.size = len(s)
+
+		default:
+			modes, ok := as.opcodes[strings.ToUpper(st.op)]
+			if !ok {
+				as.errorf(st.file, st.line, "unknown instruction %s", st.op)
+				continue
+			}
+			mode, err := as.mode(st, modes, pc)
+			if err != nil {
+				as.errorf(st.file, st.line, "%v", err)
+				continue
+			}
+			st.opcode = modes[mode]
+			st.size = mode.Bytes()
+		}
+
+		pc += st.size
+		if pc > 0x10000 {
+			as.errorf(st.file, st.line, "code runs past $FFFF")
+			return
+		}
+	}
+}
+
+// defines the label of a statement
+func (as *assembly) define(st *statement, pc int) {
+	name := as.qualify(st.scope, st.label)
+	if _, ok := as.symbols[name]; ok {
+		as.errorf(st.file, st.line, "%s already defined", st.label)
+		return
+	}
+	if st.op == "=" {
+		as.symbols[name] = &symbol{expr: st}
+	} else {
+		as.symbols[name] = &symbol{value: pc, known: true}
+	}
+}
+
+// the full name of a label: local ones are prefixed with their scope
+func (as *assembly) qualify(scope, label string) string {
+	if strings.HasPrefix(label, "@") {
+		return scope + label
+	}
+	return label
+}
+
+// operand forms
+const (
+	formNone = iota
+	formA
+	formImm
+	formDirect
+	formX
+	formY
+	formInd
+	formIndX
+	formIndY
+	formPair
+)
+
+// the addressing modes each operand form can stand for: the zero page
+// one, if any, and the one for larger values
+var formModes = [...][2]AddrMode{
+	formNone:   {Implied, Accumulator},
+	formA:      {Accumulator, Accumulator},
+	formImm:    {Immediate, Immediate},
+	formDirect: {ZeroPage, Absolute},
+	formX:      {ZeroPageX, AbsoluteX},
+	formY:      {ZeroPageY, AbsoluteY},
+	formInd:    {ZeroPageIndirect, Indirect},
+	formIndX:   {IndirectX, AbsoluteIndirectX},
+	formIndY:   {IndirectY, IndirectY},
+	formPair:   {ZeroPageRelative, ZeroPageRelative},
+}
+
+// splits an operand into its form and expressions
+func parseOperand(operand string) (form int, exprs []string) {
+	switch {
+	case operand == "":
+		return formNone, nil
+	case strings.EqualFold(operand, "A"):
+		return formA, nil
+	case strings.HasPrefix(operand, "#"):
+		return formImm, []string{operand[1:]}
+	}
+
+	args := splitArgs(operand)
+	if strings.HasPrefix(operand, "(") {
+		end := closing(operand)
+		inner := splitArgs(operand[1:max(end, 1)])
+		rest := strings.TrimSpace(operand[end+1:])
+		switch {
+		case end == len(operand)-1 && len(inner) == 1:
+			return formInd, inner
+		case end == len(operand)-1 && len(inner) == 2 && isReg(inner[1], "X"):
+			return formIndX, inner[:1]
+		case len(inner) == 1 && len(args) == 2 && strings.HasPrefix(rest, ",") && isReg(args[1], "Y"):
+			return formIndY, inner
+		}
+	}
+
+	switch {
+	case len(args) == 2 && isReg(args[1], "X"):
+		return formX, args[:1]
+	case len(args) == 2 && isReg(args[1], "Y"):
+		return formY, args[:1]
+	case len(args) == 2:
+		return formPair, args
+	}
+	return formDirect, args
+}
+
+func isReg(s, reg string) bool {
+	return strings.EqualFold(strings.TrimSpace(s), reg)
+}
+
+// picks the addressing mode of an instruction. The zero page modes are
+// used when the value is known to fit on the first pass
+func (as *assembly) mode(st *statement, modes map[AddrMode]uint8, pc int) (AddrMode, error) {
+	form, exprs := parseOperand(st.operand)
+
+	if form == formDirect {
+		if _, ok := modes[Relative]; ok {
+			return Relative, nil
+		}
+	}
+
+	zp, wide := formModes[form][0], formModes[form][1]
+	_, hasZp := modes[zp]
+	_, hasWide := modes[wide]
+	switch {
+	case hasZp && hasWide && zp != wide:
+		v, err := as.eval(st, exprs[0], pc, false)
+		if err == nil && v >= 0 && v <= 0xFF {
+			return zp, nil
+		}
+		return wide, nil
+	case hasZp:
+		return zp, nil
+	case hasWide:
+		return wide, nil
+	}
+
+	return 0, fmt.Errorf("%s doesn't take operand %q", strings.ToUpper(st.op), st.operand)
+}
+
+// emits the code
+func (as *assembly) pass2() {
+	for _, st := range as.statements {
+		var data []uint8
+		switch op := strings.ToLower(st.op); op {
+		case "", "=", ".org":
+
+		case ".byte":
+			for _, arg := range splitArgs(st.operand) {
+				arg = strings.TrimSpace(arg)
+				if s, err := strconv.Unquote(arg); err == nil {
+					data = append(data, s...)
+					continue
+				}
+				data = append(data, as.byteValue(st, arg))
+			}
+
+		case ".word":
+			for _, arg := range splitArgs(st.operand) {
+				v := as.value(st, arg, -0x8000, 0xFFFF)
+				data = append(data, uint8(v), uint8(v>>8))
+			}
+
+		case ".text":
+			s, _ := strconv.Unquote(st.operand)
+			data = []uint8(s)
+
+		default:
+			data = as.instruction(st)
+			as.lines[uint16(st.addr)] = SourceLine{st.file, st.line}
+		}
+		as.emit(st, data)
+	}
+}
+
+// encodes an instruction
+func (as *assembly) instruction(st *statement) []uint8 {
+	mode := Opcodes(as.variant)[st.opcode].Mode
+	_, exprs := parseOperand(st.operand)
+	code := []uint8{st.opcode}
+
+	switch mode {
+	case Immediate:
+		code = append(code, as.byteValue(st, exprs[0]))
+	case Relative:
+		code = append(code, as.offset(st, exprs[0], st.addr+2))
+	case ZeroPageRelative:
+		code = append(code, uint8(as.value(st, exprs[0], 0, 0xFF)), as.offset(st, exprs[1], st.addr+3))
+	case ZeroPage, ZeroPageX, ZeroPageY, IndirectX, IndirectY, ZeroPageIndirect:
+		code = append(code, uint8(as.value(st, exprs[0], 0, 0xFF)))
+	case Absolute, AbsoluteX, AbsoluteY, Indirect, AbsoluteIndirectX:
+		v := as.value(st, exprs[0], 0, 0xFFFF)
+		code = append(code, uint8(v), uint8(v>>8))
+	}
+
+	return code
+}
+
+// evaluates a byte, signed or not
+func (as *assembly) byteValue(st *statement, expr string) uint8 {
+	return uint8(as.value(st, expr, -0x80, 0xFF))
+}
+
+// evaluates the offset of a branch from the address it's relative to
+func (as *assembly) offset(st *statement, expr string, from int) uint8 {
+	target := as.value(st, expr, 0, 0xFFFF)
+	offset := target - from
+	if offset < -0x80 || offset > 0x7F {
+		as.errorf(st.file, st.line, "branch out of range: %d bytes", offset)
+	}
+	return uint8(offset)
+}
+
+// evaluates an expression on the second pass, checking its range
+func (as *assembly) value(st *statement, expr string, lo, hi int) int {
+	v, err := as.eval(st, expr, st.addr, true)
+	if err != nil {
+		as.errorf(st.file, st.line, "%v", err)
+		return 0
+	}
+	if v < lo || v > hi {
+		as.errorf(st.file, st.line, "value out of range: %s = %d", strings.TrimSpace(expr), v)
+	}
+	return v
+}
+
+// appends the bytes of a statement to the image
+func (as *assembly) emit(st *statement, data []uint8) {
+	if len(data) == 0 {
+		return
+	}
+	addr := uint16(st.addr)
+	if n := len(as.segments); n > 0 {
+		seg := &as.segments[n-1]
+		if int(seg.Addr)+len(seg.Data) == st.addr {
+			seg.Data = append(seg.Data, data...)
+			return
+		}
+	}
+	as.segments = append(as.segments, Segment{Addr: addr, Data: data})
+}
+
+// errUnknown is the value of an expression that uses a label not defined
+// yet, on the first pass
+var errUnknown = errors.New("unknown value")
+
+// evaluates an expression. pc is the value of *. When final is false,
+// labels not defined yet are not an error, but make the value unknown
+func (as *assembly) eval(st *statement, expr string, pc int, final bool) (int, error) {
+	e := &expression{as: as, st: st, src: expr, pc: pc, final: final}
+	v, err := e.parse(0)
+	if err == nil {
+		e.space()
+		if e.pos < len(e.src) {
+			err = fmt.Errorf("unexpected %q in %q", e.src[e.pos:], strings.TrimSpace(expr))
+		}
+	}
+	return v, err
+}
+
+// the value of a symbol
+func (as *assembly) lookup(st *statement, name string, final bool) (int, error) {
+	sym, ok := as.symbols[as.qualify(st.scope, name)]
+	if !ok {
+		if final {
+			return 0, fmt.Errorf("undefined label %s", name)
+		}
+		return 0, errUnknown
+	}
+
+	if !sym.known {
+		if sym.evaluating {
+			return 0, fmt.Errorf("%s is defined in terms of itself", name)
+		}
+		sym.evaluating = true
+		v, err := as.eval(sym.expr, sym.expr.operand, sym.expr.addr, final)
+		sym.evaluating = false
+		if err != nil {
+			return 0, err
+		}
+		sym.value, sym.known = v, true
+	}
+	return sym.value, nil
+}
+
+// an expression being parsed and evaluated
+type expression struct {
+	as    *assembly
+	st    *statement
+	src   string
+	pos   int
+	pc    int
+	final bool
+}
+
+// binary operators, by precedence from the loosest binding
+var binaryOps = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (e *expression) space() {
+	for e.pos < len(e.src) && (e.src[e.pos] == ' ' || e.src[e.pos] == '\t') {
+		e.pos++
+	}
+}
+
+// parses the operators of a precedence level and the tighter ones
+func (e *expression) parse(level int) (int, error) {
+	if level == len(binaryOps) {
+		return e.unary()
+	}
+
+	v, err := e.parse(level + 1)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		e.space()
+		op := ""
+		for _, o := range binaryOps[level] {
+			if strings.HasPrefix(e.src[e.pos:], o) {
+				op = o
+			}
+		}
+		if op == "" {
+			return v, nil
+		}
+		e.pos += len(op)
+
+		w, err := e.parse(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "|":
+			v |= w
+		case "^":
+			v ^= w
+		case "&":
+			v &= w
+		case "<<", ">>":
+			// a count past 31 is a mistake: nothing is left of a 16-bit value
+			if w < 0 || w > 31 {
+				return 0, fmt.Errorf("shift count out of range: %d", w)
+			}
+			if op == "<<" {
+				v <<= w
+			} else {
+				v >>= w
+			}
+		case "+":
+			v += w
+		case "-":
+			v -= w
+		case "*":
+			v *= w
+		case "/", "%":
+			if w == 0 {
+				return 0, errors.New("division by zero")
+			}
+			if op == "/" {
+				v /= w
+			} else {
+				v %= w
+			}
+		}
+	}
+}
+
+func (e *expression) unary() (int, error) {
+	e.space()
+	if e.pos == len(e.src) {
+		return 0, fmt.Errorf("missing value in %q", strings.TrimSpace(e.src))
+	}
+
+	switch c := e.src[e.pos]; c {
+	case '-', '~', '<', '>', '+':
+		e.pos++
+		v, err := e.unary()
+		switch c {
+		case '-':
+			v = -v
+		case '~':
+			v = ^v
+		case '<':
+			v &= 0xFF
+		case '>':
+			v = (v >> 8) & 0xFF
+		}
+		return v, err
+	}
+
+	return e.primary()
+}
+
+func (e *expression) primary() (int, error) {
+	rest := e.src[e.pos:]
+
+	switch c := rest[0]; {
+	case c == '(' || c == '[':
+		e.pos++
+		v, err := e.parse(0)
+		if err != nil {
+			return 0, err
+		}
+		e.space()
+		if e.pos == len(e.src) || e.src[e.pos] != map[byte]byte{'(': ')', '[': ']'}[c] {
+			return 0, fmt.Errorf("unbalanced %c in %q", c, strings.TrimSpace(e.src))
+		}
+		e.pos++
+		return v, nil
+
+	case c == '*':
+		e.pos++
+		return e.pc, nil
+
+	case c == '\'':
+		if len(rest) < 3 || rest[2] != '\'' {
+			return 0, fmt.Errorf("bad character %q", rest)
+		}
+		e.pos += 3
+		return int(rest[1]), nil
+
+	case c == '$' || c == '%' || c >= '0' && c <= '9':
+		base, digits := 10, rest
+		switch c {
+		case '$':
+			base, digits = 16, rest[1:]
+		case '%':
+			base, digits = 2, rest[1:]
+		}
+		n := 0
+		for n < len(digits) && isAlnum(digits[n]) {
+			n++
+		}
+		v, err := strconv.ParseInt(digits[:n], base, 32)
+		if err != nil {
+			return 0, fmt.Errorf("bad number %q", rest[:len(rest)-len(digits)+n])
+		}
+		e.pos += len(rest) - len(digits) + n
+		return int(v), nil
+
+	case c == '@' || c == '_' || isAlpha(c):
+		n := 1
+		for n < len(rest) && (isAlnum(rest[n]) || rest[n] == '_') {
+			n++
+		}
+		e.pos += n
+		return e.as.lookup(e.st, rest[:n], e.final)
+	}
+
+	return 0, fmt.Errorf("unexpected %q", rest)
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isAlnum(c byte) bool {
+	return isAlpha(c) || c >= '0' && c <= '9'
+}
+
+// removes the comment at the end of a line, if any
+func stripComment(text string) string {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"':
+			quote = c
+		case c == '\'' && i+2 < len(text) && text[i+2] == '\'':
+			i += 2
+		case c == ';':
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// splits a list at the commas outside brackets and strings
+func splitArgs(s string) (args []string) {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		case '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case '\'':
+			i += 2
+		case ',':
+			if depth == 0 {
+				args = append(args, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(args, s[start:])
+}
+
+// the index of the bracket closing the one s starts with, or the end of s
+func closing(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(s) - 1
+}
+
+// replaces whole identifiers outside strings
+func replaceIdents(text string, subst map[string]string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '"':
+			j := i + 1
+			for j < len(text) && text[j] != '"' {
+				if text[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(text))
+			b.WriteString(text[i:j])
+			i = j
+		case c == '_' || isAlpha(c):
+			j := i + 1
+			for j < len(text) && (isAlnum(text[j]) || text[j] == '_') {
+				j++
+			}
+			// the character before tells apart $AB and @labels
+			if r, ok := subst[text[i:j]]; ok && (i == 0 || text[i-1] != '$' && text[i-1] != '@' && text[i-1] != '.') {
+				b.WriteString(r)
+			} else {
+				b.WriteString(text[i:j])
+			}
+			i = j
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
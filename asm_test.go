@@ -0,0 +1,222 @@
+package mos6502
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAssemble(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		variant Variant
+		src     string
+		// Expected
+		exp []Segment
+	}{
+		{name: "Implied and accumulator",
+			src: ".org $0200\n inx\n asl\n ASL A",
+			exp: []Segment{{0x0200, []uint8{0xE8, 0x0A, 0x0A}}},
+		},
+		{name: "Zero page when it fits",
+			src: ".org $0200\n lda $10\n lda $0100\n lda $10,x\n ldx $10,y\n lda $10,y",
+			exp: []Segment{{0x0200, []uint8{0xA5, 0x10, 0xAD, 0x00, 0x01, 0xB5, 0x10, 0xB6, 0x10, 0xB9, 0x10, 0x00}}},
+		},
+		{name: "Indirect modes",
+			src: ".org $0200\n lda ($20,X)\n sta ($20),y\n jmp ($FFFC)",
+			exp: []Segment{{0x0200, []uint8{0xA1, 0x20, 0x91, 0x20, 0x6C, 0xFC, 0xFF}}},
+		},
+		{name: "Brackets group",
+			src: ".org $0200\n lda [2+3]*4\n lda (2+3)*4",
+			exp: []Segment{{0x0200, []uint8{0xA5, 0x14, 0xA5, 0x14}}},
+		},
+		{name: "Expressions",
+			src: "base = $1234\n.org $0200\n lda #<base\n ldx #>base\n ldy #%1010 | 1\n lda #'A'+1\n lda #-1\n .word base*2-$10, * ",
+			exp: []Segment{{0x0200, []uint8{0xA9, 0x34, 0xA2, 0x12, 0xA0, 0x0B, 0xA9, 0x42, 0xA9, 0xFF, 0x58, 0x24, 0x0A, 0x02}}},
+		},
+		{name: "Branches",
+			src: "* = $0200\nloop: dex\n bne loop\n beq done\n nop\ndone: rts",
+			exp: []Segment{{0x0200, []uint8{0xCA, 0xD0, 0xFD, 0xF0, 0x01, 0xEA, 0x60}}},
+		},
+		{name: "Forward references are absolute",
+			src: ".org $0200\n lda later\nlater = $10",
+			exp: []Segment{{0x0200, []uint8{0xAD, 0x10, 0x00}}},
+		},
+		{name: "Data",
+			src: ".org $0200\n.byte 1, \"AB\", 'c' ; comment; \"\n.text \"hi;\\n\"",
+			exp: []Segment{{0x0200, []uint8{0x01, 0x41, 0x42, 0x63, 0x68, 0x69, 0x3B, 0x0A}}},
+		},
+		{name: "Local labels",
+			src: ".org $0200\nfirst:\n@l: bne @l\nsecond:\n@l: bne @l\n jmp first",
+			exp: []Segment{{0x0200, []uint8{0xD0, 0xFE, 0xD0, 0xFE, 0x4C, 0x00, 0x02}}},
+		},
+		{name: "Macros",
+			src: ".macro inc16 addr\n inc addr\n bne @skip\n inc addr+1\n@skip:\n.endm\n" +
+				".org $0200\n inc16 $10\n inc16 $20",
+			exp: []Segment{{0x0200, []uint8{0xE6, 0x10, 0xD0, 0x02, 0xE6, 0x11, 0xE6, 0x20, 0xD0, 0x02, 0xE6, 0x21}}},
+		},
+		{name: "Segments",
+			src: ".org $0200\n nop\n.org $FFFC\n .word $0200\n.org $0201\n rts",
+			exp: []Segment{{0x0200, []uint8{0xEA}}, {0xFFFC, []uint8{0x00, 0x02}}, {0x0201, []uint8{0x60}}},
+		},
+		{name: "Undocumented",
+			src: ".org $0200\n lax $10\n nop\n nop $10",
+			exp: []Segment{{0x0200, []uint8{0xA7, 0x10, 0xEA, 0x04, 0x10}}},
+		},
+		{name: "65C02",
+			variant: WDC65C02,
+			src:     ".org $0200\n lda ($20)\n jmp ($2000,x)\n bra * \n bbr2 $10,*\n stz $10",
+			exp:     []Segment{{0x0200, []uint8{0xB2, 0x20, 0x7C, 0x00, 0x20, 0x80, 0xFE, 0x2F, 0x10, 0xFD, 0x64, 0x10}}},
+		},
+	} {
+		t.Log(tt.name)
+		img, err := NewAssembler(tt.variant).Assemble("", tt.src)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(img.Segments, tt.exp) {
+			t.Errorf("Expected %+v, got %+v\n", tt.exp, img.Segments)
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		src  string
+		// Expected
+		line int
+		msg  string
+	}{
+		{name: "Unknown instruction",
+			src: "nop\nfoo", line: 2, msg: "unknown instruction foo"},
+		{name: "Undefined label",
+			src: "nop\n\n jmp nowhere", line: 3, msg: "undefined label nowhere"},
+		{name: "Bad mode",
+			src: " inx #1", line: 1, msg: `INX doesn't take operand "#1"`},
+		{name: "Out of range",
+			src: " lda #$100", line: 1, msg: "value out of range: $100 = 256"},
+		{name: "Branch out of range",
+			src: "l: .org $0200\n bne $0300", line: 2, msg: "branch out of range: 254 bytes"},
+		{name: "Duplicate label",
+			src: "a:\na:", line: 2, msg: "a already defined"},
+		{name: "Local labels are scoped",
+			src: "one:\n@l: nop\ntwo:\n jmp @l", line: 4, msg: "undefined label @l"},
+		{name: "Macro arguments",
+			src: ".macro m a, b\n.endm\n m 1", line: 3, msg: "macro m takes 2 arguments, got 1"},
+		{name: "Missing .endm",
+			src: ".macro m\n nop", line: 2, msg: "missing .endm"},
+		{name: "Negative shift",
+			src: " lda #1<<-1", line: 1, msg: "shift count out of range: -1"},
+		{name: "Oversized shift",
+			src: " .byte 1<<70", line: 1, msg: "shift count out of range: 70"},
+		{name: "Recursion",
+			src: "foo = bar\nbar = foo\n lda foo", line: 3, msg: "foo is defined in terms of itself"},
+	} {
+		t.Log(tt.name)
+		_, err := Assemble(tt.src)
+		var asmErr *AsmError
+		if !errors.As(err, &asmErr) {
+			t.Errorf("Expected an AsmError, got %v", err)
+			continue
+		}
+		if exp := (&AsmError{Line: tt.line, Msg: tt.msg}); *asmErr != *exp {
+			t.Errorf("Expected %+v, got %+v\n", exp, asmErr)
+		}
+	}
+}
+
+func TestAssembleInclude(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.s":       {Data: []byte(".org $0200\n.include \"lib/io.s\"\n jsr print")},
+		"lib/io.s":     {Data: []byte(".include \"consts.s\"\nprint: lda #VALUE\n rts")},
+		"lib/consts.s": {Data: []byte("VALUE = 7\n bogus")},
+	}
+	a := NewAssembler(NMOS6502)
+	a.FS = fsys
+
+	_, err := a.AssembleFile("main.s")
+	var asmErr *AsmError
+	if !errors.As(err, &asmErr) || asmErr.File != "lib/consts.s" || asmErr.Line != 2 {
+		t.Fatalf("Expected an error at lib/consts.s:2, got %v", err)
+	}
+
+	fsys["lib/consts.s"] = &fstest.MapFile{Data: []byte("VALUE = 7")}
+	img, err := a.AssembleFile("main.s")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	exp := []Segment{{0x0200, []uint8{0xA9, 0x07, 0x60, 0x20, 0x00, 0x02}}}
+	if !reflect.DeepEqual(img.Segments, exp) {
+		t.Errorf("Expected %+v, got %+v\n", exp, img.Segments)
+	}
+	if img.Symbols["print"] != 0x0200 || img.Symbols["VALUE"] != 7 {
+		t.Errorf("Unexpected symbols %+v", img.Symbols)
+	}
+	expLines := map[uint16]SourceLine{0x0200: {"lib/io.s", 2}, 0x0202: {"lib/io.s", 3}, 0x0203: {"main.s", 3}}
+	if !reflect.DeepEqual(img.Lines, expLines) {
+		t.Errorf("Expected %+v, got %+v\n", expLines, img.Lines)
+	}
+}
+
+func TestAssembleRun(t *testing.T) {
+	img, err := Assemble(`
+		.org $0200
+		; sums 1 to 10 into $10
+		        lda #0
+		        ldx #10
+		@loop:  stx tmp
+		        clc
+		        adc tmp
+		        dex
+		        bne @loop
+		        sta result
+		done:   jmp done
+		tmp = $20
+		result = $10
+	`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var mem Memory
+	img.Load(&mem)
+	cpu := Cpu{mem: &mem, pc: 0x0200}
+	if _, err := cpu.RunUntil(func(cpu *Cpu) bool { return cpu.pc == img.Symbols["done"] }); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if act := mem.Read(0x10); act != 55 {
+		t.Errorf("Expected %+v, got %+v\n", 55, act)
+	}
+}
+
+func TestAssembleDisassemble(t *testing.T) {
+	// every documented opcode reads back the same as it was written
+	for _, variant := range []Variant{NMOS6502, WDC65C02} {
+		var mem Memory
+		d := NewDisassembler(&mem, variant)
+		a := NewAssembler(variant)
+		for i, op := range Opcodes(variant) {
+			if op.Status != Official {
+				continue
+			}
+			mem.Write(0x1000, uint8(i))
+			mem.Write(0x1001, 0x12)
+			mem.Write(0x1002, 0x34)
+			inst := d.Disassemble(0x1000)
+
+			src := ".org $1000\n" + inst.Opcode.Mnemonic + " " + inst.Operand
+			img, err := a.Assemble("", src)
+			if err != nil {
+				t.Errorf("Variant %d: %q: %v", variant, src, err)
+				continue
+			}
+			if act := img.Segments[0].Data; !reflect.DeepEqual(act, inst.Bytes) {
+				t.Errorf("Variant %d: %q: expected % X, got % X", variant, src, inst.Bytes, act)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+// Dap is a Debug Adapter Protocol server for 6502 programs, for editors to
+// debug them with. It speaks on its standard input and output, as editors
+// start adapters, or on a TCP address:
+//
+//	dap [-listen addr]
+//
+// See mos6502.ServeDAP for the launch arguments.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	mos6502 "github.com/jmle/6502"
+)
+
+func main() {
+	listen := flag.String("listen", "", "TCP address to listen on, like localhost:4711, rather than the standard input and output")
+	flag.Parse()
+
+	var err error
+	if *listen != "" {
+		err = mos6502.ListenAndServeDAP(*listen)
+	} else {
+		err = mos6502.ServeDAP(os.Stdin, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dap:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,68 @@
+// Monitor is a machine language monitor for the 6502. It loads a raw image
+// into a flat 64K memory and reads commands from the standard input:
+//
+//	monitor [-variant nmos|6507|2a03|65c02] [-addr hex] [-pc hex] [image]
+//
+// The image is loaded at -addr, $0000 by default. The processor starts at
+// -pc, or at its reset vector when there is none. Type ? for the commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	mos6502 "github.com/jmle/6502"
+)
+
+var variants = map[string]mos6502.Variant{
+	"nmos":  mos6502.NMOS6502,
+	"6507":  mos6502.MOS6507,
+	"2a03":  mos6502.RICOH2A03,
+	"65c02": mos6502.WDC65C02,
+}
+
+func main() {
+	variantName := flag.String("variant", "nmos", "processor variant: nmos, 6507, 2a03 or 65c02")
+	addr := flag.String("addr", "0", "address to load the image at, in hex")
+	pc := flag.String("pc", "", "address to start at, in hex. The reset vector when empty")
+	flag.Parse()
+
+	variant, ok := variants[strings.ToLower(*variantName)]
+	if !ok {
+		fail(fmt.Errorf("unknown variant %s", *variantName))
+	}
+	m := newMonitor(variant, os.Stdout)
+
+	if flag.NArg() > 0 {
+		if err := m.load([]string{flag.Arg(0), *addr}); err != nil {
+			fail(err)
+		}
+	}
+	m.cpu.Reset()
+	if *pc != "" {
+		start, err := parseAddr(*pc)
+		if err != nil {
+			fail(err)
+		}
+		m.cpu.SetPC(start)
+	}
+
+	// Ctrl-C stops a running program rather than the monitor
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+			m.stop.Store(true)
+		}
+	}()
+
+	m.run(os.Stdin)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "monitor:", err)
+	os.Exit(1)
+}
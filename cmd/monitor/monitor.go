@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	mos6502 "github.com/jmle/6502"
+)
+
+// the state of the monitor
+type monitor struct {
+	cpu *mos6502.Cpu
+	// the memory as the processor sees it, through its address bus
+	mem         mos6502.Mem
+	dis         *mos6502.Disassembler
+	asm         *mos6502.Assembler
+	out         io.Writer
+	breakpoints map[uint16]bool
+	// set to stop a running program
+	stop atomic.Bool
+	// where m and d go on from when given no address
+	dumpAddr, disAddr uint16
+	quit              bool
+}
+
+func newMonitor(variant mos6502.Variant, out io.Writer) *monitor {
+	cpu := mos6502.NewCpuVariant(&mos6502.RAM{}, variant)
+	return &monitor{
+		cpu:         cpu,
+		mem:         cpu.Mem(),
+		dis:         mos6502.NewDisassembler(cpu.Mem(), variant),
+		asm:         mos6502.NewAssembler(variant),
+		out:         out,
+		breakpoints: map[uint16]bool{},
+	}
+}
+
+type command struct {
+	names []string
+	args  string
+	help  string
+	run   func(m *monitor, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{[]string{"r", "regs"}, "[reg=value...]", "show the registers, or set pc, a, x, y, sp or p", (*monitor).regs},
+		{[]string{"s", "step"}, "[count]", "run count instructions, 1 by default", (*monitor).step},
+		{[]string{"g", "go"}, "[addr]", "run from addr, or the pc, up to a breakpoint or Ctrl-C", (*monitor).goTo},
+		{[]string{"b", "break"}, "[addr]", "set a breakpoint, or list them", (*monitor).setBreak},
+		{[]string{"bd", "delete"}, "addr", "delete a breakpoint", (*monitor).deleteBreak},
+		{[]string{"m", "mem"}, "[start [end]]", "dump memory", (*monitor).dump},
+		{[]string{"f", "fill"}, "start end byte...", "fill memory with a pattern of bytes", (*monitor).fill},
+		{[]string{"d", "dis"}, "[start [end]]", "disassemble", (*monitor).disassemble},
+		{[]string{"a", "asm"}, "addr instruction", "assemble an instruction", (*monitor).assemble},
+		{[]string{"l", "load"}, "file [addr]", "load a raw image, at $0000 by default", (*monitor).load},
+		{[]string{"sv", "save"}, "file start end", "save memory to a raw image", (*monitor).save},
+		{[]string{"reset"}, "", "reset the processor", (*monitor).reset},
+		{[]string{"?", "help"}, "", "list the commands", (*monitor).help},
+		{[]string{"q", "quit"}, "", "leave", (*monitor).exit},
+	}
+}
+
+// reads and runs commands until the input ends or q
+func (m *monitor) run(in io.Reader) {
+	lines := bufio.NewScanner(in)
+	m.regs(nil)
+	for !m.quit {
+		fmt.Fprint(m.out, "> ")
+		if !lines.Scan() {
+			fmt.Fprintln(m.out)
+			return
+		}
+		if err := m.exec(lines.Text()); err != nil {
+			fmt.Fprintln(m.out, "?", err)
+		}
+	}
+}
+
+// runs a command line
+func (m *monitor) exec(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	name := strings.ToLower(fields[0])
+	for _, cmd := range commands {
+		for _, n := range cmd.names {
+			if n == name {
+				return cmd.run(m, fields[1:])
+			}
+		}
+	}
+	return fmt.Errorf("unknown command %s, ? lists them", fields[0])
+}
+
+// parses an address or a value, in hex with an optional $
+func parseHex(s string, bits int) (uint64, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "$"), 16, bits)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %s", s)
+	}
+	return v, nil
+}
+
+func parseAddr(s string) (uint16, error) {
+	v, err := parseHex(s, 16)
+	return uint16(v), err
+}
+
+// parses an optional range: start defaults to from, and end to count
+// bytes past start
+func parseRange(args []string, from uint16, count int) (start, end uint16, err error) {
+	start = from
+	if len(args) > 0 {
+		if start, err = parseAddr(args[0]); err != nil {
+			return
+		}
+	}
+	end = start + uint16(count-1)
+	if end < start {
+		end = 0xFFFF
+	}
+	if len(args) > 1 {
+		if end, err = parseAddr(args[1]); err != nil {
+			return
+		}
+	}
+	if end < start {
+		err = errors.New("the range ends before it starts")
+	}
+	return
+}
+
+func (m *monitor) regs(args []string) error {
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("expected reg=value, got %s", arg)
+		}
+		bits := 8
+		if strings.EqualFold(name, "pc") {
+			bits = 16
+		}
+		v, err := parseHex(value, bits)
+		if err != nil {
+			return err
+		}
+
+		switch strings.ToLower(name) {
+		case "pc":
+			m.cpu.SetPC(uint16(v))
+		case "a":
+			m.cpu.SetAC(uint8(v))
+		case "x":
+			m.cpu.SetX(uint8(v))
+		case "y":
+			m.cpu.SetY(uint8(v))
+		case "sp":
+			m.cpu.SetSP(uint8(v))
+		case "p":
+			m.cpu.Status().SetAsWord(uint8(v))
+		default:
+			return fmt.Errorf("unknown register %s", name)
+		}
+	}
+
+	p := m.cpu.Status().AsWord()
+	var flags []byte
+	for i, f := range "NV-BDIZC" {
+		if p&(0x80>>i) != 0 {
+			flags = append(flags, byte(f))
+		} else {
+			flags = append(flags, '.')
+		}
+	}
+	fmt.Fprintf(m.out, "PC=%04X A=%02X X=%02X Y=%02X SP=%02X P=%02X %s\n",
+		m.cpu.PC(), m.cpu.AC(), m.cpu.X(), m.cpu.Y(), m.cpu.SP(), p, flags)
+	fmt.Fprintln(m.out, m.dis.Disassemble(m.cpu.PC()))
+	m.disAddr = m.cpu.PC()
+	return nil
+}
+
+func (m *monitor) step(args []string) error {
+	count := 1
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad count %s", args[0])
+		}
+		count = n
+	}
+
+	for i := 0; i < count; i++ {
+		if _, err := m.cpu.Step(); err != nil {
+			m.regs(nil)
+			return err
+		}
+	}
+	return m.regs(nil)
+}
+
+func (m *monitor) goTo(args []string) error {
+	if len(args) > 0 {
+		addr, err := parseAddr(args[0])
+		if err != nil {
+			return err
+		}
+		m.cpu.SetPC(addr)
+	}
+
+	// the first instruction runs even if it's on a breakpoint, so that go
+	// carries on from one
+	m.stop.Store(false)
+	first := true
+	_, err := m.cpu.RunUntil(func(cpu *mos6502.Cpu) bool {
+		if first {
+			first = false
+			return false
+		}
+		return m.stop.Load() || m.breakpoints[cpu.PC()]
+	})
+
+	switch {
+	case err != nil:
+	case m.stop.Load():
+		fmt.Fprintln(m.out, "stopped")
+	default:
+		fmt.Fprintf(m.out, "breakpoint at %04X\n", m.cpu.PC())
+	}
+	m.regs(nil)
+	return err
+}
+
+func (m *monitor) setBreak(args []string) error {
+	if len(args) == 0 {
+		var addrs []int
+		for addr := range m.breakpoints {
+			addrs = append(addrs, int(addr))
+		}
+		sort.Ints(addrs)
+		for _, addr := range addrs {
+			fmt.Fprintln(m.out, m.dis.Disassemble(uint16(addr)))
+		}
+		return nil
+	}
+
+	addr, err := parseAddr(args[0])
+	if err != nil {
+		return err
+	}
+	m.breakpoints[addr] = true
+	return nil
+}
+
+func (m *monitor) deleteBreak(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: bd addr")
+	}
+	addr, err := parseAddr(args[0])
+	if err != nil {
+		return err
+	}
+	if !m.breakpoints[addr] {
+		return fmt.Errorf("no breakpoint at %04X", addr)
+	}
+	delete(m.breakpoints, addr)
+	return nil
+}
+
+func (m *monitor) dump(args []string) error {
+	start, end, err := parseRange(args, m.dumpAddr, 128)
+	if err != nil {
+		return err
+	}
+
+	for line := int(start) &^ 0xF; line <= int(end); line += 16 {
+		hex, text := "", ""
+		for addr := line; addr < line+16; addr++ {
+			if addr < int(start) || addr > int(end) {
+				hex += "   "
+				text += " "
+				continue
+			}
+			b := m.mem.Read(uint16(addr))
+			hex += fmt.Sprintf(" %02X", b)
+			if b >= 0x20 && b < 0x7F {
+				text += string(rune(b))
+			} else {
+				text += "."
+			}
+		}
+		fmt.Fprintf(m.out, "%04X %s  |%s|\n", line, hex, text)
+	}
+	m.dumpAddr = end + 1
+	return nil
+}
+
+func (m *monitor) fill(args []string) error {
+	if len(args) < 3 {
+		return errors.New("usage: f start end byte...")
+	}
+	start, end, err := parseRange(args[:2], 0, 1)
+	if err != nil {
+		return err
+	}
+	var pattern []uint8
+	for _, arg := range args[2:] {
+		v, err := parseHex(arg, 8)
+		if err != nil {
+			return err
+		}
+		pattern = append(pattern, uint8(v))
+	}
+
+	for addr := int(start); addr <= int(end); addr++ {
+		m.mem.Write(uint16(addr), pattern[(addr-int(start))%len(pattern)])
+	}
+	return nil
+}
+
+func (m *monitor) disassemble(args []string) error {
+	start := m.disAddr
+	if len(args) > 0 {
+		var err error
+		if start, err = parseAddr(args[0]); err != nil {
+			return err
+		}
+	}
+
+	addr := int(start)
+	if len(args) > 1 {
+		_, end, err := parseRange(args, start, 1)
+		if err != nil {
+			return err
+		}
+		for _, inst := range m.dis.DisassembleRange(start, end+1) {
+			fmt.Fprintln(m.out, inst)
+			addr = int(inst.Addr) + inst.Opcode.Bytes
+		}
+	} else {
+		for i := 0; i < 16; i++ {
+			inst := m.dis.Disassemble(uint16(addr))
+			fmt.Fprintln(m.out, inst)
+			addr += inst.Opcode.Bytes
+		}
+	}
+	m.disAddr = uint16(addr)
+	return nil
+}
+
+func (m *monitor) assemble(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: a addr instruction")
+	}
+	addr, err := parseAddr(args[0])
+	if err != nil {
+		return err
+	}
+
+	img, err := m.asm.Assemble("", fmt.Sprintf(".org $%04X\n %s", addr, strings.Join(args[1:], " ")))
+	if err != nil {
+		// there's a single line to point at
+		var asmErr *mos6502.AsmError
+		if errors.As(err, &asmErr) {
+			return errors.New(asmErr.Msg)
+		}
+		return err
+	}
+	img.Load(m.mem)
+
+	inst := m.dis.Disassemble(addr)
+	fmt.Fprintln(m.out, inst)
+	m.disAddr = addr + uint16(inst.Opcode.Bytes)
+	return nil
+}
+
+func (m *monitor) load(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: l file [addr]")
+	}
+	var addr uint16
+	if len(args) > 1 {
+		var err error
+		if addr, err = parseAddr(args[1]); err != nil {
+			return err
+		}
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	if int(addr)+len(data) > 1<<16 {
+		return fmt.Errorf("%s is %d bytes, too large to load at %04X", args[0], len(data), addr)
+	}
+	for i, b := range data {
+		m.mem.Write(addr+uint16(i), b)
+	}
+	fmt.Fprintf(m.out, "loaded %04X-%04X\n", addr, int(addr)+len(data)-1)
+	return nil
+}
+
+func (m *monitor) save(args []string) error {
+	if len(args) != 3 {
+		return errors.New("usage: sv file start end")
+	}
+	start, end, err := parseRange(args[1:], 0, 1)
+	if err != nil {
+		return err
+	}
+	var data []uint8
+	for addr := int(start); addr <= int(end); addr++ {
+		data = append(data, m.mem.Read(uint16(addr)))
+	}
+	return os.WriteFile(args[0], data, 0o644)
+}
+
+func (m *monitor) reset(args []string) error {
+	m.cpu.Reset()
+	return m.regs(nil)
+}
+
+func (m *monitor) help(args []string) error {
+	for _, cmd := range commands {
+		usage := strings.TrimSpace(strings.Join(cmd.names, ", ") + " " + cmd.args)
+		fmt.Fprintf(m.out, "%-28s %s\n", usage, cmd.help)
+	}
+	fmt.Fprintln(m.out, "Addresses and values are in hex, counts in decimal.")
+	return nil
+}
+
+func (m *monitor) exit(args []string) error {
+	m.quit = true
+	return nil
+}
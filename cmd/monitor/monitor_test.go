@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mos6502 "github.com/jmle/6502"
+)
+
+func TestMonitor(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cmds []string
+		// Expected, in the output of the last command
+		exp string
+	}{
+		{name: "Registers",
+			cmds: []string{"r pc=0200 a=12 x=34 y=56 sp=fd p=e3"},
+			exp:  "PC=0200 A=12 X=34 Y=56 SP=FD P=E3 NV-...ZC\n0200  00        BRK\n",
+		},
+		{name: "Assemble and disassemble",
+			cmds: []string{"a 0200 lda #$10", "a 0202 sta $1234,x", "d 0200 0202"},
+			exp:  "0200  A9 10     LDA #$10\n0202  9D 34 12  STA $1234,X\n",
+		},
+		{name: "Step",
+			cmds: []string{"a 0200 ldx #5", "a 0202 dex", "r pc=0200", "s 2"},
+			exp:  "PC=0203 A=00 X=04 Y=00 SP=00 P=20 ..-.....\n0203  00        BRK\n",
+		},
+		{name: "Breakpoint",
+			cmds: []string{"a 0200 inx", "a 0201 jmp $0200", "b 0201", "g 0200", "g"},
+			exp:  "breakpoint at 0201\nPC=0201 A=00 X=02 Y=00 SP=00 P=20 ..-.....\n0201  4C 00 02  JMP $0200\n",
+		},
+		{name: "Fill and dump",
+			cmds: []string{"f 0203 0206 41 42", "m 0200 0207"},
+			exp:  "0200  00 00 00 41 42 41 42 00                          |...ABAB.        |\n",
+		},
+		{name: "Errors",
+			cmds: []string{"a 0200 lda #$100"},
+			exp:  "? value out of range: $100 = 256\n",
+		},
+		{name: "Bad expression",
+			cmds: []string{"a 0200 lda #1<<-1"},
+			exp:  "? shift count out of range: -1\n",
+		},
+	} {
+		t.Log(tt.name)
+		var out strings.Builder
+		m := newMonitor(mos6502.NMOS6502, &out)
+		for _, cmd := range tt.cmds[:len(tt.cmds)-1] {
+			if err := m.exec(cmd); err != nil {
+				t.Fatalf("%s: %v", cmd, err)
+			}
+		}
+		out.Reset()
+
+		m.run(strings.NewReader(tt.cmds[len(tt.cmds)-1] + "\nq\n"))
+		if !strings.Contains(out.String(), tt.exp) {
+			t.Errorf("Expected %q in %q\n", tt.exp, out.String())
+		}
+	}
+}
+
+func TestMonitorLoadSave(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in.bin"), filepath.Join(dir, "out.bin")
+	if err := os.WriteFile(in, []uint8{1, 2, 3, 4}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMonitor(mos6502.NMOS6502, &strings.Builder{})
+	for _, cmd := range []string{"l " + in + " FFFC", "sv " + out + " FFFD FFFE"} {
+		if err := m.exec(cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "\x02\x03" {
+		t.Errorf("Expected %q, got %q\n", "\x02\x03", data)
+	}
+	if err := m.exec("l " + in + " FFFD"); err == nil {
+		t.Errorf("Loaded past $FFFF")
+	}
+}
+
+func TestMonitor6507(t *testing.T) {
+	// a 4K cartridge, seen at $F000 through the 13 address lines of the 6507
+	cart := make([]uint8, 0x1000)
+	copy(cart, []uint8{0xA9, 0x42})
+	cart[0xFFC], cart[0xFFD] = 0x00, 0xF0
+	file := filepath.Join(t.TempDir(), "cart.bin")
+	if err := os.WriteFile(file, cart, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	m := newMonitor(mos6502.MOS6507, &out)
+	if err := m.exec("l " + file + " F000"); err != nil {
+		t.Fatal(err)
+	}
+	m.cpu.Reset()
+	if pc := m.cpu.PC(); pc != 0xF000 {
+		t.Errorf("Expected %+v, got %+v\n", 0xF000, pc)
+	}
+
+	out.Reset()
+	for _, cmd := range []string{"d F000 F000", "m 1000 1001"} {
+		if err := m.exec(cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	if exp := "F000  A9 42     LDA #$42\n1000  A9 42"; !strings.HasPrefix(out.String(), exp) {
+		t.Errorf("Expected %q, got %q\n", exp, out.String())
+	}
+}
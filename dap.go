@@ -0,0 +1,640 @@
+package mos6502
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ServeDAP runs a session of the Debug Adapter Protocol, which editors
+// debug programs with, on a reader and a writer: the standard input and
+// output when the editor starts the adapter. The launch request assembles
+// a source file into a flat 64K memory, and runs it on a processor:
+//
+//	{
+//		"type": "6502",
+//		"request": "launch",
+//		"program": "${workspaceFolder}/main.s",
+//		"variant": "65c02",
+//		"start": "main",
+//		"stopOnEntry": true
+//	}
+//
+// The variant is nmos, 6507, 2a03 or 65c02, nmos by default. The program
+// starts at start, a label or a $hex address, or else at its reset vector
+// if it sets one, or else at its first byte.
+//
+// Breakpoints are set on source lines, through the line map of the
+// assembler. The call stack is made of the return addresses of the JSRs
+// found on page one, and the variables are the registers, the flags and
+// the zero page. Step over runs JSRs to their return, and step out runs up
+// to the RTS or RTI of the current subroutine.
+func ServeDAP(r io.Reader, w io.Writer) error {
+	s := &dapSession{w: w, sources: map[string][]int{}}
+	return s.serve(bufio.NewReader(r))
+}
+
+// ListenAndServeDAP listens on a TCP address, like "localhost:4711", and
+// runs a DAP session on each connection it gets, one at a time
+func ListenAndServeDAP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		ServeDAP(conn, conn)
+		conn.Close()
+	}
+}
+
+// the messages of the protocol
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapBreakpoint struct {
+	ID       int        `json:"id,omitempty"`
+	Verified bool       `json:"verified"`
+	Line     int        `json:"line,omitempty"`
+	Source   *dapSource `json:"source,omitempty"`
+	Message  string     `json:"message,omitempty"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// the only thread
+const dapThread = 1
+
+// the variables references of the scopes
+const (
+	dapRegisters = iota + 1
+	dapFlags
+	dapZeroPage
+)
+
+// the state of a session
+type dapSession struct {
+	// held by the program while it runs an instruction, and by the
+	// requests that look at its state
+	mu  sync.Mutex
+	cpu *Cpu
+	d   *Debugger
+	img *Image
+	// where the source files are
+	dir string
+	// the source lines of code, by file, sorted
+	codeLines map[string][]int
+	addrs     map[SourceLine]uint16
+	// the breakpoint lines asked for, and the debugger breakpoints they
+	// got, by source path
+	sources     map[string][]int
+	breakpoints map[string][]int
+	stopOnEntry bool
+
+	// set while the program runs, under mu
+	busy    bool
+	pause   atomic.Bool
+	running sync.WaitGroup
+
+	// guards the writer and the sequence numbers
+	wmu sync.Mutex
+	w   io.Writer
+	seq int
+
+	// run after the response to the current request is sent
+	after func()
+}
+
+func (s *dapSession) serve(r *bufio.Reader) error {
+	headers := textproto.NewReader(r)
+	for {
+		header, err := headers.ReadMIMEHeader()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			return fmt.Errorf("bad Content-Length %q", header.Get("Content-Length"))
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+
+		var req dapRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			return err
+		}
+
+		s.after = nil
+		body, err := s.handle(&req)
+		resp := dapResponse{Type: "response", RequestSeq: req.Seq, Success: err == nil, Command: req.Command, Body: body}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		if err := s.send(&resp); err != nil {
+			return err
+		}
+		if s.after != nil {
+			s.after()
+		}
+		if req.Command == "disconnect" {
+			return nil
+		}
+	}
+}
+
+// writes a message, numbering it
+func (s *dapSession) send(msg any) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.seq++
+	switch m := msg.(type) {
+	case *dapResponse:
+		m.Seq = s.seq
+	case *dapEvent:
+		m.Seq = s.seq
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+func (s *dapSession) event(name string, body any) {
+	s.send(&dapEvent{Type: "event", Event: name, Body: body})
+}
+
+func (s *dapSession) handle(req *dapRequest) (any, error) {
+	// the program can be paused, and its threads listed, while it runs
+	switch req.Command {
+	case "pause":
+		s.pause.Store(true)
+		return nil, nil
+	case "threads":
+		return map[string]any{"threads": []map[string]any{{"id": dapThread, "name": "6502"}}}, nil
+	case "disconnect":
+		s.pause.Store(true)
+		s.running.Wait()
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cpu == nil {
+		switch req.Command {
+		case "initialize":
+			return map[string]any{
+				"supportsConfigurationDoneRequest": true,
+			}, nil
+		case "launch":
+			return nil, s.launch(req.Arguments)
+		case "setBreakpoints":
+		default:
+			return nil, errors.New("no program launched")
+		}
+	}
+
+	switch req.Command {
+	case "setBreakpoints":
+		return s.setBreakpoints(req.Arguments)
+	case "configurationDone":
+		if s.stopOnEntry {
+			s.after = func() { s.stopped("entry", nil) }
+			return nil, nil
+		}
+		return nil, s.resume("breakpoint", func(*Cpu) bool { return false })
+	case "stackTrace":
+		return s.stackTrace(), nil
+	case "scopes":
+		return map[string]any{"scopes": []map[string]any{
+			{"name": "Registers", "variablesReference": dapRegisters, "expensive": false},
+			{"name": "Flags", "variablesReference": dapFlags, "expensive": false},
+			{"name": "Zero page", "variablesReference": dapZeroPage, "expensive": false},
+		}}, nil
+	case "variables":
+		return s.variables(req.Arguments)
+	case "continue":
+		if err := s.resume("breakpoint", func(*Cpu) bool { return false }); err != nil {
+			return nil, err
+		}
+		return map[string]any{"allThreadsContinued": true}, nil
+	case "next":
+		return nil, s.resume("step", s.stepOver())
+	case "stepIn":
+		return nil, s.resume("step", s.stepIn())
+	case "stepOut":
+		return nil, s.resume("step", s.stepOut())
+	}
+
+	return nil, fmt.Errorf("%s is not supported", req.Command)
+}
+
+var dapVariants = map[string]Variant{
+	"":      NMOS6502,
+	"nmos":  NMOS6502,
+	"6507":  MOS6507,
+	"2a03":  RICOH2A03,
+	"65c02": WDC65C02,
+}
+
+func (s *dapSession) launch(args json.RawMessage) error {
+	var launch struct {
+		Program     string `json:"program"`
+		Variant     string `json:"variant"`
+		Start       string `json:"start"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+	if err := json.Unmarshal(args, &launch); err != nil {
+		return err
+	}
+	variant, ok := dapVariants[strings.ToLower(launch.Variant)]
+	if !ok {
+		return fmt.Errorf("unknown variant %s", launch.Variant)
+	}
+
+	program, err := filepath.Abs(launch.Program)
+	if err != nil {
+		return err
+	}
+	s.dir = filepath.Dir(program)
+	a := NewAssembler(variant)
+	a.FS = os.DirFS(s.dir)
+	img, err := a.AssembleFile(filepath.Base(program))
+	if err != nil {
+		return err
+	}
+	s.img = img
+
+	mem := &RAM{}
+	img.Load(mem)
+	s.cpu = NewCpuVariant(mem, variant)
+	s.d = NewDebugger(s.cpu)
+	s.breakpoints = map[string][]int{}
+	s.stopOnEntry = launch.StopOnEntry
+
+	s.cpu.Reset()
+	switch {
+	case launch.Start != "":
+		start, ok := img.Symbols[launch.Start]
+		if !ok {
+			v, err := strconv.ParseUint(strings.TrimPrefix(launch.Start, "$"), 16, 16)
+			if err != nil {
+				return fmt.Errorf("no label %s", launch.Start)
+			}
+			start = uint16(v)
+		}
+		s.cpu.pc = start
+	case !img.covers(RESET_VECTOR) && len(img.Segments) > 0:
+		s.cpu.pc = img.Segments[0].Addr
+	}
+
+	// the lines of code of each file, and their first addresses
+	s.addrs = map[SourceLine]uint16{}
+	for addr, line := range img.Lines {
+		if prev, ok := s.addrs[line]; !ok || addr < prev {
+			s.addrs[line] = addr
+		}
+	}
+	s.codeLines = map[string][]int{}
+	for line := range s.addrs {
+		s.codeLines[line.File] = append(s.codeLines[line.File], line.Line)
+	}
+	for _, lines := range s.codeLines {
+		sort.Ints(lines)
+	}
+
+	// the breakpoints set before the launch
+	for path, lines := range s.sources {
+		s.resolve(path, lines)
+	}
+
+	s.after = func() { s.event("initialized", nil) }
+	return nil
+}
+
+// tells if the image has code or data at an address
+func (img *Image) covers(addr uint16) bool {
+	for _, seg := range img.Segments {
+		if addr >= seg.Addr && int(addr) < int(seg.Addr)+len(seg.Data) {
+			return true
+		}
+	}
+	return false
+}
+
+// the name of a source path for the assembler, and back
+func (s *dapSession) sourceFile(path string) string {
+	rel, err := filepath.Rel(s.dir, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (s *dapSession) sourcePath(file string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(file))
+}
+
+func (s *dapSession) setBreakpoints(args json.RawMessage) (any, error) {
+	var set struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(args, &set); err != nil {
+		return nil, err
+	}
+
+	var lines []int
+	for _, bp := range set.Breakpoints {
+		lines = append(lines, bp.Line)
+	}
+	s.sources[set.Source.Path] = lines
+
+	if s.cpu == nil {
+		bps := []dapBreakpoint{}
+		for _, line := range lines {
+			bps = append(bps, dapBreakpoint{Line: line, Message: "not launched yet"})
+		}
+		return map[string]any{"breakpoints": bps}, nil
+	}
+	return map[string]any{"breakpoints": s.resolve(set.Source.Path, lines)}, nil
+}
+
+// sets the breakpoints of a source file, on its lines of code. A line
+// without code gets the next line with some
+func (s *dapSession) resolve(path string, lines []int) []dapBreakpoint {
+	for _, id := range s.breakpoints[path] {
+		s.d.Delete(id)
+	}
+	s.breakpoints[path] = nil
+
+	file := s.sourceFile(path)
+	code := s.codeLines[file]
+	bps := []dapBreakpoint{}
+	for _, line := range lines {
+		i := sort.SearchInts(code, line)
+		if i == len(code) {
+			bps = append(bps, dapBreakpoint{Line: line, Message: "no code at or after this line"})
+			continue
+		}
+
+		addr := s.addrs[SourceLine{file, code[i]}]
+		bp, _ := s.d.Add(Breakpoint{Kind: BreakPC, Start: addr})
+		s.breakpoints[path] = append(s.breakpoints[path], bp.ID)
+		bps = append(bps, dapBreakpoint{ID: bp.ID, Verified: true, Line: code[i], Source: &dapSource{Name: filepath.Base(path), Path: path}})
+	}
+	return bps
+}
+
+// runs the program once the response is sent, unless it runs already.
+// Called with mu held
+func (s *dapSession) resume(reason string, until func(cpu *Cpu) bool) error {
+	if s.busy {
+		return errors.New("the program is running")
+	}
+	s.busy = true
+	s.after = func() { s.run(reason, until) }
+	return nil
+}
+
+// runs the program until until tells to stop, a breakpoint, a pause or an
+// error, and reports the stop. The requests get mu between instructions,
+// where the debugger looks at nothing
+func (s *dapSession) run(reason string, until func(cpu *Cpu) bool) {
+	s.pause.Store(false)
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+
+		s.mu.Lock()
+		_, err := s.d.RunUntil(func(cpu *Cpu) bool {
+			s.mu.Unlock()
+			s.mu.Lock()
+			return s.pause.Load() || until(cpu)
+		})
+		s.busy = false
+		s.mu.Unlock()
+
+		if err == nil && s.pause.Load() {
+			reason = "pause"
+		}
+		s.stopped(reason, err)
+	}()
+}
+
+// the stopped event
+func (s *dapSession) stopped(reason string, err error) {
+	body := map[string]any{"threadId": dapThread, "allThreadsStopped": true}
+
+	var stop *BreakError
+	switch {
+	case errors.As(err, &stop):
+		reason = "breakpoint"
+		if stop.Breakpoint.Kind == BreakPC {
+			body["hitBreakpointIds"] = []int{stop.Breakpoint.ID}
+		} else {
+			reason = "data breakpoint"
+		}
+		body["description"] = stop.Error()
+	case err != nil:
+		reason = "exception"
+		body["description"] = err.Error()
+		body["text"] = err.Error()
+	}
+	body["reason"] = reason
+
+	s.event("stopped", body)
+}
+
+// runs a single instruction
+func (s *dapSession) stepIn() func(cpu *Cpu) bool {
+	ran := false
+	return func(*Cpu) bool {
+		done := ran
+		ran = true
+		return done
+	}
+}
+
+// runs a single instruction, or a subroutine call up to its return
+func (s *dapSession) stepOver() func(cpu *Cpu) bool {
+	if s.cpu.Mem().Read(s.cpu.pc) != 0x20 {
+		return s.stepIn()
+	}
+	ret, sp := s.cpu.pc+3, s.cpu.sp
+	return func(cpu *Cpu) bool {
+		return cpu.pc == ret && cpu.sp >= sp
+	}
+}
+
+// runs up to the return of the current subroutine: its RTS, or the RTI
+// of an interrupt handler, with the stack as it was on entry
+func (s *dapSession) stepOut() func(cpu *Cpu) bool {
+	sp := s.cpu.sp
+	returned := false
+	return func(cpu *Cpu) bool {
+		if returned {
+			return true
+		}
+		if op := cpu.Mem().Read(cpu.pc); (op == 0x60 || op == 0x40) && cpu.sp >= sp {
+			returned = true
+		}
+		return false
+	}
+}
+
+// the addresses of the frames of the call stack, from the innermost: the
+// PC, then the JSRs whose return addresses are on the stack
+func (s *dapSession) frames() []uint16 {
+	mem := s.cpu.Mem()
+	frames := []uint16{s.cpu.pc}
+	for sp := uint16(s.cpu.sp) + 1; sp < 0xFF; {
+		ret := word(mem.Read(0x100+sp), mem.Read(0x100+sp+1))
+		// JSR pushes the address of its last byte
+		if jsr := ret - 2; mem.Read(jsr) == 0x20 {
+			frames = append(frames, jsr)
+			sp += 2
+		} else {
+			sp++
+		}
+	}
+	return frames
+}
+
+// names an address by the closest label of an instruction at or before
+// it, constants being no names for code
+func (s *dapSession) name(addr uint16) string {
+	best, bestAddr := "", -1
+	for label, value := range s.img.Symbols {
+		if _, code := s.img.Lines[value]; !code || value > addr {
+			continue
+		}
+		if int(value) > bestAddr || int(value) == bestAddr && label < best {
+			best, bestAddr = label, int(value)
+		}
+	}
+	switch {
+	case best == "":
+		return fmt.Sprintf("$%04X", addr)
+	case bestAddr == int(addr):
+		return best
+	}
+	return fmt.Sprintf("%s+%d", best, int(addr)-bestAddr)
+}
+
+func (s *dapSession) stackTrace() any {
+	var frames []map[string]any
+	for i, addr := range s.frames() {
+		frame := map[string]any{
+			"id":                          i,
+			"name":                        s.name(addr),
+			"line":                        0,
+			"column":                      0,
+			"instructionPointerReference": fmt.Sprintf("0x%04X", addr),
+		}
+		if line, ok := s.img.Lines[addr]; ok {
+			path := s.sourcePath(line.File)
+			frame["source"] = dapSource{Name: filepath.Base(path), Path: path}
+			frame["line"] = line.Line
+			frame["column"] = 1
+		}
+		frames = append(frames, frame)
+	}
+	return map[string]any{"stackFrames": frames, "totalFrames": len(frames)}
+}
+
+func (s *dapSession) variables(args json.RawMessage) (any, error) {
+	var vars struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(args, &vars); err != nil {
+		return nil, err
+	}
+
+	cpu := s.cpu
+	list := []dapVariable{}
+	switch vars.VariablesReference {
+	case dapRegisters:
+		list = []dapVariable{
+			{Name: "PC", Value: fmt.Sprintf("$%04X", cpu.pc)},
+			{Name: "A", Value: fmt.Sprintf("$%02X", cpu.ac)},
+			{Name: "X", Value: fmt.Sprintf("$%02X", cpu.x)},
+			{Name: "Y", Value: fmt.Sprintf("$%02X", cpu.y)},
+			{Name: "SP", Value: fmt.Sprintf("$%02X", cpu.sp)},
+			{Name: "P", Value: fmt.Sprintf("$%02X", cpu.p.getAsWord())},
+		}
+	case dapFlags:
+		for _, f := range []struct {
+			name string
+			v    int
+		}{{"N", cpu.p.n}, {"V", cpu.p.v}, {"D", cpu.p.d}, {"I", cpu.p.i}, {"Z", cpu.p.z}, {"C", cpu.p.c}} {
+			list = append(list, dapVariable{Name: f.name, Value: strconv.Itoa(f.v)})
+		}
+	case dapZeroPage:
+		for row := uint16(0); row < 0x100; row += 16 {
+			var hex []string
+			for addr := row; addr < row+16; addr++ {
+				hex = append(hex, fmt.Sprintf("%02X", cpu.Mem().Read(addr)))
+			}
+			list = append(list, dapVariable{Name: fmt.Sprintf("$%02X", row), Value: strings.Join(hex, " ")})
+		}
+	default:
+		return nil, fmt.Errorf("no variables %d", vars.VariablesReference)
+	}
+	return map[string]any{"variables": list}, nil
+}
@@ -0,0 +1,257 @@
+package mos6502
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// an editor of sorts
+type dapClient struct {
+	t    *testing.T
+	w    io.Writer
+	seq  int
+	msgs chan map[string]any
+	// the events read while waiting for responses
+	events []map[string]any
+}
+
+func newDAPClient(t *testing.T) *dapClient {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	t.Cleanup(func() { clientOut.Close(); clientIn.Close() })
+	go func() {
+		ServeDAP(serverIn, serverOut)
+		serverOut.Close()
+	}()
+
+	c := &dapClient{t: t, w: clientOut, msgs: make(chan map[string]any, 64)}
+	go func() {
+		r := bufio.NewReader(clientIn)
+		headers := textproto.NewReader(r)
+		defer close(c.msgs)
+		for {
+			header, err := headers.ReadMIMEHeader()
+			if err != nil {
+				return
+			}
+			length, _ := strconv.Atoi(header.Get("Content-Length"))
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			var msg map[string]any
+			json.Unmarshal(data, &msg)
+			c.msgs <- msg
+		}
+	}()
+	return c
+}
+
+func (c *dapClient) next() map[string]any {
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatal("Connection closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("No message")
+	}
+	return nil
+}
+
+// sends a request and returns the body of its response
+func (c *dapClient) request(command string, args any) map[string]any {
+	c.seq++
+	data, _ := json.Marshal(map[string]any{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+
+	for {
+		msg := c.next()
+		if msg["type"] == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg["request_seq"] != float64(c.seq) || msg["success"] != true {
+			c.t.Fatalf("%s: unexpected response %v", command, msg)
+		}
+		body, _ := msg["body"].(map[string]any)
+		return body
+	}
+}
+
+// returns the body of the next event, which must be the one given
+func (c *dapClient) event(name string) map[string]any {
+	var msg map[string]any
+	if len(c.events) > 0 {
+		msg, c.events = c.events[0], c.events[1:]
+	} else {
+		msg = c.next()
+	}
+	if msg["type"] != "event" || msg["event"] != name {
+		c.t.Fatalf("Expected a %s event, got %v", name, msg)
+	}
+	body, _ := msg["body"].(map[string]any)
+	return body
+}
+
+// the function and line of each frame of the call stack
+func (c *dapClient) stack() (frames []string) {
+	body := c.request("stackTrace", map[string]any{"threadId": 1})
+	for _, f := range body["stackFrames"].([]any) {
+		frame := f.(map[string]any)
+		source, _ := frame["source"].(map[string]any)
+		frames = append(frames, fmt.Sprintf("%s %v:%v", frame["name"], source["name"], frame["line"]))
+	}
+	return
+}
+
+func (c *dapClient) stopped(reason string) {
+	if body := c.event("stopped"); body["reason"] != reason {
+		c.t.Errorf("Expected a stop on %s, got %v", reason, body)
+	}
+}
+
+func TestDAP(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"main.s": `	.org $0200
+main:	ldx #0
+loop:	jsr sub
+	inx
+	cpx #3
+	bne loop
+done:	jmp done
+	.include "sub.s"
+`,
+		"sub.s": `sub:	lda #$42
+	; stores A
+	sta $10
+	rts
+`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newDAPClient(t)
+	c.request("initialize", map[string]any{"adapterID": "6502"})
+	c.request("launch", map[string]any{"program": filepath.Join(dir, "main.s"), "start": "main", "stopOnEntry": true})
+	c.event("initialized")
+
+	// a line without code gets the next one
+	body := c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": filepath.Join(dir, "sub.s")},
+		"breakpoints": []map[string]any{{"line": 2}, {"line": 9}},
+	})
+	bps := body["breakpoints"].([]any)
+	if bp := bps[0].(map[string]any); bp["verified"] != true || bp["line"] != float64(3) {
+		t.Errorf("Unexpected breakpoint %v", bp)
+	}
+	if bp := bps[1].(map[string]any); bp["verified"] != false {
+		t.Errorf("Unexpected breakpoint %v", bp)
+	}
+
+	c.request("configurationDone", nil)
+	c.stopped("entry")
+	if act, exp := fmt.Sprint(c.stack()), "[main main.s:2]"; act != exp {
+		t.Errorf("Expected %s, got %s\n", exp, act)
+	}
+
+	c.request("continue", map[string]any{"threadId": 1})
+	c.stopped("breakpoint")
+	if act, exp := fmt.Sprint(c.stack()), "[sub+2 sub.s:3 loop main.s:3]"; act != exp {
+		t.Errorf("Expected %s, got %s\n", exp, act)
+	}
+
+	scopes := c.request("scopes", map[string]any{"frameId": 0})["scopes"].([]any)
+	vars := map[string]string{}
+	for _, scope := range scopes {
+		ref := scope.(map[string]any)["variablesReference"]
+		for _, v := range c.request("variables", map[string]any{"variablesReference": ref})["variables"].([]any) {
+			v := v.(map[string]any)
+			vars[v["name"].(string)] = v["value"].(string)
+		}
+	}
+	for name, exp := range map[string]string{"A": "$42", "PC": "$020F", "SP": "$FB", "Z": "0", "I": "1", "$00": "00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00"} {
+		if vars[name] != exp {
+			t.Errorf("%s: expected %s, got %s\n", name, exp, vars[name])
+		}
+	}
+
+	c.request("stepOut", map[string]any{"threadId": 1})
+	c.stopped("step")
+	if act, exp := fmt.Sprint(c.stack()), "[loop+3 main.s:4]"; act != exp {
+		t.Errorf("Expected %s, got %s\n", exp, act)
+	}
+
+	// step over the JSR, without the breakpoint in the way
+	c.request("setBreakpoints", map[string]any{"source": map[string]any{"path": filepath.Join(dir, "sub.s")}})
+	for _, exp := range []string{"main.s:5", "main.s:6", "main.s:3", "main.s:4"} {
+		c.request("next", map[string]any{"threadId": 1})
+		c.stopped("step")
+		if act := c.stack(); len(act) != 1 || !strings.HasSuffix(act[0], " "+exp) {
+			t.Errorf("Expected %s, got %s\n", exp, act)
+		}
+	}
+
+	c.request("stepIn", map[string]any{"threadId": 1})
+	c.stopped("step")
+
+	// the program ends looping on done, and takes requests meanwhile
+	c.request("continue", map[string]any{"threadId": 1})
+	time.Sleep(10 * time.Millisecond)
+	body = c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": filepath.Join(dir, "sub.s")},
+		"breakpoints": []map[string]any{{"line": 3}},
+	})
+	if bp := body["breakpoints"].([]any)[0].(map[string]any); bp["verified"] != true {
+		t.Errorf("Unexpected breakpoint %v", bp)
+	}
+	c.request("pause", map[string]any{"threadId": 1})
+	c.stopped("pause")
+	if act, exp := fmt.Sprint(c.stack()), "[done main.s:7]"; act != exp {
+		t.Errorf("Expected %s, got %s\n", exp, act)
+	}
+
+	c.request("disconnect", nil)
+}
+
+func TestDAPErrors(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "bad.s"), []byte(" .org $0200\n lda #$100\n"), 0o644)
+	c := newDAPClient(t)
+
+	c.seq++
+	data, _ := json.Marshal(map[string]any{"seq": c.seq, "type": "request", "command": "launch",
+		"arguments": map[string]any{"program": filepath.Join(dir, "bad.s")}})
+	fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	if msg := c.next(); msg["success"] != false || msg["message"] != "bad.s:2: value out of range: $100 = 256" {
+		t.Errorf("Unexpected response %v", msg)
+	}
+}
+
+func TestDAPFrames(t *testing.T) {
+	// the 6507 sees its code at $E000 as well as at $0000
+	var mem RAM
+	mem[0x0200] = 0x20
+	mem[0x01FC], mem[0x01FD] = 0x02, 0xE2
+	cpu := NewCpuVariant(&mem, MOS6507)
+	cpu.pc, cpu.sp = 0xE300, 0xFB
+
+	s := &dapSession{cpu: cpu}
+	if act, exp := s.frames(), []uint16{0xE300, 0xE200}; !reflect.DeepEqual(act, exp) {
+		t.Errorf("Expected %+v, got %+v\n", exp, act)
+	}
+}
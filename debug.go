@@ -0,0 +1,543 @@
+package mos6502
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BreakKind is what a breakpoint stops on
+type BreakKind int
+
+// Breakpoint kinds
+const (
+	// Stops before the instruction at Start runs
+	BreakPC BreakKind = iota
+	// Stops after an instruction that reads, writes, or does either to an
+	// address from Start to End
+	BreakRead
+	BreakWrite
+	BreakAccess
+	// Stops before an instruction with the opcode Opcode runs
+	BreakOpcode
+	// Stops once the processor enters an IRQ or NMI handler. BRK is an
+	// instruction: break on its opcode
+	BreakInterrupt
+	// Stops before an instruction when Cond holds
+	BreakCondition
+)
+
+// Breakpoint is a condition the debugger stops the processor on
+type Breakpoint struct {
+	// set by Add
+	ID   int
+	Kind BreakKind
+	// the address of BreakPC, and the range of addresses watched by
+	// BreakRead, BreakWrite and BreakAccess. End defaults to Start
+	Start, End uint16
+	Opcode     uint8
+	// Cond is the expression of BreakCondition, or an extra condition on
+	// the other kinds, checked when they trip. Watchpoints check it on the
+	// access. For instance:
+	//
+	//	A == $40 && [$80] > 3
+	//
+	// The registers are A, X, Y, SP, PC and P, the flags C, Z, I, D, V and
+	// N, and [addr] is the byte at addr. Numbers are $hex, %binary or
+	// decimal. The operators are those of C, with the comparisons binding
+	// looser than the arithmetic ones, and are evaluated on ints: any
+	// value other than 0 is true.
+	Cond     string
+	Disabled bool
+
+	cond condExpr
+}
+
+// BreakError is returned when the debugger stops the processor on a
+// breakpoint
+type BreakError struct {
+	Breakpoint *Breakpoint
+	// where the processor stopped
+	PC uint16
+	// the access of a watchpoint, or the vector of an interrupt
+	Addr  uint16
+	Value uint8
+	Write bool
+}
+
+func (e *BreakError) Error() string {
+	bp := e.Breakpoint
+	switch bp.Kind {
+	case BreakRead, BreakWrite, BreakAccess:
+		dir := "read $%02X from $%04X"
+		if e.Write {
+			dir = "wrote $%02X to $%04X"
+		}
+		return fmt.Sprintf("watchpoint %d: "+dir+", stopped at $%04X", bp.ID, e.Value, e.Addr, e.PC)
+	case BreakOpcode:
+		return fmt.Sprintf("breakpoint %d: opcode $%02X at $%04X", bp.ID, bp.Opcode, e.PC)
+	case BreakInterrupt:
+		name := "IRQ"
+		if e.Addr == NMI_VECTOR {
+			name = "NMI"
+		}
+		return fmt.Sprintf("breakpoint %d: %s, handler at $%04X", bp.ID, name, e.PC)
+	case BreakCondition:
+		return fmt.Sprintf("breakpoint %d: %s at $%04X", bp.ID, bp.Cond, e.PC)
+	}
+	return fmt.Sprintf("breakpoint %d at $%04X", bp.ID, e.PC)
+}
+
+// Debugger runs a processor and stops it on breakpoints. It watches the
+// memory accesses of the processor by standing between it and its Mem.
+type Debugger struct {
+	cpu         *Cpu
+	mem         *watchedMem
+	breakpoints []*Breakpoint
+	lastID      int
+	// the first watchpoint tripped by the instruction running
+	hit *BreakError
+}
+
+// NewDebugger attaches a debugger to a processor
+func NewDebugger(cpu *Cpu) *Debugger {
+	d := &Debugger{cpu: cpu}
+	d.mem = &watchedMem{mem: cpu.mem, d: d}
+	cpu.mem = d.mem
+	return d
+}
+
+// Detach gives the processor its memory back. The debugger can't be used
+// afterwards.
+func (d *Debugger) Detach() {
+	d.cpu.mem = d.mem.mem
+}
+
+// Add adds a breakpoint and returns it with its ID. It fails if the
+// condition doesn't parse.
+func (d *Debugger) Add(bp Breakpoint) (*Breakpoint, error) {
+	if bp.Cond != "" {
+		cond, err := parseCond(bp.Cond)
+		if err != nil {
+			return nil, err
+		}
+		bp.cond = cond
+	} else if bp.Kind == BreakCondition {
+		return nil, fmt.Errorf("condition breakpoint without a condition")
+	}
+	if bp.End < bp.Start {
+		bp.End = bp.Start
+	}
+
+	d.lastID++
+	bp.ID = d.lastID
+	d.breakpoints = append(d.breakpoints, &bp)
+	return &bp, nil
+}
+
+// Delete removes a breakpoint. It returns false if there is none with
+// that ID.
+func (d *Debugger) Delete(id int) bool {
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Breakpoints returns the breakpoints, in the order they were added
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	return d.breakpoints
+}
+
+// Step runs a single instruction, or interrupt sequence, like Cpu.Step.
+// It returns a *BreakError if it trips a watchpoint or enters an
+// interrupt handler with a breakpoint on it.
+func (d *Debugger) Step() (resCycles int, err error) {
+	cpu := d.cpu
+	nmi := cpu.nmiPending
+	interrupt := !cpu.halted && (nmi || cpu.irq && cpu.p.i == 0)
+
+	d.hit = nil
+	d.mem.armed = true
+	resCycles, err = cpu.Step()
+	d.mem.armed = false
+	if err != nil {
+		return
+	}
+	if d.hit != nil {
+		// the PC is only known once the instruction is done
+		d.hit.PC = cpu.pc
+		err = d.hit
+		return
+	}
+
+	if interrupt {
+		vector := uint16(IRQ_VECTOR)
+		if nmi {
+			vector = NMI_VECTOR
+		}
+		for _, bp := range d.breakpoints {
+			if bp.Kind == BreakInterrupt && d.trips(bp) {
+				err = &BreakError{Breakpoint: bp, PC: cpu.pc, Addr: vector}
+				return
+			}
+		}
+	}
+	return
+}
+
+// RunUntil runs instructions like Cpu.RunUntil, and stops on breakpoints
+// too, returning a *BreakError. The first instruction always runs, so
+// that it can carry on from a breakpoint.
+func (d *Debugger) RunUntil(pred func(cpu *Cpu) bool) (ran int, err error) {
+	for first := true; !pred(d.cpu); first = false {
+		if !first {
+			if err = d.check(); err != nil {
+				return
+			}
+		}
+		if d.cpu.halted {
+			err = ErrHalted
+			return
+		}
+
+		var resCycles int
+		resCycles, err = d.Step()
+		ran += resCycles
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Run runs instructions until a breakpoint, or an error, stops them
+func (d *Debugger) Run() (ran int, err error) {
+	return d.RunUntil(func(*Cpu) bool { return false })
+}
+
+// checks the breakpoints on the instruction about to run
+func (d *Debugger) check() error {
+	cpu := d.cpu
+	for _, bp := range d.breakpoints {
+		switch bp.Kind {
+		case BreakPC:
+			if cpu.pc != bp.Start {
+				continue
+			}
+		case BreakOpcode:
+			if d.mem.mem.Read(cpu.pc) != bp.Opcode {
+				continue
+			}
+		case BreakCondition:
+		default:
+			continue
+		}
+		if d.trips(bp) {
+			return &BreakError{Breakpoint: bp, PC: cpu.pc}
+		}
+	}
+	return nil
+}
+
+// tells if a breakpoint is enabled and its condition, if any, holds
+func (d *Debugger) trips(bp *Breakpoint) bool {
+	return !bp.Disabled && (bp.cond == nil || bp.cond(d) != 0)
+}
+
+// records the first watchpoint an access trips
+func (d *Debugger) watch(addr uint16, value uint8, write bool) {
+	if d.hit != nil {
+		return
+	}
+	for _, bp := range d.breakpoints {
+		switch {
+		case addr < bp.Start || addr > bp.End:
+			continue
+		case bp.Kind == BreakRead && write, bp.Kind == BreakWrite && !write:
+			continue
+		case bp.Kind != BreakRead && bp.Kind != BreakWrite && bp.Kind != BreakAccess:
+			continue
+		}
+		if d.trips(bp) {
+			d.hit = &BreakError{Breakpoint: bp, Addr: addr, Value: value, Write: write}
+			return
+		}
+	}
+}
+
+// the memory of a processor, seen through a debugger
+type watchedMem struct {
+	mem Mem
+	d   *Debugger
+	// only the accesses of the processor are watched, while it runs
+	armed bool
+}
+
+func (m *watchedMem) Read(addr uint16) uint8 {
+	value := m.mem.Read(addr)
+	if m.armed {
+		m.d.watch(addr, value, false)
+	}
+	return value
+}
+
+func (m *watchedMem) Write(addr uint16, value uint8) {
+	m.mem.Write(addr, value)
+	if m.armed {
+		m.d.watch(addr, value, true)
+	}
+}
+
+// a compiled condition
+type condExpr func(d *Debugger) int
+
+// a condition being parsed
+type condParser struct {
+	src string
+	pos int
+}
+
+// binary operators of conditions, by precedence from the loosest binding
+var condOps = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<=", ">=", "<", ">"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func parseCond(src string) (condExpr, error) {
+	p := &condParser{src: src}
+	expr, err := p.parse(0)
+	if err == nil {
+		p.space()
+		if p.pos < len(p.src) {
+			err = fmt.Errorf("unexpected %q in %q", p.src[p.pos:], src)
+		}
+	}
+	return expr, err
+}
+
+func (p *condParser) space() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// parses the operators of a precedence level and the tighter ones
+func (p *condParser) parse(level int) (condExpr, error) {
+	if level == len(condOps) {
+		return p.unary()
+	}
+
+	x, err := p.parse(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.space()
+		op := ""
+		for _, o := range condOps[level] {
+			// the longest operator: < is not <=, nor <<. & is not &&
+			if strings.HasPrefix(p.src[p.pos:], o) && len(o) > len(op) && !p.longer(o) {
+				op = o
+			}
+		}
+		if op == "" {
+			return x, nil
+		}
+		p.pos += len(op)
+
+		y, err := p.parse(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = binaryCond(op, x, y)
+	}
+}
+
+// tells if an operator found at the position is the start of a longer one
+func (p *condParser) longer(op string) bool {
+	rest := p.src[p.pos+len(op):]
+	if rest == "" {
+		return false
+	}
+	switch op {
+	case "<", ">":
+		return rest[0] == '=' || rest[0] == op[0]
+	case "&", "|":
+		return rest[0] == op[0]
+	}
+	return false
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func binaryCond(op string, x, y condExpr) condExpr {
+	switch op {
+	case "||":
+		return func(d *Debugger) int { return boolInt(x(d) != 0 || y(d) != 0) }
+	case "&&":
+		return func(d *Debugger) int { return boolInt(x(d) != 0 && y(d) != 0) }
+	case "==":
+		return func(d *Debugger) int { return boolInt(x(d) == y(d)) }
+	case "!=":
+		return func(d *Debugger) int { return boolInt(x(d) != y(d)) }
+	case "<=":
+		return func(d *Debugger) int { return boolInt(x(d) <= y(d)) }
+	case ">=":
+		return func(d *Debugger) int { return boolInt(x(d) >= y(d)) }
+	case "<":
+		return func(d *Debugger) int { return boolInt(x(d) < y(d)) }
+	case ">":
+		return func(d *Debugger) int { return boolInt(x(d) > y(d)) }
+	case "|":
+		return func(d *Debugger) int { return x(d) | y(d) }
+	case "^":
+		return func(d *Debugger) int { return x(d) ^ y(d) }
+	case "&":
+		return func(d *Debugger) int { return x(d) & y(d) }
+	case "<<", ">>":
+		// a negative shift count gives 0, as division by zero does below
+		return func(d *Debugger) int {
+			v := y(d)
+			switch {
+			case v < 0:
+				return 0
+			case op == "<<":
+				return x(d) << v
+			}
+			return x(d) >> v
+		}
+	case "+":
+		return func(d *Debugger) int { return x(d) + y(d) }
+	case "-":
+		return func(d *Debugger) int { return x(d) - y(d) }
+	case "*":
+		return func(d *Debugger) int { return x(d) * y(d) }
+	}
+	// division by zero gives 0 rather than stopping the program
+	return func(d *Debugger) int {
+		v := y(d)
+		if v == 0 {
+			return 0
+		}
+		if op == "/" {
+			return x(d) / v
+		}
+		return x(d) % v
+	}
+}
+
+func (p *condParser) unary() (condExpr, error) {
+	p.space()
+	if p.pos == len(p.src) {
+		return nil, fmt.Errorf("missing value in %q", p.src)
+	}
+
+	switch c := p.src[p.pos]; c {
+	case '!', '-', '~':
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		switch c {
+		case '!':
+			return func(d *Debugger) int { return boolInt(x(d) == 0) }, nil
+		case '-':
+			return func(d *Debugger) int { return -x(d) }, nil
+		}
+		return func(d *Debugger) int { return ^x(d) }, nil
+	}
+
+	return p.primary()
+}
+
+// the registers and flags of conditions
+var condRegs = map[string]condExpr{
+	"A":  func(d *Debugger) int { return int(d.cpu.ac) },
+	"X":  func(d *Debugger) int { return int(d.cpu.x) },
+	"Y":  func(d *Debugger) int { return int(d.cpu.y) },
+	"SP": func(d *Debugger) int { return int(d.cpu.sp) },
+	"PC": func(d *Debugger) int { return int(d.cpu.pc) },
+	"P":  func(d *Debugger) int { return int(d.cpu.p.getAsWord()) },
+	"C":  func(d *Debugger) int { return d.cpu.p.c },
+	"Z":  func(d *Debugger) int { return d.cpu.p.z },
+	"I":  func(d *Debugger) int { return d.cpu.p.i },
+	"D":  func(d *Debugger) int { return d.cpu.p.d },
+	"V":  func(d *Debugger) int { return d.cpu.p.v },
+	"N":  func(d *Debugger) int { return d.cpu.p.n },
+}
+
+func (p *condParser) primary() (condExpr, error) {
+	rest := p.src[p.pos:]
+
+	switch c := rest[0]; {
+	case c == '(' || c == '[':
+		p.pos++
+		x, err := p.parse(0)
+		if err != nil {
+			return nil, err
+		}
+		p.space()
+		closing := map[byte]byte{'(': ')', '[': ']'}[c]
+		if p.pos == len(p.src) || p.src[p.pos] != closing {
+			return nil, fmt.Errorf("missing %c in %q", closing, p.src)
+		}
+		p.pos++
+		if c == '(' {
+			return x, nil
+		}
+		// the byte at an address, read without the debugger seeing it
+		return func(d *Debugger) int { return int(d.mem.mem.Read(uint16(x(d)))) }, nil
+
+	case c == '$' || c == '%' || c >= '0' && c <= '9':
+		base, digits := 10, rest
+		switch c {
+		case '$':
+			base, digits = 16, rest[1:]
+		case '%':
+			base, digits = 2, rest[1:]
+		}
+		n := 0
+		for n < len(digits) && isAlnum(digits[n]) {
+			n++
+		}
+		v, err := strconv.ParseInt(digits[:n], base, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", rest[:len(rest)-len(digits)+n])
+		}
+		p.pos += len(rest) - len(digits) + n
+		return func(*Debugger) int { return int(v) }, nil
+
+	case isAlpha(c):
+		n := 1
+		for n < len(rest) && isAlnum(rest[n]) {
+			n++
+		}
+		reg, ok := condRegs[strings.ToUpper(rest[:n])]
+		if !ok {
+			return nil, fmt.Errorf("unknown register %s", rest[:n])
+		}
+		p.pos += n
+		return reg, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q", rest)
+}
@@ -0,0 +1,168 @@
+package mos6502
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// a program counting $80 up from 0, storing the count in $0300,X
+const debugProgram = `
+	.org $0200
+loop:	inc $80
+	lda $80
+	ldx #2
+	sta $0300,x
+	jmp loop
+`
+
+func debugCpu(t *testing.T, src string) (*Cpu, *Memory) {
+	img, err := Assemble(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mem Memory
+	img.Load(&mem)
+	return &Cpu{mem: &mem, pc: 0x0200, sp: 0xFD}, &mem
+}
+
+func TestDebugger(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		bp   Breakpoint
+		// Expected
+		pc    uint16
+		count uint8
+		addr  uint16
+		value uint8
+		write bool
+	}{
+		{name: "PC",
+			bp: Breakpoint{Kind: BreakPC, Start: 0x0204}, pc: 0x0204, count: 1},
+		{name: "PC with a condition",
+			bp: Breakpoint{Kind: BreakPC, Start: 0x0204, Cond: "A == 3"}, pc: 0x0204, count: 3},
+		{name: "Write",
+			bp: Breakpoint{Kind: BreakWrite, Start: 0x0300, End: 0x03FF}, pc: 0x0209, count: 1, addr: 0x0302, value: 1, write: true},
+		{name: "Read",
+			bp: Breakpoint{Kind: BreakRead, Start: 0x0080}, pc: 0x0202, count: 1, addr: 0x0080},
+		{name: "Access with a condition",
+			bp: Breakpoint{Kind: BreakAccess, Start: 0x0080, Cond: "[$80] == 2"}, pc: 0x0202, count: 2, addr: 0x0080, value: 2, write: true},
+		{name: "Opcode",
+			bp: Breakpoint{Kind: BreakOpcode, Opcode: 0x4C}, pc: 0x0209, count: 1},
+		{name: "Condition",
+			bp: Breakpoint{Kind: BreakCondition, Cond: "A == $05 && [$80] > 4 && X != 0"}, pc: 0x0204, count: 5},
+	} {
+		t.Log(tt.name)
+		cpu, mem := debugCpu(t, debugProgram)
+		d := NewDebugger(cpu)
+		bp, err := d.Add(tt.bp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = d.Run()
+		var stop *BreakError
+		if !errors.As(err, &stop) {
+			t.Errorf("Expected a BreakError, got %v", err)
+			continue
+		}
+		exp := BreakError{Breakpoint: bp, PC: tt.pc, Addr: tt.addr, Value: tt.value, Write: tt.write}
+		if *stop != exp {
+			t.Errorf("Expected %+v, got %+v\n", exp, *stop)
+		}
+		if act := mem.Read(0x80); act != tt.count {
+			t.Errorf("Expected %+v, got %+v\n", tt.count, act)
+		}
+	}
+}
+
+func TestDebuggerContinue(t *testing.T) {
+	cpu, mem := debugCpu(t, debugProgram)
+	d := NewDebugger(cpu)
+	pc, _ := d.Add(Breakpoint{Kind: BreakPC, Start: 0x0200})
+	d.Add(Breakpoint{Kind: BreakPC, Start: 0x0204, Disabled: true})
+
+	// it carries on from the breakpoint it starts on
+	for i := 1; i <= 3; i++ {
+		_, err := d.Run()
+		var stop *BreakError
+		if !errors.As(err, &stop) || stop.Breakpoint != pc {
+			t.Fatalf("Expected breakpoint %d, got %v", pc.ID, err)
+		}
+		if act := mem.Read(0x80); act != uint8(i) {
+			t.Errorf("Expected %+v, got %+v\n", i, act)
+		}
+	}
+
+	if !d.Delete(pc.ID) || d.Delete(pc.ID) {
+		t.Errorf("Breakpoint %d not deleted once", pc.ID)
+	}
+	ran, err := d.RunUntil(func(cpu *Cpu) bool { return mem.Read(0x80) == 10 })
+	if err != nil || ran == 0 {
+		t.Errorf("Unexpected error: %v after %d cycles", err, ran)
+	}
+}
+
+func TestDebuggerInterrupt(t *testing.T) {
+	cpu, _ := debugCpu(t, debugProgram+`
+nmi:	rti
+	.org $FFFA
+	.word nmi
+`)
+	d := NewDebugger(cpu)
+	bp, _ := d.Add(Breakpoint{Kind: BreakInterrupt})
+
+	d.Step()
+	cpu.SetNMI(true)
+	_, err := d.Step()
+
+	exp := &BreakError{Breakpoint: bp, PC: 0x020C, Addr: NMI_VECTOR}
+	var stop *BreakError
+	if !errors.As(err, &stop) || *stop != *exp {
+		t.Errorf("Expected %+v, got %v\n", exp, err)
+	}
+	if !strings.Contains(err.Error(), "NMI") {
+		t.Errorf("Expected NMI in %q", err)
+	}
+}
+
+func TestDebuggerConditions(t *testing.T) {
+	var mem Memory
+	mem.Write(0x80, 7)
+	cpu := &Cpu{mem: &mem, pc: 0x1234, ac: 0x40, x: 2, y: 0xFF, sp: 0xF0}
+	cpu.p.c = 1
+	d := NewDebugger(cpu)
+
+	for _, tt := range []struct {
+		cond string
+		exp  int
+	}{
+		{"A == $40 && [$80] > 3", 1},
+		{"A == $40 && [$80] > 7", 0},
+		{"a == 64 || 0", 1},
+		{"[$7F + X - 1] == 7", 1},
+		{"PC == $1234 && SP >= $F0 && Y <= $FF", 1},
+		{"C && !Z && N == 0", 1},
+		{"(P & %00000001) != 0", 1},
+		{"X << 2 == 8 && 7 % 4 == 3 && -X == ~X + 1", 1},
+		{"A / 0 == 0", 1},
+		{"A << -1 == 0 && A >> (X - 3) == 0", 1},
+		{"1 + 2 * 3 == 7", 1},
+	} {
+		t.Log(tt.cond)
+		cond, err := parseCond(tt.cond)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			continue
+		}
+		if act := cond(d); act != tt.exp {
+			t.Errorf("Expected %+v, got %+v\n", tt.exp, act)
+		}
+	}
+
+	for _, cond := range []string{"A ==", "B == 1", "[$80", "A == 1)", ""} {
+		if _, err := d.Add(Breakpoint{Kind: BreakCondition, Cond: cond}); err == nil {
+			t.Errorf("No error for %q", cond)
+		}
+	}
+}
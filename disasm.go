@@ -0,0 +1,140 @@
+package mos6502
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Instruction is an instruction read back from memory
+type Instruction struct {
+	// where the instruction is
+	Addr uint16
+	// the opcode and its operand bytes
+	Bytes  []uint8
+	Opcode Opcode
+	// the operand in assembly syntax, like "($20),Y", with addresses
+	// replaced by their labels. Empty for implied instructions
+	Operand string
+}
+
+// Target returns the address a branch goes to when taken. Instructions that
+// don't branch return false
+func (inst Instruction) Target() (addr uint16, ok bool) {
+	switch inst.Opcode.Mode {
+	case Relative:
+		return inst.Addr + 2 + uint16(int8(inst.Bytes[1])), true
+	case ZeroPageRelative:
+		return inst.Addr + 3 + uint16(int8(inst.Bytes[2])), true
+	}
+	return 0, false
+}
+
+// String formats the instruction as a listing line: address, bytes,
+// mnemonic and operand
+func (inst Instruction) String() string {
+	var hex []string
+	for _, b := range inst.Bytes {
+		hex = append(hex, fmt.Sprintf("%02X", b))
+	}
+
+	line := fmt.Sprintf("%04X  %-8s  %s", inst.Addr, strings.Join(hex, " "), inst.Opcode.Mnemonic)
+	if inst.Operand != "" {
+		line += " " + inst.Operand
+	}
+	return line
+}
+
+// Disassembler reads the instructions in a memory
+type Disassembler struct {
+	mem     Mem
+	opcodes [256]Opcode
+	// Labels replace the addresses they name in operands. Immediate
+	// operands are left as they are
+	Labels map[uint16]string
+}
+
+// NewDisassembler returns a disassembler for the instruction set of a
+// processor variant. It reads memory through mem.Read, so it sees what the
+// processor would.
+func NewDisassembler(mem Mem, variant Variant) *Disassembler {
+	return &Disassembler{mem: mem, opcodes: Opcodes(variant)}
+}
+
+// Disassemble reads the instruction at addr
+func (d *Disassembler) Disassemble(addr uint16) (inst Instruction) {
+	inst.Addr = addr
+	inst.Opcode = d.opcodes[d.mem.Read(addr)]
+	for i := 0; i < inst.Opcode.Bytes; i++ {
+		inst.Bytes = append(inst.Bytes, d.mem.Read(addr+uint16(i)))
+	}
+	inst.Operand = d.operand(inst)
+
+	return
+}
+
+// DisassembleRange reads the instructions from start up to end, end not
+// included. The last instruction may run past end.
+func (d *Disassembler) DisassembleRange(start, end uint16) (insts []Instruction) {
+	for addr := int(start); addr < int(end); {
+		inst := d.Disassemble(uint16(addr))
+		insts = append(insts, inst)
+		addr += inst.Opcode.Bytes
+	}
+
+	return
+}
+
+// writes the operand of an instruction in assembly syntax
+func (d *Disassembler) operand(inst Instruction) string {
+	var zp, abs uint16
+	if len(inst.Bytes) > 1 {
+		zp = uint16(inst.Bytes[1])
+	}
+	if len(inst.Bytes) > 2 {
+		abs = word(inst.Bytes[1], inst.Bytes[2])
+	}
+	target, _ := inst.Target()
+
+	switch inst.Opcode.Mode {
+	case Accumulator:
+		return "A"
+	case Immediate:
+		return fmt.Sprintf("#$%02X", zp)
+	case ZeroPage:
+		return d.label(zp, 2)
+	case ZeroPageX:
+		return d.label(zp, 2) + ",X"
+	case ZeroPageY:
+		return d.label(zp, 2) + ",Y"
+	case Relative:
+		return d.label(target, 4)
+	case Absolute:
+		return d.label(abs, 4)
+	case AbsoluteX:
+		return d.label(abs, 4) + ",X"
+	case AbsoluteY:
+		return d.label(abs, 4) + ",Y"
+	case Indirect:
+		return "(" + d.label(abs, 4) + ")"
+	case IndirectX:
+		return "(" + d.label(zp, 2) + ",X)"
+	case IndirectY:
+		return "(" + d.label(zp, 2) + "),Y"
+	case ZeroPageIndirect:
+		return "(" + d.label(zp, 2) + ")"
+	case AbsoluteIndirectX:
+		return "(" + d.label(abs, 4) + ",X)"
+	case ZeroPageRelative:
+		return d.label(zp, 2) + "," + d.label(target, 4)
+	}
+
+	return ""
+}
+
+// names an address by its label, or in hex with the given number of digits
+func (d *Disassembler) label(addr uint16, digits int) string {
+	if label, ok := d.Labels[addr]; ok {
+		return label
+	}
+	return fmt.Sprintf("$%0*X", digits, addr)
+}
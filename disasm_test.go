@@ -0,0 +1,148 @@
+package mos6502
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		variant Variant
+		addr    uint16
+		code    []uint8
+		labels  map[uint16]string
+		// Expected
+		exp string
+	}{
+		{name: "Implied",
+			addr: 0xC000, code: []uint8{0xE8},
+			exp: "C000  E8        INX",
+		},
+		{name: "Accumulator",
+			addr: 0xC000, code: []uint8{0x0A},
+			exp: "C000  0A        ASL A",
+		},
+		{name: "Immediate",
+			addr: 0xC000, code: []uint8{0xA9, 0x10},
+			exp: "C000  A9 10     LDA #$10",
+		},
+		{name: "Zero page,Y",
+			addr: 0xC000, code: []uint8{0xB6, 0x10},
+			exp: "C000  B6 10     LDX $10,Y",
+		},
+		{name: "Absolute,X",
+			addr: 0xC000, code: []uint8{0xBD, 0x34, 0x12},
+			exp: "C000  BD 34 12  LDA $1234,X",
+		},
+		{name: "Indirect",
+			addr: 0xC000, code: []uint8{0x6C, 0xFC, 0xFF},
+			exp: "C000  6C FC FF  JMP ($FFFC)",
+		},
+		{name: "(Zero page,X)",
+			addr: 0xC000, code: []uint8{0xA1, 0x20},
+			exp: "C000  A1 20     LDA ($20,X)",
+		},
+		{name: "(Zero page),Y",
+			addr: 0xC000, code: []uint8{0xB1, 0x20},
+			exp: "C000  B1 20     LDA ($20),Y",
+		},
+		{name: "Branch backwards",
+			addr: 0xC010, code: []uint8{0xD0, 0xFE},
+			exp: "C010  D0 FE     BNE $C010",
+		},
+		{name: "Branch forwards",
+			addr: 0xC000, code: []uint8{0xF0, 0x10},
+			exp: "C000  F0 10     BEQ $C012",
+		},
+		{name: "Undocumented",
+			addr: 0xC000, code: []uint8{0xA7, 0x10},
+			exp: "C000  A7 10     LAX $10",
+		},
+		{name: "Labels",
+			addr: 0xC000, code: []uint8{0x20, 0xD2, 0xFF},
+			labels: map[uint16]string{0xFFD2: "CHROUT"},
+			exp:    "C000  20 D2 FF  JSR CHROUT",
+		},
+		{name: "Labelled branch target",
+			addr: 0xC010, code: []uint8{0xD0, 0xFE},
+			labels: map[uint16]string{0xC010: "loop"},
+			exp:    "C010  D0 FE     BNE loop",
+		},
+		{name: "Labels in indirect modes",
+			addr: 0xC000, code: []uint8{0x91, 0xFB},
+			labels: map[uint16]string{0xFB: "ptr"},
+			exp:    "C000  91 FB     STA (ptr),Y",
+		},
+		{name: "Immediates aren't labelled",
+			addr: 0xC000, code: []uint8{0xA9, 0x10},
+			labels: map[uint16]string{0x10: "zp"},
+			exp:    "C000  A9 10     LDA #$10",
+		},
+		{name: "65C02 (zp)",
+			variant: WDC65C02, addr: 0xC000, code: []uint8{0xB2, 0x20},
+			exp: "C000  B2 20     LDA ($20)",
+		},
+		{name: "65C02 (abs,X)",
+			variant: WDC65C02, addr: 0xC000, code: []uint8{0x7C, 0x00, 0x20},
+			exp: "C000  7C 00 20  JMP ($2000,X)",
+		},
+		{name: "65C02 BBR",
+			variant: WDC65C02, addr: 0xC000, code: []uint8{0x2F, 0x10, 0xFD},
+			exp: "C000  2F 10 FD  BBR2 $10,$C000",
+		},
+	} {
+		var mem Memory
+		for i, b := range tt.code {
+			mem.Write(tt.addr+uint16(i), b)
+		}
+		d := NewDisassembler(&mem, tt.variant)
+		d.Labels = tt.labels
+
+		act := d.Disassemble(tt.addr).String()
+		t.Log(tt.name)
+
+		if act != tt.exp {
+			t.Errorf("Expected %q, got %q\n", tt.exp, act)
+		}
+	}
+}
+
+func TestDisassembleTarget(t *testing.T) {
+	var mem Memory
+	mem.Write(0x0200, 0x90)
+	mem.Write(0x0201, 0x80)
+	mem.Write(0x0202, 0xEA)
+	d := NewDisassembler(&mem, NMOS6502)
+
+	if target, ok := d.Disassemble(0x0200).Target(); !ok || target != 0x0182 {
+		t.Errorf("Expected %+v, got %+v %v\n", 0x0182, target, ok)
+	}
+	if _, ok := d.Disassemble(0x0202).Target(); ok {
+		t.Errorf("NOP has a target")
+	}
+}
+
+func TestDisassembleRange(t *testing.T) {
+	var mem Memory
+	// LDX #$05; DEX; BNE *-1; RTS
+	for i, b := range []uint8{0xA2, 0x05, 0xCA, 0xD0, 0xFD, 0x60} {
+		mem.Write(0x0200+uint16(i), b)
+	}
+	d := NewDisassembler(&mem, NMOS6502)
+
+	var act []string
+	for _, inst := range d.DisassembleRange(0x0200, 0x0206) {
+		act = append(act, inst.String())
+	}
+
+	exp := []string{
+		"0200  A2 05     LDX #$05",
+		"0202  CA        DEX",
+		"0203  D0 FD     BNE $0202",
+		"0205  60        RTS",
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Errorf("Expected %q, got %q\n", exp, act)
+	}
+}
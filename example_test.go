@@ -0,0 +1,23 @@
+package mos6502_test
+
+import (
+	"fmt"
+
+	mos6502 "github.com/jmle/6502"
+)
+
+func Example() {
+	var mem mos6502.RAM
+	// reset vector
+	mem[0xFFFC], mem[0xFFFD] = 0x00, 0x02
+	// LDX #$05; DEX; BNE *-1
+	copy(mem[0x0200:], []uint8{0xA2, 0x05, 0xCA, 0xD0, 0xFD})
+
+	cpu := mos6502.NewCpu(&mem)
+	cpu.Reset()
+	cpu.Step()
+	cpu.Step()
+
+	fmt.Printf("PC=%04X X=%02X Z=%v\n", cpu.PC(), cpu.X(), cpu.Status().Zero())
+	// Output: PC=0203 X=04 Z=false
+}
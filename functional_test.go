@@ -0,0 +1,117 @@
+package mos6502
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Klaus Dormann's test suites (https://github.com/Klaus2m5/6502_65C02_functional_tests).
+// The binaries are not part of the repository: assemble them, or copy the
+// prebuilt ones, into testdata/. A missing binary skips its test.
+//
+// Every test ends in a trap, a jump or branch to itself. The functional
+// tests trap at a known address on success and anywhere else on failure,
+// with the number of the failing test in test_case ($0200). The decimal
+// test always ends at the same place and leaves its verdict in ERROR ($000B).
+var dormannTests = []struct {
+	name    string
+	file    string
+	variant Variant
+	// where the binary is loaded and where execution starts
+	load, start uint16
+	// trap address on success, zero if any trap will do. These are the
+	// ones of the prebuilt binaries in bin_files/ of the suite
+	success uint16
+	// address of the failing test number, or of the error flag
+	result uint16
+}{
+	{name: "Functional test",
+		file: "6502_functional_test.bin", variant: NMOS6502,
+		load: 0x0000, start: 0x0400,
+		success: 0x3469, result: 0x0200,
+	},
+	{name: "Functional test, 65C02",
+		file: "6502_functional_test.bin", variant: WDC65C02,
+		load: 0x0000, start: 0x0400,
+		success: 0x3469, result: 0x0200,
+	},
+	{name: "65C02 extended opcodes test",
+		file: "65C02_extended_opcodes_test.bin", variant: WDC65C02,
+		load: 0x0000, start: 0x0400,
+		success: 0x24F1, result: 0x0202,
+	},
+	{name: "Decimal test",
+		file: "6502_decimal_test.bin", variant: NMOS6502,
+		load: 0x0200, start: 0x0200,
+		result: 0x000B,
+	},
+	{name: "Decimal test, 65C02",
+		file: "65C02_decimal_test.bin", variant: WDC65C02,
+		load: 0x0200, start: 0x0200,
+		result: 0x000B,
+	},
+}
+
+// upper bound on the run, well above what the slowest test needs
+const dormannMaxCycles = 1 << 30
+
+func TestDormann(t *testing.T) {
+	for _, tt := range dormannTests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if errors.Is(err, os.ErrNotExist) {
+				t.Skipf("%s not found in testdata", tt.file)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var mem Memory
+			for i, b := range bin {
+				mem.Write(tt.load+uint16(i), b)
+			}
+
+			cpu := NewCpuVariant(&mem, tt.variant)
+			cpu.SetPC(tt.start)
+
+			trap, err := runToTrap(cpu)
+			if err != nil {
+				t.Fatalf("%v at %04X (test %02X), %s", err, cpu.pc, mem.Read(tt.result), cpuState(cpu))
+			}
+
+			switch {
+			case tt.success != 0 && trap != tt.success:
+				t.Errorf("Trapped at %04X in test %02X, %s", trap, mem.Read(tt.result), cpuState(cpu))
+			case tt.success == 0 && mem.Read(tt.result) != 0:
+				t.Errorf("Trapped at %04X with error flag set, %s", trap, cpuState(cpu))
+			}
+		})
+	}
+}
+
+// runToTrap steps until an instruction leaves the PC where it was and
+// returns the trap address. Halting (STP, JAM) counts as a trap too.
+func runToTrap(cpu *Cpu) (uint16, error) {
+	for ran := 0; ran < dormannMaxCycles; {
+		pc := cpu.pc
+
+		resCycles, err := cpu.Step()
+		ran += resCycles
+		if err != nil {
+			return pc, err
+		}
+		if cpu.pc == pc || cpu.halted {
+			return pc, nil
+		}
+	}
+
+	return cpu.pc, errors.New("no trap reached")
+}
+
+func cpuState(cpu *Cpu) string {
+	return fmt.Sprintf("PC=%04X A=%02X X=%02X Y=%02X SP=%02X P=%02X",
+		cpu.pc, cpu.ac, cpu.x, cpu.y, cpu.sp, cpu.p.getAsWord())
+}
@@ -0,0 +1,498 @@
+package mos6502
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// GDBServer serves the GDB remote serial protocol for a processor, so that
+// gdb, or any other front end speaking it, can debug the programs it
+// runs:
+//
+//	(gdb) target remote localhost:6502
+//
+// It reads and writes the registers, in the order pc (16 bits), sp, a, x,
+// y and p, and the memory, steps and continues, and sets software
+// breakpoints and watchpoints. A stop is reported as SIGTRAP, an
+// interrupt from gdb as SIGINT, and an error of the processor, like an
+// undefined opcode, as SIGILL.
+type GDBServer struct {
+	cpu *Cpu
+	d   *Debugger
+	// the debugger breakpoints of gdb's, by packet
+	breakpoints map[string]int
+}
+
+// NewGDBServer returns a server for a processor. It attaches a debugger
+// to it.
+func NewGDBServer(cpu *Cpu) *GDBServer {
+	return &GDBServer{cpu: cpu, d: NewDebugger(cpu), breakpoints: map[string]int{}}
+}
+
+// ListenAndServe listens on a TCP address, like "localhost:6502", and
+// serves the connections it gets
+func (s *GDBServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(l)
+}
+
+// Serve serves the connections of a listener, one at a time, until it
+// fails
+func (s *GDBServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.ServeConn(conn)
+		conn.Close()
+	}
+}
+
+// the signals of stop replies
+const (
+	gdbSIGINT  = 2
+	gdbSIGILL  = 4
+	gdbSIGTRAP = 5
+)
+
+// the target description sent to gdb
+const gdbTargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.6502.cpu">
+    <reg name="pc" bitsize="16" type="code_ptr" regnum="0"/>
+    <reg name="sp" bitsize="8" type="uint8"/>
+    <reg name="a" bitsize="8" type="uint8"/>
+    <reg name="x" bitsize="8" type="uint8"/>
+    <reg name="y" bitsize="8" type="uint8"/>
+    <reg name="p" bitsize="8" type="uint8"/>
+  </feature>
+</target>
+`
+
+// a connection to gdb
+type gdbConn struct {
+	w io.Writer
+	// the bytes read, but for the interrupts
+	in    chan byte
+	noAck bool
+	// set when gdb interrupts the program
+	interrupt atomic.Bool
+}
+
+// ServeConn runs a debugging session on a connection, until gdb detaches
+// or kills the program, or the connection ends
+func (s *GDBServer) ServeConn(rw io.ReadWriter) error {
+	c := &gdbConn{w: rw, in: make(chan byte, 4096)}
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		r := bufio.NewReader(rw)
+		defer close(c.in)
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			if b == 0x03 {
+				c.interrupt.Store(true)
+				continue
+			}
+			select {
+			case c.in <- b:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for {
+		packet, err := c.readPacket()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		// k is the only packet without a reply
+		if packet == "k" {
+			return nil
+		}
+		reply, done := s.handle(c, packet)
+		if err := c.writePacket(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// reads a packet, acknowledging it
+func (c *gdbConn) readPacket() (string, error) {
+	for {
+		// acks and anything else outside packets are skipped
+		for b, ok := <-c.in; b != '$'; b, ok = <-c.in {
+			if !ok {
+				return "", io.EOF
+			}
+		}
+
+		var data []byte
+		for b := range c.in {
+			if b == '#' {
+				break
+			}
+			data = append(data, b)
+		}
+		sum := []byte{<-c.in, <-c.in}
+
+		if c.noAck {
+			return string(data), nil
+		}
+		if exp, err := strconv.ParseUint(string(sum), 16, 8); err != nil || uint8(exp) != gdbChecksum(data) {
+			if _, err := c.w.Write([]byte("-")); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if _, err := c.w.Write([]byte("+")); err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
+func (c *gdbConn) writePacket(data string) error {
+	_, err := fmt.Fprintf(c.w, "$%s#%02x", data, gdbChecksum([]byte(data)))
+	return err
+}
+
+func gdbChecksum(data []byte) (sum uint8) {
+	for _, b := range data {
+		sum += b
+	}
+	return
+}
+
+// runs a packet and returns the reply, and whether the session is over
+func (s *GDBServer) handle(c *gdbConn, packet string) (reply string, done bool) {
+	cmd, args := packet[:min(1, len(packet))], packet[min(1, len(packet)):]
+
+	switch {
+	case cmd == "?":
+		return fmt.Sprintf("S%02x", gdbSIGTRAP), false
+	case cmd == "g":
+		return s.readRegisters(), false
+	case cmd == "G":
+		return s.writeRegisters(args), false
+	case cmd == "p":
+		return s.readRegister(args), false
+	case cmd == "P":
+		return s.writeRegister(args), false
+	case cmd == "m":
+		return s.readMemory(args), false
+	case cmd == "M":
+		return s.writeMemory(args), false
+	case cmd == "s":
+		return s.resume(c, args, true), false
+	case cmd == "c":
+		return s.resume(c, args, false), false
+	case cmd == "Z" || cmd == "z":
+		return s.breakpoint(cmd == "Z", args), false
+	case cmd == "H":
+		return "OK", false
+	case cmd == "D":
+		return "OK", true
+	case strings.HasPrefix(packet, "qSupported"):
+		return "PacketSize=1000;qXfer:features:read+;QStartNoAckMode+", false
+	case packet == "QStartNoAckMode":
+		c.noAck = true
+		return "OK", false
+	case packet == "qAttached":
+		return "1", false
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		return gdbXfer(gdbTargetXML, strings.TrimPrefix(packet, "qXfer:features:read:target.xml:")), false
+	}
+
+	// an empty reply tells gdb the packet isn't supported
+	return "", false
+}
+
+// the errors replies carry
+const (
+	gdbErrSyntax = "E01"
+	gdbErrRange  = "E02"
+)
+
+// sends a part of a document, as asked by offset,length
+func gdbXfer(doc, args string) string {
+	offset, length, err := gdbPair(args, ",")
+	if err != nil {
+		return gdbErrSyntax
+	}
+	if offset >= len(doc) {
+		return "l"
+	}
+	end := offset + length
+	if end >= len(doc) {
+		return "l" + doc[offset:]
+	}
+	return "m" + doc[offset:end]
+}
+
+// parses two hex numbers separated by sep
+func gdbPair(s, sep string) (a, b int, err error) {
+	as, bs, ok := strings.Cut(s, sep)
+	if !ok {
+		return 0, 0, errors.New("missing " + sep)
+	}
+	av, err := strconv.ParseUint(as, 16, 32)
+	if err != nil {
+		return
+	}
+	bv, err := strconv.ParseUint(bs, 16, 32)
+	return int(av), int(bv), err
+}
+
+// the sizes of the registers, in bytes, in the order gdb numbers them
+var gdbRegSizes = []int{2, 1, 1, 1, 1, 1}
+
+func (s *GDBServer) register(n int) uint16 {
+	cpu := s.cpu
+	switch n {
+	case 0:
+		return cpu.pc
+	case 1:
+		return uint16(cpu.sp)
+	case 2:
+		return uint16(cpu.ac)
+	case 3:
+		return uint16(cpu.x)
+	case 4:
+		return uint16(cpu.y)
+	}
+	return uint16(cpu.p.getAsWord())
+}
+
+func (s *GDBServer) setRegister(n int, v uint16) {
+	cpu := s.cpu
+	switch n {
+	case 0:
+		cpu.pc = v
+	case 1:
+		cpu.sp = uint8(v)
+	case 2:
+		cpu.ac = uint8(v)
+	case 3:
+		cpu.x = uint8(v)
+	case 4:
+		cpu.y = uint8(v)
+	case 5:
+		cpu.p.setAsWord(uint8(v))
+	}
+}
+
+// registers go in target byte order: little endian
+func gdbRegister(v uint16, size int) string {
+	if size == 1 {
+		return fmt.Sprintf("%02x", v)
+	}
+	return fmt.Sprintf("%02x%02x", uint8(v), uint8(v>>8))
+}
+
+func parseGDBRegister(s string) (v uint16, err error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint16(b[i])
+	}
+	return
+}
+
+func (s *GDBServer) readRegisters() string {
+	var regs strings.Builder
+	for n, size := range gdbRegSizes {
+		regs.WriteString(gdbRegister(s.register(n), size))
+	}
+	return regs.String()
+}
+
+func (s *GDBServer) writeRegisters(args string) string {
+	values := make([]uint16, len(gdbRegSizes))
+	for n, size := range gdbRegSizes {
+		if len(args) < 2*size {
+			return gdbErrSyntax
+		}
+		v, err := parseGDBRegister(args[:2*size])
+		if err != nil {
+			return gdbErrSyntax
+		}
+		values[n], args = v, args[2*size:]
+	}
+	for n, v := range values {
+		s.setRegister(n, v)
+	}
+	return "OK"
+}
+
+func (s *GDBServer) readRegister(args string) string {
+	n, err := strconv.ParseUint(args, 16, 8)
+	if err != nil || int(n) >= len(gdbRegSizes) {
+		return gdbErrRange
+	}
+	return gdbRegister(s.register(int(n)), gdbRegSizes[n])
+}
+
+func (s *GDBServer) writeRegister(args string) string {
+	ns, vs, _ := strings.Cut(args, "=")
+	n, err := strconv.ParseUint(ns, 16, 8)
+	if err != nil || int(n) >= len(gdbRegSizes) {
+		return gdbErrRange
+	}
+	v, err := parseGDBRegister(vs)
+	if err != nil || len(vs) != 2*gdbRegSizes[n] {
+		return gdbErrSyntax
+	}
+	s.setRegister(int(n), v)
+	return "OK"
+}
+
+// memory is read and written past the debugger, so that gdb doesn't trip
+// the watchpoints
+func (s *GDBServer) readMemory(args string) string {
+	addr, length, err := gdbPair(args, ",")
+	if err != nil {
+		return gdbErrSyntax
+	}
+	if addr+length > 0x10000 {
+		return gdbErrRange
+	}
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = s.d.mem.mem.Read(uint16(addr + i))
+	}
+	return hex.EncodeToString(data)
+}
+
+func (s *GDBServer) writeMemory(args string) string {
+	header, values, _ := strings.Cut(args, ":")
+	addr, length, err := gdbPair(header, ",")
+	if err != nil {
+		return gdbErrSyntax
+	}
+	data, err := hex.DecodeString(values)
+	if err != nil || len(data) != length {
+		return gdbErrSyntax
+	}
+	if addr+length > 0x10000 {
+		return gdbErrRange
+	}
+	for i, b := range data {
+		s.d.mem.mem.Write(uint16(addr+i), b)
+	}
+	return "OK"
+}
+
+// steps or continues, from addr if given, and returns the stop reply
+func (s *GDBServer) resume(c *gdbConn, addr string, step bool) string {
+	if addr != "" {
+		pc, err := strconv.ParseUint(addr, 16, 16)
+		if err != nil {
+			return gdbErrSyntax
+		}
+		s.cpu.pc = uint16(pc)
+	}
+
+	var err error
+	if step {
+		_, err = s.d.Step()
+	} else {
+		_, err = s.d.RunUntil(func(*Cpu) bool { return c.interrupt.Load() })
+	}
+	interrupted := c.interrupt.Swap(false)
+
+	var stop *BreakError
+	switch {
+	case errors.As(err, &stop):
+		switch stop.Breakpoint.Kind {
+		case BreakRead:
+			return fmt.Sprintf("T%02xrwatch:%04x;", gdbSIGTRAP, stop.Addr)
+		case BreakWrite:
+			return fmt.Sprintf("T%02xwatch:%04x;", gdbSIGTRAP, stop.Addr)
+		case BreakAccess:
+			return fmt.Sprintf("T%02xawatch:%04x;", gdbSIGTRAP, stop.Addr)
+		}
+	case err != nil:
+		return fmt.Sprintf("S%02x", gdbSIGILL)
+	case interrupted:
+		return fmt.Sprintf("S%02x", gdbSIGINT)
+	}
+	return fmt.Sprintf("S%02x", gdbSIGTRAP)
+}
+
+// the debugger breakpoints of gdb's: Z0 and Z1 are breakpoints, Z2, Z3
+// and Z4 write, read and access watchpoints
+var gdbBreakKinds = map[string]BreakKind{
+	"0": BreakPC,
+	"1": BreakPC,
+	"2": BreakWrite,
+	"3": BreakRead,
+	"4": BreakAccess,
+}
+
+// inserts or removes a breakpoint, given as type,addr,kind
+func (s *GDBServer) breakpoint(insert bool, args string) string {
+	fields := strings.Split(args, ",")
+	if len(fields) < 3 {
+		return gdbErrSyntax
+	}
+	kind, ok := gdbBreakKinds[fields[0]]
+	if !ok {
+		return ""
+	}
+	addr, length, err := gdbPair(fields[1]+","+fields[2], ",")
+	if err != nil || addr > 0xFFFF {
+		return gdbErrSyntax
+	}
+
+	// the length of software breakpoints is the kind of instruction
+	if kind == BreakPC {
+		length = 1
+	}
+	key := fmt.Sprintf("%s,%x,%x", fields[0], addr, length)
+
+	if !insert {
+		id, ok := s.breakpoints[key]
+		if !ok || !s.d.Delete(id) {
+			return gdbErrRange
+		}
+		delete(s.breakpoints, key)
+		return "OK"
+	}
+
+	if _, ok := s.breakpoints[key]; ok {
+		return "OK"
+	}
+	bp, err := s.d.Add(Breakpoint{Kind: kind, Start: uint16(addr), End: uint16(min(addr+max(length, 1)-1, 0xFFFF))})
+	if err != nil {
+		return gdbErrSyntax
+	}
+	s.breakpoints[key] = bp.ID
+	return "OK"
+}
@@ -0,0 +1,171 @@
+package mos6502
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a gdb of sorts, on a loopback connection
+type gdbClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *gdbClient) send(packet string) {
+	var sum uint8
+	for _, b := range []byte(packet) {
+		sum += b
+	}
+	fmt.Fprintf(c.conn, "$%s#%02x", packet, sum)
+}
+
+// reads a reply, skipping the acks
+func (c *gdbClient) reply() string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatalf("Reading the reply: %v", err)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatalf("Reading the reply: %v", err)
+	}
+	c.r.Discard(2)
+	c.conn.Write([]byte("+"))
+	return strings.TrimSuffix(data, "#")
+}
+
+func (c *gdbClient) call(packet string) string {
+	c.send(packet)
+	return c.reply()
+}
+
+func newGDBTest(t *testing.T) (*gdbClient, *Cpu) {
+	cpu, _ := debugCpu(t, debugProgram)
+	server := NewGDBServer(cpu)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &gdbClient{t: t, conn: conn, r: bufio.NewReader(conn)}, cpu
+}
+
+func TestGDBServer(t *testing.T) {
+	c, _ := newGDBTest(t)
+
+	for _, tt := range []struct {
+		name   string
+		packet string
+		// Expected
+		exp string
+	}{
+		{name: "Features",
+			packet: "qSupported:swbreak+", exp: "PacketSize=1000;qXfer:features:read+;QStartNoAckMode+"},
+		{name: "Target description",
+			packet: "qXfer:features:read:target.xml:0,f", exp: "m<?xml version=\""},
+		{name: "Stop reason",
+			packet: "?", exp: "S05"},
+		{name: "Registers",
+			packet: "g", exp: "0002fd00000020"},
+		{name: "Write registers",
+			packet: "G0002fd112233a1", exp: "OK"},
+		{name: "Registers written",
+			packet: "g", exp: "0002fd112233a1"},
+		{name: "Write a register",
+			packet: "P2=40", exp: "OK"},
+		{name: "Read a register",
+			packet: "p2", exp: "40"},
+		{name: "Read the PC",
+			packet: "p0", exp: "0002"},
+		{name: "Bad register",
+			packet: "p9", exp: "E02"},
+		{name: "Read memory",
+			packet: "m200,5", exp: "e680a580a2"},
+		{name: "Write memory",
+			packet: "M80,2:0a0b", exp: "OK"},
+		{name: "Memory written",
+			packet: "m80,2", exp: "0a0b"},
+		{name: "Memory past $FFFF",
+			packet: "mffff,2", exp: "E02"},
+		{name: "Step",
+			packet: "s", exp: "S05"},
+		{name: "Stepped",
+			packet: "p0", exp: "0202"},
+		{name: "Breakpoint",
+			packet: "Z0,209,1", exp: "OK"},
+		{name: "Continue to it",
+			packet: "c", exp: "S05"},
+		{name: "Stopped on it",
+			packet: "p0", exp: "0902"},
+		{name: "Remove it",
+			packet: "z0,209,1", exp: "OK"},
+		{name: "Remove it again",
+			packet: "z0,209,1", exp: "E02"},
+		{name: "Write watchpoint",
+			packet: "Z2,302,1", exp: "OK"},
+		{name: "Continue to it",
+			packet: "c", exp: "T05watch:0302;"},
+		{name: "Read watchpoint",
+			packet: "Z3,80,1", exp: "OK"},
+		{name: "Continue to it",
+			packet: "c", exp: "T05rwatch:0080;"},
+		{name: "Unsupported",
+			packet: "vMustReplyEmpty", exp: ""},
+	} {
+		t.Log(tt.name)
+		if act := c.call(tt.packet); act != tt.exp {
+			t.Errorf("%s: expected %q, got %q\n", tt.packet, tt.exp, act)
+		}
+	}
+}
+
+func TestGDBServerInterrupt(t *testing.T) {
+	c, _ := newGDBTest(t)
+
+	if act := c.call("QStartNoAckMode"); act != "OK" {
+		t.Fatalf("Expected %q, got %q\n", "OK", act)
+	}
+
+	// the program loops forever, until gdb interrupts it
+	c.send("c")
+	c.conn.Write([]byte{0x03})
+	if act := c.reply(); act != "S02" {
+		t.Errorf("Expected %q, got %q\n", "S02", act)
+	}
+
+	// checksums are not checked any more
+	fmt.Fprint(c.conn, "$p1#00")
+	if act := c.reply(); act != "fd" {
+		t.Errorf("Expected %q, got %q\n", "fd", act)
+	}
+
+	if act := c.call("D"); act != "OK" {
+		t.Errorf("Expected %q, got %q\n", "OK", act)
+	}
+}
+
+func TestGDBServerChecksum(t *testing.T) {
+	c, _ := newGDBTest(t)
+
+	fmt.Fprint(c.conn, "$g#00")
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := c.r.ReadByte(); err != nil || b != '-' {
+		t.Errorf("Expected a nak, got %q %v", b, err)
+	}
+	if act := c.call("p3"); act != "00" {
+		t.Errorf("Expected %q, got %q\n", "00", act)
+	}
+}
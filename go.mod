@@ -0,0 +1,3 @@
+module github.com/jmle/6502
+
+go 1.23
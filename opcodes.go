@@ -0,0 +1,607 @@
+package mos6502
+
+// AddrMode is the addressing mode of an instruction
+type AddrMode int
+
+// Addressing modes
+const (
+	// No operand
+	Implied AddrMode = iota
+	// The accumulator is the operand: ASL A
+	Accumulator
+	// The operand follows the opcode: LDA #$10
+	Immediate
+	// LDA $10
+	ZeroPage
+	// LDA $10,X
+	ZeroPageX
+	// LDX $10,Y
+	ZeroPageY
+	// A signed offset from the next instruction: BNE $0200
+	Relative
+	// LDA $1234
+	Absolute
+	// LDA $1234,X
+	AbsoluteX
+	// LDA $1234,Y
+	AbsoluteY
+	// JMP ($1234)
+	Indirect
+	// LDA ($10,X)
+	IndirectX
+	// LDA ($10),Y
+	IndirectY
+	// LDA ($10), 65C02 only
+	ZeroPageIndirect
+	// JMP ($1234,X), 65C02 only
+	AbsoluteIndirectX
+	// A zero page address and a relative offset: BBR0 $10,$0200, 65C02
+	// only
+	ZeroPageRelative
+)
+
+// Bytes returns how long an instruction with the addressing mode is,
+// opcode included
+func (m AddrMode) Bytes() int {
+	switch m {
+	case Implied, Accumulator:
+		return 1
+	case Absolute, AbsoluteX, AbsoluteY, Indirect, AbsoluteIndirectX, ZeroPageRelative:
+		return 3
+	}
+	return 2
+}
+
+// OpcodeStatus tells whether an opcode is documented, and so when the
+// processor runs it
+type OpcodeStatus int
+
+// Opcode statuses
+const (
+	// Documented, always run
+	Official OpcodeStatus = iota
+	// One of the stable undocumented opcodes of the NMOS part, run with
+	// IllegalStable or IllegalAll
+	Undocumented
+	// One of the unstable undocumented opcodes of the NMOS part, run with
+	// IllegalAll only
+	Unstable
+	// Reserved on the 65C02, where it is a NOP. Always run, as the chip
+	// has no undefined opcodes
+	Reserved
+)
+
+// Opcode describes an opcode of the processor
+type Opcode struct {
+	Mnemonic string
+	Mode     AddrMode
+	// length of the instruction, opcode included. BRK takes one byte, but
+	// skips the one after it
+	Bytes int
+	// cycles the instruction takes, without the penalties below. Taken
+	// branches take one more, and the 65C02 takes one more for ADC and SBC
+	// in decimal mode
+	Cycles int
+	// cycles added when indexing, or a taken branch, crosses a page.
+	// Indexed opcodes without a penalty always take the cycle to fix the
+	// address instead
+	PageCross int
+	Status    OpcodeStatus
+}
+
+// Opcodes returns the opcode table of a processor variant, indexed by
+// opcode. Every opcode is in it: the ones the processor doesn't document
+// are marked by their status
+func Opcodes(variant Variant) (opcodes [256]Opcode) {
+	for i, inst := range instructionSet(variant) {
+		opcodes[i] = inst.Opcode
+	}
+	return
+}
+
+// an opcode and how the processor runs it
+type instruction struct {
+	Opcode
+	// runs the instruction once the addressing mode has resolved its
+	// address. Immediates get the address of the operand, and the
+	// instructions without one get nothing
+	run func(cpu *Cpu, addr uint16)
+	// the instruction fetches its operand itself (JSR)
+	fetch bool
+}
+
+// the instruction set of a processor variant
+func instructionSet(variant Variant) *[256]instruction {
+	if variant == WDC65C02 {
+		return &cmosInstructions
+	}
+	return &nmosInstructions
+}
+
+func official(mnemonic string, mode AddrMode, cycles, pageCross int, run func(*Cpu, uint16)) instruction {
+	return instruction{Opcode: Opcode{mnemonic, mode, mode.Bytes(), cycles, pageCross, Official}, run: run}
+}
+
+func undocumented(mnemonic string, mode AddrMode, cycles, pageCross int, run func(*Cpu, uint16)) instruction {
+	return instruction{Opcode: Opcode{mnemonic, mode, mode.Bytes(), cycles, pageCross, Undocumented}, run: run}
+}
+
+func unstable(mnemonic string, mode AddrMode, cycles, pageCross int, run func(*Cpu, uint16)) instruction {
+	return instruction{Opcode: Opcode{mnemonic, mode, mode.Bytes(), cycles, pageCross, Unstable}, run: run}
+}
+
+func reserved(mode AddrMode, cycles int) instruction {
+	run := (*Cpu).nopm
+	if mode == Implied {
+		run = noOperand((*Cpu).nop)
+	}
+	return instruction{Opcode: Opcode{"NOP", mode, mode.Bytes(), cycles, 0, Reserved}, run: run}
+}
+
+// adapters from the instruction implementations to run functions
+
+func noOperand(f func(*Cpu)) func(*Cpu, uint16) {
+	return func(cpu *Cpu, addr uint16) { f(cpu) }
+}
+
+func onRegister(f func(*Cpu, uint16, int), r int) func(*Cpu, uint16) {
+	return func(cpu *Cpu, addr uint16) { f(cpu, addr, r) }
+}
+
+func register(f func(*Cpu, int), r int) func(*Cpu, uint16) {
+	return func(cpu *Cpu, addr uint16) { f(cpu, r) }
+}
+
+func onBit(f func(*Cpu, uint16, uint8), bit uint8) func(*Cpu, uint16) {
+	return func(cpu *Cpu, addr uint16) { f(cpu, addr, bit) }
+}
+
+func branchOnBit(f func(*Cpu, uint16, uint8) bool, bit uint8) func(*Cpu, uint16) {
+	return func(cpu *Cpu, addr uint16) { f(cpu, addr, bit) }
+}
+
+func conditional(f func(*Cpu, uint16) bool) func(*Cpu, uint16) {
+	return func(cpu *Cpu, addr uint16) { f(cpu, addr) }
+}
+
+func rmw(f func(*Cpu, uint16) uint8) func(*Cpu, uint16) {
+	return func(cpu *Cpu, addr uint16) { f(cpu, addr) }
+}
+
+// The NMOS 6502, 6507 and 2A03
+var nmosInstructions = [256]instruction{
+	// ADC
+	0x69: official("ADC", Immediate, 2, 0, (*Cpu).adc),
+	0x65: official("ADC", ZeroPage, 3, 0, (*Cpu).adc),
+	0x75: official("ADC", ZeroPageX, 4, 0, (*Cpu).adc),
+	0x6D: official("ADC", Absolute, 4, 0, (*Cpu).adc),
+	0x7D: official("ADC", AbsoluteX, 4, 1, (*Cpu).adc),
+	0x79: official("ADC", AbsoluteY, 4, 1, (*Cpu).adc),
+	0x61: official("ADC", IndirectX, 6, 0, (*Cpu).adc),
+	0x71: official("ADC", IndirectY, 5, 1, (*Cpu).adc),
+
+	// AND
+	0x29: official("AND", Immediate, 2, 0, (*Cpu).and),
+	0x25: official("AND", ZeroPage, 3, 0, (*Cpu).and),
+	0x35: official("AND", ZeroPageX, 4, 0, (*Cpu).and),
+	0x2D: official("AND", Absolute, 4, 0, (*Cpu).and),
+	0x3D: official("AND", AbsoluteX, 4, 1, (*Cpu).and),
+	0x39: official("AND", AbsoluteY, 4, 1, (*Cpu).and),
+	0x21: official("AND", IndirectX, 6, 0, (*Cpu).and),
+	0x31: official("AND", IndirectY, 5, 1, (*Cpu).and),
+
+	// ASL
+	0x0A: official("ASL", Accumulator, 2, 0, noOperand((*Cpu).asla)),
+	0x06: official("ASL", ZeroPage, 5, 0, rmw((*Cpu).asl)),
+	0x16: official("ASL", ZeroPageX, 6, 0, rmw((*Cpu).asl)),
+	0x0E: official("ASL", Absolute, 6, 0, rmw((*Cpu).asl)),
+	0x1E: official("ASL", AbsoluteX, 7, 0, rmw((*Cpu).asl)),
+
+	// branches
+	0x90: official("BCC", Relative, 2, 1, conditional((*Cpu).bcc)),
+	0xB0: official("BCS", Relative, 2, 1, conditional((*Cpu).bcs)),
+	0xF0: official("BEQ", Relative, 2, 1, conditional((*Cpu).beq)),
+	0x30: official("BMI", Relative, 2, 1, conditional((*Cpu).bmi)),
+	0xD0: official("BNE", Relative, 2, 1, conditional((*Cpu).bne)),
+	0x10: official("BPL", Relative, 2, 1, conditional((*Cpu).bpl)),
+	0x50: official("BVC", Relative, 2, 1, conditional((*Cpu).bvc)),
+	0x70: official("BVS", Relative, 2, 1, conditional((*Cpu).bvs)),
+
+	// BIT
+	0x24: official("BIT", ZeroPage, 3, 0, (*Cpu).bit),
+	0x2C: official("BIT", Absolute, 4, 0, (*Cpu).bit),
+
+	// BRK
+	0x00: official("BRK", Implied, 7, 0, noOperand((*Cpu).brk)),
+
+	// flags
+	0x18: official("CLC", Implied, 2, 0, noOperand((*Cpu).clc)),
+	0xD8: official("CLD", Implied, 2, 0, noOperand((*Cpu).cld)),
+	0x58: official("CLI", Implied, 2, 0, noOperand((*Cpu).cli)),
+	0xB8: official("CLV", Implied, 2, 0, noOperand((*Cpu).clv)),
+	0x38: official("SEC", Implied, 2, 0, noOperand((*Cpu).sec)),
+	0xF8: official("SED", Implied, 2, 0, noOperand((*Cpu).sed)),
+	0x78: official("SEI", Implied, 2, 0, noOperand((*Cpu).sei)),
+
+	// CMP
+	0xC9: official("CMP", Immediate, 2, 0, onRegister((*Cpu).cmp, A)),
+	0xC5: official("CMP", ZeroPage, 3, 0, onRegister((*Cpu).cmp, A)),
+	0xD5: official("CMP", ZeroPageX, 4, 0, onRegister((*Cpu).cmp, A)),
+	0xCD: official("CMP", Absolute, 4, 0, onRegister((*Cpu).cmp, A)),
+	0xDD: official("CMP", AbsoluteX, 4, 1, onRegister((*Cpu).cmp, A)),
+	0xD9: official("CMP", AbsoluteY, 4, 1, onRegister((*Cpu).cmp, A)),
+	0xC1: official("CMP", IndirectX, 6, 0, onRegister((*Cpu).cmp, A)),
+	0xD1: official("CMP", IndirectY, 5, 1, onRegister((*Cpu).cmp, A)),
+
+	// CPX
+	0xE0: official("CPX", Immediate, 2, 0, onRegister((*Cpu).cmp, X)),
+	0xE4: official("CPX", ZeroPage, 3, 0, onRegister((*Cpu).cmp, X)),
+	0xEC: official("CPX", Absolute, 4, 0, onRegister((*Cpu).cmp, X)),
+
+	// CPY
+	0xC0: official("CPY", Immediate, 2, 0, onRegister((*Cpu).cmp, Y)),
+	0xC4: official("CPY", ZeroPage, 3, 0, onRegister((*Cpu).cmp, Y)),
+	0xCC: official("CPY", Absolute, 4, 0, onRegister((*Cpu).cmp, Y)),
+
+	// DEC
+	0xC6: official("DEC", ZeroPage, 5, 0, rmw((*Cpu).dec)),
+	0xD6: official("DEC", ZeroPageX, 6, 0, rmw((*Cpu).dec)),
+	0xCE: official("DEC", Absolute, 6, 0, rmw((*Cpu).dec)),
+	0xDE: official("DEC", AbsoluteX, 7, 0, rmw((*Cpu).dec)),
+	0xCA: official("DEX", Implied, 2, 0, register((*Cpu).decxy, X)),
+	0x88: official("DEY", Implied, 2, 0, register((*Cpu).decxy, Y)),
+
+	// EOR
+	0x49: official("EOR", Immediate, 2, 0, (*Cpu).eor),
+	0x45: official("EOR", ZeroPage, 3, 0, (*Cpu).eor),
+	0x55: official("EOR", ZeroPageX, 4, 0, (*Cpu).eor),
+	0x4D: official("EOR", Absolute, 4, 0, (*Cpu).eor),
+	0x5D: official("EOR", AbsoluteX, 4, 1, (*Cpu).eor),
+	0x59: official("EOR", AbsoluteY, 4, 1, (*Cpu).eor),
+	0x41: official("EOR", IndirectX, 6, 0, (*Cpu).eor),
+	0x51: official("EOR", IndirectY, 5, 1, (*Cpu).eor),
+
+	// INC
+	0xE6: official("INC", ZeroPage, 5, 0, rmw((*Cpu).inc)),
+	0xF6: official("INC", ZeroPageX, 6, 0, rmw((*Cpu).inc)),
+	0xEE: official("INC", Absolute, 6, 0, rmw((*Cpu).inc)),
+	0xFE: official("INC", AbsoluteX, 7, 0, rmw((*Cpu).inc)),
+	0xE8: official("INX", Implied, 2, 0, register((*Cpu).incxy, X)),
+	0xC8: official("INY", Implied, 2, 0, register((*Cpu).incxy, Y)),
+
+	// JMP
+	0x4C: official("JMP", Absolute, 3, 0, (*Cpu).jmp),
+	0x6C: official("JMP", Indirect, 5, 0, (*Cpu).jmp),
+
+	// JSR
+	0x20: {Opcode: Opcode{"JSR", Absolute, 3, 6, 0, Official}, run: noOperand((*Cpu).jsr), fetch: true},
+
+	// LDA
+	0xA9: official("LDA", Immediate, 2, 0, onRegister((*Cpu).ldr, A)),
+	0xA5: official("LDA", ZeroPage, 3, 0, onRegister((*Cpu).ldr, A)),
+	0xB5: official("LDA", ZeroPageX, 4, 0, onRegister((*Cpu).ldr, A)),
+	0xAD: official("LDA", Absolute, 4, 0, onRegister((*Cpu).ldr, A)),
+	0xBD: official("LDA", AbsoluteX, 4, 1, onRegister((*Cpu).ldr, A)),
+	0xB9: official("LDA", AbsoluteY, 4, 1, onRegister((*Cpu).ldr, A)),
+	0xA1: official("LDA", IndirectX, 6, 0, onRegister((*Cpu).ldr, A)),
+	0xB1: official("LDA", IndirectY, 5, 1, onRegister((*Cpu).ldr, A)),
+
+	// LDX
+	0xA2: official("LDX", Immediate, 2, 0, onRegister((*Cpu).ldr, X)),
+	0xA6: official("LDX", ZeroPage, 3, 0, onRegister((*Cpu).ldr, X)),
+	0xB6: official("LDX", ZeroPageY, 4, 0, onRegister((*Cpu).ldr, X)),
+	0xAE: official("LDX", Absolute, 4, 0, onRegister((*Cpu).ldr, X)),
+	0xBE: official("LDX", AbsoluteY, 4, 1, onRegister((*Cpu).ldr, X)),
+
+	// LDY
+	0xA0: official("LDY", Immediate, 2, 0, onRegister((*Cpu).ldr, Y)),
+	0xA4: official("LDY", ZeroPage, 3, 0, onRegister((*Cpu).ldr, Y)),
+	0xB4: official("LDY", ZeroPageX, 4, 0, onRegister((*Cpu).ldr, Y)),
+	0xAC: official("LDY", Absolute, 4, 0, onRegister((*Cpu).ldr, Y)),
+	0xBC: official("LDY", AbsoluteX, 4, 1, onRegister((*Cpu).ldr, Y)),
+
+	// LSR
+	0x4A: official("LSR", Accumulator, 2, 0, noOperand((*Cpu).lsra)),
+	0x46: official("LSR", ZeroPage, 5, 0, rmw((*Cpu).lsrm)),
+	0x56: official("LSR", ZeroPageX, 6, 0, rmw((*Cpu).lsrm)),
+	0x4E: official("LSR", Absolute, 6, 0, rmw((*Cpu).lsrm)),
+	0x5E: official("LSR", AbsoluteX, 7, 0, rmw((*Cpu).lsrm)),
+
+	// NOP
+	0xEA: official("NOP", Implied, 2, 0, noOperand((*Cpu).nop)),
+
+	// ORA
+	0x09: official("ORA", Immediate, 2, 0, (*Cpu).ora),
+	0x05: official("ORA", ZeroPage, 3, 0, (*Cpu).ora),
+	0x15: official("ORA", ZeroPageX, 4, 0, (*Cpu).ora),
+	0x0D: official("ORA", Absolute, 4, 0, (*Cpu).ora),
+	0x1D: official("ORA", AbsoluteX, 4, 1, (*Cpu).ora),
+	0x19: official("ORA", AbsoluteY, 4, 1, (*Cpu).ora),
+	0x01: official("ORA", IndirectX, 6, 0, (*Cpu).ora),
+	0x11: official("ORA", IndirectY, 5, 1, (*Cpu).ora),
+
+	// stack
+	0x48: official("PHA", Implied, 3, 0, noOperand((*Cpu).pha)),
+	0x08: official("PHP", Implied, 3, 0, noOperand((*Cpu).php)),
+	0x68: official("PLA", Implied, 4, 0, noOperand((*Cpu).pla)),
+	0x28: official("PLP", Implied, 4, 0, noOperand((*Cpu).plp)),
+
+	// ROL
+	0x2A: official("ROL", Accumulator, 2, 0, noOperand((*Cpu).rola)),
+	0x26: official("ROL", ZeroPage, 5, 0, rmw((*Cpu).rolm)),
+	0x36: official("ROL", ZeroPageX, 6, 0, rmw((*Cpu).rolm)),
+	0x2E: official("ROL", Absolute, 6, 0, rmw((*Cpu).rolm)),
+	0x3E: official("ROL", AbsoluteX, 7, 0, rmw((*Cpu).rolm)),
+
+	// ROR
+	0x6A: official("ROR", Accumulator, 2, 0, noOperand((*Cpu).rora)),
+	0x66: official("ROR", ZeroPage, 5, 0, rmw((*Cpu).rorm)),
+	0x76: official("ROR", ZeroPageX, 6, 0, rmw((*Cpu).rorm)),
+	0x6E: official("ROR", Absolute, 6, 0, rmw((*Cpu).rorm)),
+	0x7E: official("ROR", AbsoluteX, 7, 0, rmw((*Cpu).rorm)),
+
+	// RTI, RTS
+	0x40: official("RTI", Implied, 6, 0, noOperand((*Cpu).rti)),
+	0x60: official("RTS", Implied, 6, 0, noOperand((*Cpu).rts)),
+
+	// SBC
+	0xE9: official("SBC", Immediate, 2, 0, (*Cpu).sbc),
+	0xE5: official("SBC", ZeroPage, 3, 0, (*Cpu).sbc),
+	0xF5: official("SBC", ZeroPageX, 4, 0, (*Cpu).sbc),
+	0xED: official("SBC", Absolute, 4, 0, (*Cpu).sbc),
+	0xFD: official("SBC", AbsoluteX, 4, 1, (*Cpu).sbc),
+	0xF9: official("SBC", AbsoluteY, 4, 1, (*Cpu).sbc),
+	0xE1: official("SBC", IndirectX, 6, 0, (*Cpu).sbc),
+	0xF1: official("SBC", IndirectY, 5, 1, (*Cpu).sbc),
+
+	// STA
+	0x85: official("STA", ZeroPage, 3, 0, onRegister((*Cpu).st, A)),
+	0x95: official("STA", ZeroPageX, 4, 0, onRegister((*Cpu).st, A)),
+	0x8D: official("STA", Absolute, 4, 0, onRegister((*Cpu).st, A)),
+	0x9D: official("STA", AbsoluteX, 5, 0, onRegister((*Cpu).st, A)),
+	0x99: official("STA", AbsoluteY, 5, 0, onRegister((*Cpu).st, A)),
+	0x81: official("STA", IndirectX, 6, 0, onRegister((*Cpu).st, A)),
+	0x91: official("STA", IndirectY, 6, 0, onRegister((*Cpu).st, A)),
+
+	// STX
+	0x86: official("STX", ZeroPage, 3, 0, onRegister((*Cpu).st, X)),
+	0x96: official("STX", ZeroPageY, 4, 0, onRegister((*Cpu).st, X)),
+	0x8E: official("STX", Absolute, 4, 0, onRegister((*Cpu).st, X)),
+
+	// STY
+	0x84: official("STY", ZeroPage, 3, 0, onRegister((*Cpu).st, Y)),
+	0x94: official("STY", ZeroPageX, 4, 0, onRegister((*Cpu).st, Y)),
+	0x8C: official("STY", Absolute, 4, 0, onRegister((*Cpu).st, Y)),
+
+	// transfers
+	0xAA: official("TAX", Implied, 2, 0, register((*Cpu).taxy, X)),
+	0xA8: official("TAY", Implied, 2, 0, register((*Cpu).taxy, Y)),
+	0xBA: official("TSX", Implied, 2, 0, noOperand((*Cpu).tsx)),
+	0x8A: official("TXA", Implied, 2, 0, register((*Cpu).txya, X)),
+	0x9A: official("TXS", Implied, 2, 0, noOperand((*Cpu).txs)),
+	0x98: official("TYA", Implied, 2, 0, register((*Cpu).txya, Y)),
+
+	// SLO
+	0x07: undocumented("SLO", ZeroPage, 5, 0, (*Cpu).slo),
+	0x17: undocumented("SLO", ZeroPageX, 6, 0, (*Cpu).slo),
+	0x0F: undocumented("SLO", Absolute, 6, 0, (*Cpu).slo),
+	0x1F: undocumented("SLO", AbsoluteX, 7, 0, (*Cpu).slo),
+	0x1B: undocumented("SLO", AbsoluteY, 7, 0, (*Cpu).slo),
+	0x03: undocumented("SLO", IndirectX, 8, 0, (*Cpu).slo),
+	0x13: undocumented("SLO", IndirectY, 8, 0, (*Cpu).slo),
+
+	// RLA
+	0x27: undocumented("RLA", ZeroPage, 5, 0, (*Cpu).rla),
+	0x37: undocumented("RLA", ZeroPageX, 6, 0, (*Cpu).rla),
+	0x2F: undocumented("RLA", Absolute, 6, 0, (*Cpu).rla),
+	0x3F: undocumented("RLA", AbsoluteX, 7, 0, (*Cpu).rla),
+	0x3B: undocumented("RLA", AbsoluteY, 7, 0, (*Cpu).rla),
+	0x23: undocumented("RLA", IndirectX, 8, 0, (*Cpu).rla),
+	0x33: undocumented("RLA", IndirectY, 8, 0, (*Cpu).rla),
+
+	// SRE
+	0x47: undocumented("SRE", ZeroPage, 5, 0, (*Cpu).sre),
+	0x57: undocumented("SRE", ZeroPageX, 6, 0, (*Cpu).sre),
+	0x4F: undocumented("SRE", Absolute, 6, 0, (*Cpu).sre),
+	0x5F: undocumented("SRE", AbsoluteX, 7, 0, (*Cpu).sre),
+	0x5B: undocumented("SRE", AbsoluteY, 7, 0, (*Cpu).sre),
+	0x43: undocumented("SRE", IndirectX, 8, 0, (*Cpu).sre),
+	0x53: undocumented("SRE", IndirectY, 8, 0, (*Cpu).sre),
+
+	// RRA
+	0x67: undocumented("RRA", ZeroPage, 5, 0, (*Cpu).rra),
+	0x77: undocumented("RRA", ZeroPageX, 6, 0, (*Cpu).rra),
+	0x6F: undocumented("RRA", Absolute, 6, 0, (*Cpu).rra),
+	0x7F: undocumented("RRA", AbsoluteX, 7, 0, (*Cpu).rra),
+	0x7B: undocumented("RRA", AbsoluteY, 7, 0, (*Cpu).rra),
+	0x63: undocumented("RRA", IndirectX, 8, 0, (*Cpu).rra),
+	0x73: undocumented("RRA", IndirectY, 8, 0, (*Cpu).rra),
+
+	// SAX
+	0x87: undocumented("SAX", ZeroPage, 3, 0, (*Cpu).sax),
+	0x97: undocumented("SAX", ZeroPageY, 4, 0, (*Cpu).sax),
+	0x8F: undocumented("SAX", Absolute, 4, 0, (*Cpu).sax),
+	0x83: undocumented("SAX", IndirectX, 6, 0, (*Cpu).sax),
+
+	// LAX
+	0xA7: undocumented("LAX", ZeroPage, 3, 0, (*Cpu).lax),
+	0xB7: undocumented("LAX", ZeroPageY, 4, 0, (*Cpu).lax),
+	0xAF: undocumented("LAX", Absolute, 4, 0, (*Cpu).lax),
+	0xBF: undocumented("LAX", AbsoluteY, 4, 1, (*Cpu).lax),
+	0xA3: undocumented("LAX", IndirectX, 6, 0, (*Cpu).lax),
+	0xB3: undocumented("LAX", IndirectY, 5, 1, (*Cpu).lax),
+
+	// DCP
+	0xC7: undocumented("DCP", ZeroPage, 5, 0, (*Cpu).dcp),
+	0xD7: undocumented("DCP", ZeroPageX, 6, 0, (*Cpu).dcp),
+	0xCF: undocumented("DCP", Absolute, 6, 0, (*Cpu).dcp),
+	0xDF: undocumented("DCP", AbsoluteX, 7, 0, (*Cpu).dcp),
+	0xDB: undocumented("DCP", AbsoluteY, 7, 0, (*Cpu).dcp),
+	0xC3: undocumented("DCP", IndirectX, 8, 0, (*Cpu).dcp),
+	0xD3: undocumented("DCP", IndirectY, 8, 0, (*Cpu).dcp),
+
+	// ISC
+	0xE7: undocumented("ISC", ZeroPage, 5, 0, (*Cpu).isc),
+	0xF7: undocumented("ISC", ZeroPageX, 6, 0, (*Cpu).isc),
+	0xEF: undocumented("ISC", Absolute, 6, 0, (*Cpu).isc),
+	0xFF: undocumented("ISC", AbsoluteX, 7, 0, (*Cpu).isc),
+	0xFB: undocumented("ISC", AbsoluteY, 7, 0, (*Cpu).isc),
+	0xE3: undocumented("ISC", IndirectX, 8, 0, (*Cpu).isc),
+	0xF3: undocumented("ISC", IndirectY, 8, 0, (*Cpu).isc),
+
+	// immediates
+	0x0B: undocumented("ANC", Immediate, 2, 0, (*Cpu).anc),
+	0x2B: undocumented("ANC", Immediate, 2, 0, (*Cpu).anc),
+	0x4B: undocumented("ALR", Immediate, 2, 0, (*Cpu).alr),
+	0x6B: undocumented("ARR", Immediate, 2, 0, (*Cpu).arr),
+	0xCB: undocumented("SBX", Immediate, 2, 0, (*Cpu).sbx),
+	0xEB: undocumented("SBC", Immediate, 2, 0, (*Cpu).sbc),
+
+	// NOPs
+	0x1A: undocumented("NOP", Implied, 2, 0, noOperand((*Cpu).nop)),
+	0x3A: undocumented("NOP", Implied, 2, 0, noOperand((*Cpu).nop)),
+	0x5A: undocumented("NOP", Implied, 2, 0, noOperand((*Cpu).nop)),
+	0x7A: undocumented("NOP", Implied, 2, 0, noOperand((*Cpu).nop)),
+	0xDA: undocumented("NOP", Implied, 2, 0, noOperand((*Cpu).nop)),
+	0xFA: undocumented("NOP", Implied, 2, 0, noOperand((*Cpu).nop)),
+	0x80: undocumented("NOP", Immediate, 2, 0, (*Cpu).nopm),
+	0x82: undocumented("NOP", Immediate, 2, 0, (*Cpu).nopm),
+	0x89: undocumented("NOP", Immediate, 2, 0, (*Cpu).nopm),
+	0xC2: undocumented("NOP", Immediate, 2, 0, (*Cpu).nopm),
+	0xE2: undocumented("NOP", Immediate, 2, 0, (*Cpu).nopm),
+	0x04: undocumented("NOP", ZeroPage, 3, 0, (*Cpu).nopm),
+	0x44: undocumented("NOP", ZeroPage, 3, 0, (*Cpu).nopm),
+	0x64: undocumented("NOP", ZeroPage, 3, 0, (*Cpu).nopm),
+	0x14: undocumented("NOP", ZeroPageX, 4, 0, (*Cpu).nopm),
+	0x34: undocumented("NOP", ZeroPageX, 4, 0, (*Cpu).nopm),
+	0x54: undocumented("NOP", ZeroPageX, 4, 0, (*Cpu).nopm),
+	0x74: undocumented("NOP", ZeroPageX, 4, 0, (*Cpu).nopm),
+	0xD4: undocumented("NOP", ZeroPageX, 4, 0, (*Cpu).nopm),
+	0xF4: undocumented("NOP", ZeroPageX, 4, 0, (*Cpu).nopm),
+	0x0C: undocumented("NOP", Absolute, 4, 0, (*Cpu).nopm),
+	0x1C: undocumented("NOP", AbsoluteX, 4, 1, (*Cpu).nopm),
+	0x3C: undocumented("NOP", AbsoluteX, 4, 1, (*Cpu).nopm),
+	0x5C: undocumented("NOP", AbsoluteX, 4, 1, (*Cpu).nopm),
+	0x7C: undocumented("NOP", AbsoluteX, 4, 1, (*Cpu).nopm),
+	0xDC: undocumented("NOP", AbsoluteX, 4, 1, (*Cpu).nopm),
+	0xFC: undocumented("NOP", AbsoluteX, 4, 1, (*Cpu).nopm),
+
+	// JAM
+	0x02: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0x12: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0x22: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0x32: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0x42: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0x52: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0x62: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0x72: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0x92: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0xB2: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0xD2: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+	0xF2: undocumented("JAM", Implied, 2, 0, noOperand((*Cpu).jam)),
+
+	// unstable
+	0x8B: unstable("XAA", Immediate, 2, 0, (*Cpu).xaa),
+	0xAB: unstable("LXA", Immediate, 2, 0, (*Cpu).lxa),
+	0x9F: unstable("AHX", AbsoluteY, 5, 0, (*Cpu).ahx),
+	0x93: unstable("AHX", IndirectY, 6, 0, (*Cpu).ahx),
+	0x9B: unstable("TAS", AbsoluteY, 5, 0, (*Cpu).tas),
+	0x9C: unstable("SHY", AbsoluteX, 5, 0, (*Cpu).shy),
+	0x9E: unstable("SHX", AbsoluteY, 5, 0, (*Cpu).shx),
+	0xBB: unstable("LAS", AbsoluteY, 4, 1, (*Cpu).las),
+}
+
+// The WDC 65C02
+var cmosInstructions = cmosInstructionSet()
+
+func cmosInstructionSet() (set [256]instruction) {
+	// the documented opcodes of the NMOS part. The rest are one byte, one
+	// cycle NOPs, unless replaced below
+	for i, inst := range nmosInstructions {
+		if inst.Status == Official {
+			set[i] = inst
+		} else {
+			set[i] = reserved(Implied, 1)
+		}
+	}
+
+	// JMP ($xxFF) takes a cycle to fix the page wrap bug
+	set[0x6C].Cycles = 6
+
+	// the shifts only take the indexing cycle on a page crossing
+	for _, i := range []uint8{0x1E, 0x3E, 0x5E, 0x7E} {
+		set[i].Cycles, set[i].PageCross = 6, 1
+	}
+
+	// (zp)
+	set[0x12] = official("ORA", ZeroPageIndirect, 5, 0, (*Cpu).ora)
+	set[0x32] = official("AND", ZeroPageIndirect, 5, 0, (*Cpu).and)
+	set[0x52] = official("EOR", ZeroPageIndirect, 5, 0, (*Cpu).eor)
+	set[0x72] = official("ADC", ZeroPageIndirect, 5, 0, (*Cpu).adc)
+	set[0x92] = official("STA", ZeroPageIndirect, 5, 0, onRegister((*Cpu).st, A))
+	set[0xB2] = official("LDA", ZeroPageIndirect, 5, 0, onRegister((*Cpu).ldr, A))
+	set[0xD2] = official("CMP", ZeroPageIndirect, 5, 0, onRegister((*Cpu).cmp, A))
+	set[0xF2] = official("SBC", ZeroPageIndirect, 5, 0, (*Cpu).sbc)
+
+	// BIT
+	set[0x89] = official("BIT", Immediate, 2, 0, (*Cpu).biti)
+	set[0x34] = official("BIT", ZeroPageX, 4, 0, (*Cpu).bit)
+	set[0x3C] = official("BIT", AbsoluteX, 4, 1, (*Cpu).bit)
+
+	// BRA
+	set[0x80] = official("BRA", Relative, 2, 1, (*Cpu).branch)
+
+	// INC A, DEC A
+	set[0x1A] = official("INC", Accumulator, 2, 0, noOperand((*Cpu).inca))
+	set[0x3A] = official("DEC", Accumulator, 2, 0, noOperand((*Cpu).deca))
+
+	// JMP (abs,X)
+	set[0x7C] = official("JMP", AbsoluteIndirectX, 6, 0, (*Cpu).jmp)
+
+	// stack
+	set[0xDA] = official("PHX", Implied, 3, 0, register((*Cpu).phxy, X))
+	set[0x5A] = official("PHY", Implied, 3, 0, register((*Cpu).phxy, Y))
+	set[0xFA] = official("PLX", Implied, 4, 0, register((*Cpu).plxy, X))
+	set[0x7A] = official("PLY", Implied, 4, 0, register((*Cpu).plxy, Y))
+
+	// STZ
+	set[0x64] = official("STZ", ZeroPage, 3, 0, (*Cpu).stz)
+	set[0x74] = official("STZ", ZeroPageX, 4, 0, (*Cpu).stz)
+	set[0x9C] = official("STZ", Absolute, 4, 0, (*Cpu).stz)
+	set[0x9E] = official("STZ", AbsoluteX, 5, 0, (*Cpu).stz)
+
+	// TRB, TSB
+	set[0x14] = official("TRB", ZeroPage, 5, 0, (*Cpu).trb)
+	set[0x1C] = official("TRB", Absolute, 6, 0, (*Cpu).trb)
+	set[0x04] = official("TSB", ZeroPage, 5, 0, (*Cpu).tsb)
+	set[0x0C] = official("TSB", Absolute, 6, 0, (*Cpu).tsb)
+
+	// RMB, SMB, BBR, BBS
+	for bit := uint8(0); bit < 8; bit++ {
+		n := string('0' + bit)
+		set[0x07|bit<<4] = official("RMB"+n, ZeroPage, 5, 0, onBit((*Cpu).rmb, bit))
+		set[0x87|bit<<4] = official("SMB"+n, ZeroPage, 5, 0, onBit((*Cpu).smb, bit))
+		set[0x0F|bit<<4] = official("BBR"+n, ZeroPageRelative, 5, 1, branchOnBit((*Cpu).bbr, bit))
+		set[0x8F|bit<<4] = official("BBS"+n, ZeroPageRelative, 5, 1, branchOnBit((*Cpu).bbs, bit))
+	}
+
+	// WAI, STP
+	set[0xCB] = official("WAI", Implied, 3, 0, noOperand((*Cpu).wai))
+	set[0xDB] = official("STP", Implied, 3, 0, noOperand((*Cpu).stp))
+
+	// the reserved opcodes that take operands
+	for _, i := range []uint8{0x02, 0x22, 0x42, 0x62, 0x82, 0xC2, 0xE2} {
+		set[i] = reserved(Immediate, 2)
+	}
+	set[0x44] = reserved(ZeroPage, 3)
+	for _, i := range []uint8{0x54, 0xD4, 0xF4} {
+		set[i] = reserved(ZeroPageX, 4)
+	}
+	set[0xDC] = reserved(Absolute, 4)
+	set[0xFC] = reserved(Absolute, 4)
+	// reads its operand, then spends four more cycles the model has no
+	// accesses for. Tick approximates them by reading from the PC
+	set[0x5C] = reserved(Absolute, 8)
+
+	return
+}
@@ -0,0 +1,94 @@
+package mos6502
+
+import (
+	"testing"
+)
+
+func TestOpcodesComplete(t *testing.T) {
+	for _, variant := range []Variant{NMOS6502, WDC65C02} {
+		for i, inst := range instructionSet(variant) {
+			if inst.Mnemonic == "" || inst.run == nil {
+				t.Errorf("Variant %d: opcode %02X missing", variant, i)
+				continue
+			}
+			if inst.Bytes != inst.Mode.Bytes() {
+				t.Errorf("Variant %d: opcode %02X takes %d bytes, its mode %d", variant, i, inst.Bytes, inst.Mode.Bytes())
+			}
+			if inst.Cycles < 1 {
+				t.Errorf("Variant %d: opcode %02X takes %d cycles", variant, i, inst.Cycles)
+			}
+		}
+	}
+}
+
+func TestOpcodes(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		variant Variant
+		opcode  uint8
+		// Expected
+		exp Opcode
+	}{
+		{name: "LDA immediate",
+			variant: NMOS6502, opcode: 0xA9,
+			exp: Opcode{Mnemonic: "LDA", Mode: Immediate, Bytes: 2, Cycles: 2},
+		},
+		{name: "LDA absolute,X",
+			variant: NMOS6502, opcode: 0xBD,
+			exp: Opcode{Mnemonic: "LDA", Mode: AbsoluteX, Bytes: 3, Cycles: 4, PageCross: 1},
+		},
+		{name: "STA absolute,X",
+			variant: NMOS6502, opcode: 0x9D,
+			exp: Opcode{Mnemonic: "STA", Mode: AbsoluteX, Bytes: 3, Cycles: 5},
+		},
+		{name: "BNE",
+			variant: NMOS6502, opcode: 0xD0,
+			exp: Opcode{Mnemonic: "BNE", Mode: Relative, Bytes: 2, Cycles: 2, PageCross: 1},
+		},
+		{name: "JSR",
+			variant: NMOS6502, opcode: 0x20,
+			exp: Opcode{Mnemonic: "JSR", Mode: Absolute, Bytes: 3, Cycles: 6},
+		},
+		{name: "LAX (zp),Y",
+			variant: NMOS6502, opcode: 0xB3,
+			exp: Opcode{Mnemonic: "LAX", Mode: IndirectY, Bytes: 2, Cycles: 5, PageCross: 1, Status: Undocumented},
+		},
+		{name: "XAA",
+			variant: NMOS6502, opcode: 0x8B,
+			exp: Opcode{Mnemonic: "XAA", Mode: Immediate, Bytes: 2, Cycles: 2, Status: Unstable},
+		},
+		{name: "2A03 shares the NMOS table",
+			variant: RICOH2A03, opcode: 0x6C,
+			exp: Opcode{Mnemonic: "JMP", Mode: Indirect, Bytes: 3, Cycles: 5},
+		},
+		{name: "65C02 JMP indirect",
+			variant: WDC65C02, opcode: 0x6C,
+			exp: Opcode{Mnemonic: "JMP", Mode: Indirect, Bytes: 3, Cycles: 6},
+		},
+		{name: "65C02 ASL absolute,X",
+			variant: WDC65C02, opcode: 0x1E,
+			exp: Opcode{Mnemonic: "ASL", Mode: AbsoluteX, Bytes: 3, Cycles: 6, PageCross: 1},
+		},
+		{name: "65C02 LDA (zp)",
+			variant: WDC65C02, opcode: 0xB2,
+			exp: Opcode{Mnemonic: "LDA", Mode: ZeroPageIndirect, Bytes: 2, Cycles: 5},
+		},
+		{name: "65C02 BBS3",
+			variant: WDC65C02, opcode: 0xBF,
+			exp: Opcode{Mnemonic: "BBS3", Mode: ZeroPageRelative, Bytes: 3, Cycles: 5, PageCross: 1},
+		},
+		{name: "65C02 one byte NOP",
+			variant: WDC65C02, opcode: 0x03,
+			exp: Opcode{Mnemonic: "NOP", Mode: Implied, Bytes: 1, Cycles: 1, Status: Reserved},
+		},
+		{name: "65C02 eight cycle NOP",
+			variant: WDC65C02, opcode: 0x5C,
+			exp: Opcode{Mnemonic: "NOP", Mode: Absolute, Bytes: 3, Cycles: 8, Status: Reserved},
+		},
+	} {
+		t.Log(tt.name)
+		if act := Opcodes(tt.variant)[tt.opcode]; act != tt.exp {
+			t.Errorf("Expected %+v, got %+v\n", tt.exp, act)
+		}
+	}
+}
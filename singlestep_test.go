@@ -0,0 +1,216 @@
+package mos6502
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// SingleStepTests (https://github.com/SingleStepTests/65x02): ten thousand
+// vectors per opcode, each running a single instruction from a random
+// state. The JSON files are not part of the repository: copy the ones for
+// a processor into testdata/singlestep/<processor>/, named after the opcode
+// in lowercase hex (a9.json). Missing files are skipped.
+//
+// The instruction runs a cycle at a time, through Tick, and its bus
+// accesses are compared with the cycles of the vector, but for the
+// opcodes of singleStepBusSkip.
+
+// how many failing vectors to report per opcode
+const singleStepReport = 5
+
+var singleStepProcessors = []struct {
+	dir     string
+	variant Variant
+	illegal IllegalOpcodes
+}{
+	{dir: "6502", variant: NMOS6502, illegal: IllegalAll},
+	{dir: "nes6502", variant: RICOH2A03, illegal: IllegalAll},
+	{dir: "wdc65c02", variant: WDC65C02, illegal: IllegalStable},
+}
+
+// the opcodes whose bus accesses the model only approximates, by processor
+var singleStepBusSkip = map[string]map[uint8]bool{
+	// the last four cycles of the reserved NOP read from the PC
+	"wdc65c02": {0x5C: true},
+}
+
+type singleStepState struct {
+	PC  int      `json:"pc"`
+	S   int      `json:"s"`
+	A   int      `json:"a"`
+	X   int      `json:"x"`
+	Y   int      `json:"y"`
+	P   int      `json:"p"`
+	RAM [][2]int `json:"ram"`
+}
+
+type singleStepVector struct {
+	Name    string          `json:"name"`
+	Initial singleStepState `json:"initial"`
+	Final   singleStepState `json:"final"`
+	// address, value and "read" or "write", one per cycle
+	Cycles [][3]any `json:"cycles"`
+}
+
+// a bus access, the way the vectors log them
+func busString(c BusCycle) string {
+	if c.Write {
+		return fmt.Sprintf("W %04X=%02X", c.Addr, c.Data)
+	}
+	return fmt.Sprintf("R %04X=%02X", c.Addr, c.Data)
+}
+
+func TestSingleStep(t *testing.T) {
+	for _, proc := range singleStepProcessors {
+		dir := filepath.Join("testdata", "singlestep", proc.dir)
+		t.Run(proc.dir, func(t *testing.T) {
+			if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+				t.Skipf("%s not found", dir)
+			}
+
+			for op := 0; op < 0x100; op++ {
+				t.Run(fmt.Sprintf("%02X", op), func(t *testing.T) {
+					data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%02x.json", op)))
+					if errors.Is(err, os.ErrNotExist) {
+						t.Skip("no vectors")
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					var vectors []singleStepVector
+					if err := json.Unmarshal(data, &vectors); err != nil {
+						t.Fatal(err)
+					}
+
+					failed := 0
+					for _, v := range vectors {
+						diff := runSingleStep(v, proc.variant, proc.illegal, !singleStepBusSkip[proc.dir][uint8(op)])
+						if diff == "" {
+							continue
+						}
+						if failed < singleStepReport {
+							t.Errorf("%s:\n%s", v.Name, diff)
+						}
+						failed++
+					}
+					if failed > singleStepReport {
+						t.Errorf("%d of %d vectors failed", failed, len(vectors))
+					}
+				})
+			}
+		})
+	}
+}
+
+// runSingleStep runs a vector and describes how the outcome differs from
+// the expected one, or returns "" if it does not. The bus accesses are
+// compared if checkBus is set
+func runSingleStep(v singleStepVector, variant Variant, illegal IllegalOpcodes, checkBus bool) string {
+	var mem Memory
+	for _, cell := range v.Initial.RAM {
+		mem.Write(uint16(cell[0]), uint8(cell[1]))
+	}
+
+	cpu := NewCpuVariant(&mem, variant)
+	cpu.SetIllegalOpcodes(illegal)
+	cpu.pc, cpu.sp = uint16(v.Initial.PC), uint8(v.Initial.S)
+	cpu.ac, cpu.x, cpu.y = uint8(v.Initial.A), uint8(v.Initial.X), uint8(v.Initial.Y)
+	cpu.p.setAsWord(uint8(v.Initial.P))
+
+	// ticks up to the end of the instruction, giving up well past the
+	// cycles it should take
+	var diff strings.Builder
+	var bus []BusCycle
+	for !cpu.boundary && len(bus) < len(v.Cycles)+16 {
+		cycle, err := cpu.Tick()
+		if err != nil {
+			fmt.Fprintf(&diff, "\terror: %v\n", err)
+		}
+		bus = append(bus, cycle)
+	}
+	cpu.stopTicking()
+
+	exp, act := v.Final, singleStepState{
+		PC: int(cpu.pc), S: int(cpu.sp), A: int(cpu.ac), X: int(cpu.x), Y: int(cpu.y),
+		P: int(cpu.p.getAsWord()),
+	}
+	for _, r := range []struct {
+		name     string
+		exp, act int
+	}{
+		{"pc", exp.PC, act.PC},
+		{"s", exp.S, act.S},
+		{"a", exp.A, act.A},
+		{"x", exp.X, act.X},
+		{"y", exp.Y, act.Y},
+		// bits 4 and 5 are not flags
+		{"p", exp.P &^ 0x30, act.P &^ 0x30},
+	} {
+		if r.exp != r.act {
+			fmt.Fprintf(&diff, "\t%s: expected %02X, got %02X\n", r.name, r.exp, r.act)
+		}
+	}
+
+	for _, cell := range exp.RAM {
+		if value := int(mem.Read(uint16(cell[0]))); value != cell[1] {
+			fmt.Fprintf(&diff, "\tram %04X: expected %02X, got %02X\n", cell[0], cell[1], value)
+		}
+	}
+
+	if len(bus) != len(v.Cycles) {
+		fmt.Fprintf(&diff, "\tcycles: expected %d, got %d\n", len(v.Cycles), len(bus))
+	}
+
+	if checkBus {
+		for i := 0; i < max(len(v.Cycles), len(bus)); i++ {
+			var e, a string
+			if i < len(v.Cycles) {
+				c := v.Cycles[i]
+				addr, _ := c[0].(float64)
+				value, _ := c[1].(float64)
+				e = busString(BusCycle{Addr: uint16(addr), Data: uint8(value), Write: c[2] == "write"})
+			}
+			if i < len(bus) {
+				a = busString(bus[i])
+			}
+			if e != a {
+				fmt.Fprintf(&diff, "\tbus %d: expected %q, got %q\n", i, e, a)
+			}
+		}
+	}
+
+	return diff.String()
+}
+
+// the runner itself, on a vector of the format for LDA #$80
+func TestSingleStepRunner(t *testing.T) {
+	var v singleStepVector
+	err := json.Unmarshal([]byte(`{
+		"name": "a9 80",
+		"initial": {"pc": 512, "s": 253, "a": 0, "x": 0, "y": 0, "p": 36, "ram": [[512, 169], [513, 128]]},
+		"final": {"pc": 514, "s": 253, "a": 128, "x": 0, "y": 0, "p": 164, "ram": [[512, 169], [513, 128]]},
+		"cycles": [[512, 169, "read"], [513, 128, "read"]]
+	}`), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := runSingleStep(v, NMOS6502, IllegalNone, true); diff != "" {
+		t.Errorf("Unexpected difference:\n%s", diff)
+	}
+
+	// a wrong bus log is caught
+	v.Cycles[1][0] = float64(514)
+	if exp, act := "\tbus 1: expected \"R 0202=80\", got \"R 0201=80\"\n", runSingleStep(v, NMOS6502, IllegalNone, true); act != exp {
+		t.Errorf("Expected %q, got %q\n", exp, act)
+	}
+	if diff := runSingleStep(v, NMOS6502, IllegalNone, false); diff != "" {
+		t.Errorf("Unexpected difference:\n%s", diff)
+	}
+}
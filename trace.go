@@ -0,0 +1,143 @@
+package mos6502
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Tracer logs the instructions a processor runs in the layout of
+// nestest.log, one line before each instruction:
+//
+//	C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD CYC:7
+//
+// Undocumented opcodes have a * before their mnemonic. There is no PPU
+// column, as there is no PPU: DiffTrace skips it in reference logs.
+type Tracer struct {
+	w io.Writer
+	d *Disassembler
+	// Cycles is the count of cycles run, printed on each line. Set it to
+	// start from another count, like the 7 of the reset sequence
+	// nestest.log starts with
+	Cycles int
+}
+
+// NewTracer returns a tracer writing to w. Attach it to a processor with
+// SetTracer.
+func NewTracer(w io.Writer) *Tracer {
+	return &Tracer{w: w}
+}
+
+// SetTracer starts tracing the instructions run, or stops it when t is
+// nil. The instruction bytes are read with mem.Read before the processor
+// reads them, so registers with read side effects see an extra read.
+func (cpu *Cpu) SetTracer(t *Tracer) {
+	if t != nil {
+		// a debugger doesn't see the reads of the tracer
+		mem := cpu.mem
+		if w, ok := mem.(*watchedMem); ok {
+			mem = w.mem
+		}
+		t.d = NewDisassembler(mem, cpu.variant)
+	}
+	cpu.tracer = t
+}
+
+// writes the line of the instruction at the PC
+func (t *Tracer) trace(cpu *Cpu) {
+	inst := t.d.Disassemble(cpu.pc)
+
+	var hex []string
+	for _, b := range inst.Bytes {
+		hex = append(hex, fmt.Sprintf("%02X", b))
+	}
+	mark := ' '
+	if inst.Opcode.Status != Official {
+		mark = '*'
+	}
+	text := strings.TrimSpace(inst.Opcode.Mnemonic + " " + inst.Operand)
+
+	fmt.Fprintf(t.w, "%04X  %-8s %c%-32sA:%02X X:%02X Y:%02X P:%02X SP:%02X CYC:%d\n",
+		cpu.pc, strings.Join(hex, " "), mark, text, cpu.ac, cpu.x, cpu.y, cpu.p.getAsWord(), cpu.sp, t.Cycles)
+}
+
+// TraceMismatch is the first difference between a trace and its reference
+type TraceMismatch struct {
+	// the line number, from 1
+	Line int
+	// what differs: PC, Bytes, A, X, Y, P, SP or CYC. Empty when one of
+	// the traces ends first
+	Field string
+	// the reference line and the traced one. Empty past the end of a trace
+	Exp, Act string
+}
+
+func (m *TraceMismatch) Error() string {
+	if m.Field == "" {
+		return fmt.Sprintf("line %d: expected %q, got %q", m.Line, m.Exp, m.Act)
+	}
+	return fmt.Sprintf("line %d: %s differs\nexpected %s\ngot      %s", m.Line, m.Field, m.Exp, m.Act)
+}
+
+// the fields of a trace line compared by DiffTrace, in order
+var traceFields = []string{"PC", "Bytes", "A", "X", "Y", "P", "SP", "CYC"}
+
+var (
+	traceLineRe = regexp.MustCompile(`^([0-9A-Fa-f]{4})  ((?:[0-9A-Fa-f]{2} ?){1,3})`)
+	traceRegRe  = regexp.MustCompile(`\b(A|X|Y|P|SP|CYC):\s*([0-9A-Fa-f]+)`)
+)
+
+// parses the fields of a trace line
+func parseTraceLine(line string) map[string]string {
+	fields := map[string]string{}
+	if m := traceLineRe.FindStringSubmatch(line); m != nil {
+		fields["PC"] = strings.ToUpper(m[1])
+		fields["Bytes"] = strings.ToUpper(strings.TrimSpace(m[2]))
+	}
+	for _, m := range traceRegRe.FindAllStringSubmatch(line, -1) {
+		fields[m[1]] = strings.ToUpper(m[2])
+	}
+	return fields
+}
+
+// DiffTrace compares a trace with a reference log, like nestest.log, line by
+// line, and returns a *TraceMismatch for the first line that differs. It
+// returns nil when they match. Only the fields found in both lines are
+// compared, so the disassembly, and its annotations in nestest.log, don't
+// count, and neither does CYC if the reference has none.
+func DiffTrace(ref, act io.Reader) error {
+	refLines, actLines := bufio.NewScanner(ref), bufio.NewScanner(act)
+
+	for n := 1; ; n++ {
+		refOk, actOk := refLines.Scan(), actLines.Scan()
+		if !refOk || !actOk {
+			if err := refLines.Err(); err != nil {
+				return err
+			}
+			if err := actLines.Err(); err != nil {
+				return err
+			}
+			if refOk || actOk {
+				m := &TraceMismatch{Line: n}
+				if refOk {
+					m.Exp = refLines.Text()
+				} else {
+					m.Act = actLines.Text()
+				}
+				return m
+			}
+			return nil
+		}
+
+		exp, got := parseTraceLine(refLines.Text()), parseTraceLine(actLines.Text())
+		for _, field := range traceFields {
+			e, eOk := exp[field]
+			a, aOk := got[field]
+			if eOk && aOk && e != a {
+				return &TraceMismatch{Line: n, Field: field, Exp: refLines.Text(), Act: actLines.Text()}
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package mos6502
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// the first lines of nestest.log
+const nestestStart = `C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7
+C5F5  A2 00     LDX #$00                        A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 30 CYC:10
+C5F7  86 00     STX $00 = 00                    A:00 X:00 Y:00 P:26 SP:FD PPU:  0, 36 CYC:12
+C5F9  86 10     STX $10 = 00                    A:00 X:00 Y:00 P:26 SP:FD PPU:  0, 45 CYC:15
+`
+
+func nestestCpu() (*Cpu, *strings.Builder) {
+	var mem Memory
+	for addr, code := range map[uint16][]uint8{
+		0xC000: {0x4C, 0xF5, 0xC5},
+		0xC5F5: {0xA2, 0x00, 0x86, 0x00, 0x86, 0x10, 0x04, 0x10},
+	} {
+		for i, b := range code {
+			mem.Write(addr+uint16(i), b)
+		}
+	}
+
+	cpu := &Cpu{mem: &mem, pc: 0xC000, sp: 0xFD}
+	cpu.p.i = 1
+	var log strings.Builder
+	tracer := NewTracer(&log)
+	tracer.Cycles = 7
+	cpu.SetTracer(tracer)
+	return cpu, &log
+}
+
+func TestTracer(t *testing.T) {
+	cpu, log := nestestCpu()
+	for i := 0; i < 5; i++ {
+		cpu.Step()
+	}
+
+	exp := `C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD CYC:7
+C5F5  A2 00     LDX #$00                        A:00 X:00 Y:00 P:24 SP:FD CYC:10
+C5F7  86 00     STX $00                         A:00 X:00 Y:00 P:26 SP:FD CYC:12
+C5F9  86 10     STX $10                         A:00 X:00 Y:00 P:26 SP:FD CYC:15
+C5FB  04 10    *NOP $10                         A:00 X:00 Y:00 P:26 SP:FD CYC:18
+`
+	if act := log.String(); act != exp {
+		t.Errorf("Expected\n%s\ngot\n%s", exp, act)
+	}
+
+	// detached
+	cpu.SetTracer(nil)
+	cpu.Step()
+	if act := log.String(); act != exp {
+		t.Errorf("Expected\n%s\ngot\n%s", exp, act)
+	}
+}
+
+func TestDiffTrace(t *testing.T) {
+	cpu, log := nestestCpu()
+	for i := 0; i < 4; i++ {
+		cpu.Step()
+	}
+
+	// the PPU column and the annotations of nestest.log don't count
+	if err := DiffTrace(strings.NewReader(nestestStart), strings.NewReader(log.String())); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		ref  string
+		// Expected
+		line  int
+		field string
+	}{
+		{name: "Status",
+			ref: strings.Replace(nestestStart, "P:26 SP:FD PPU:  0, 36", "P:27 SP:FD PPU:  0, 36", 1), line: 3, field: "P"},
+		{name: "Cycles",
+			ref: strings.Replace(nestestStart, "CYC:15", "CYC:16", 1), line: 4, field: "CYC"},
+		{name: "Bytes",
+			ref: strings.Replace(nestestStart, "A2 00", "A2 01", 1), line: 2, field: "Bytes"},
+		{name: "Reference goes on",
+			ref: nestestStart + "C5FB  86 11     STX $11 = 00                    A:00 X:00 Y:00 P:26 SP:FD PPU:  0, 54 CYC:18\n", line: 5},
+	} {
+		t.Log(tt.name)
+		err := DiffTrace(strings.NewReader(tt.ref), strings.NewReader(log.String()))
+		var m *TraceMismatch
+		if !errors.As(err, &m) {
+			t.Errorf("Expected a TraceMismatch, got %v", err)
+			continue
+		}
+		if m.Line != tt.line || m.Field != tt.field {
+			t.Errorf("Expected line %d %q, got %+v\n", tt.line, tt.field, m)
+		}
+	}
+}